@@ -0,0 +1,901 @@
+package gamemitm
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAdminMaxFlows is the number of recent flows kept by the admin
+	// API
+	DefaultAdminMaxFlows = 1000
+	// DefaultAdminMaxFlowBytes is the memory budget of the flows kept by the
+	// admin API
+	DefaultAdminMaxFlowBytes = 256 << 20
+)
+
+// AdminConfig configures the admin API, see ProxyServer.ListenAdmin
+type AdminConfig struct {
+	// Token, when set, must be sent as "Authorization: Bearer <token>";
+	// GET /api/events also takes it as the token query parameter since
+	// browsers cannot set headers on event streams. Without a token the API
+	// only listens on loopback addresses.
+	Token string
+	// Hosts are the host names besides localhost the API is reached by, the
+	// Host header of other names is rejected so pages of other sites cannot
+	// reach the API through DNS rebinding. IP addresses are always accepted.
+	Hosts []string
+	// MaxFlows is the number of recent flows kept, DefaultAdminMaxFlows
+	// when 0
+	MaxFlows int
+	// MaxFlowBytes is the memory budget of the kept flows, counting their
+	// bodies and WebSocket messages; the oldest flows are dropped to stay
+	// within it. DefaultAdminMaxFlowBytes when 0 and no budget when
+	// negative
+	MaxFlowBytes int64
+	// MaxBodySize is the number of bytes kept of each body, before and
+	// after decompression, DefaultCaptureSize when 0 and no limit when
+	// negative
+	MaxBodySize int64
+}
+
+// ConnInfo describes an active client connection
+type ConnInfo struct {
+	ID     uint64 `json:"id"`
+	Client string `json:"client"`
+	// Target is the intercepted "host:port", empty for connections to the
+	// proxy port that did not open a tunnel
+	Target string    `json:"target"`
+	Start  time.Time `json:"start"`
+}
+
+// SessionInfo describes an active WebSocket session
+type SessionInfo struct {
+	ID     uint64    `json:"id"`
+	URL    string    `json:"url"`
+	Client string    `json:"client"`
+	Start  time.Time `json:"start"`
+	// FlowID is the flow the messages are recorded in, 0 without flow
+	// observers
+	FlowID uint64 `json:"flowId,omitempty"`
+	// Replayed is set for sessions answered by Replay, they have no server
+	Replayed bool `json:"replayed"`
+}
+
+// liveRegistry tracks the active connections and WebSocket sessions
+type liveRegistry struct {
+	mu       sync.Mutex
+	seq      uint64
+	conns    map[net.Conn]*ConnInfo
+	sessions map[uint64]*liveSession
+}
+
+type liveSession struct {
+	info SessionInfo
+	ctx  *ProxyCtx
+}
+
+// trackConn registers an accepted client connection, see untrackConn
+func (p *ProxyServer) trackConn(conn net.Conn, target string) {
+	live := &p.live
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	if live.conns == nil {
+		live.conns = make(map[net.Conn]*ConnInfo)
+	}
+	live.seq++
+	info := &ConnInfo{ID: live.seq, Target: target, Start: time.Now()}
+	if addr := conn.RemoteAddr(); addr != nil {
+		info.Client = addr.String()
+	}
+	live.conns[conn] = info
+}
+
+func (p *ProxyServer) untrackConn(conn net.Conn) {
+	p.live.mu.Lock()
+	delete(p.live.conns, conn)
+	p.live.mu.Unlock()
+}
+
+// trackSession registers the WebSocket session of ctx and returns a
+// function removing it
+func (p *ProxyServer) trackSession(ctx *ProxyCtx) (untrack func()) {
+	live := &p.live
+	live.mu.Lock()
+	defer live.mu.Unlock()
+	if live.sessions == nil {
+		live.sessions = make(map[uint64]*liveSession)
+	}
+	live.seq++
+	id := live.seq
+	info := SessionInfo{
+		ID:       id,
+		URL:      ctx.Req.URL.String(),
+		Client:   ctx.Req.RemoteAddr,
+		Start:    time.Now(),
+		Replayed: ctx.WSSession.Server == nil,
+	}
+	if ctx.flow != nil {
+		info.FlowID = ctx.flow.flow.ID
+	}
+	live.sessions[id] = &liveSession{info: info, ctx: ctx}
+	return func() {
+		live.mu.Lock()
+		delete(live.sessions, id)
+		live.mu.Unlock()
+	}
+}
+
+// Connections returns the active client connections, oldest first
+func (p *ProxyServer) Connections() []ConnInfo {
+	p.live.mu.Lock()
+	list := make([]ConnInfo, 0, len(p.live.conns))
+	for _, info := range p.live.conns {
+		list = append(list, *info)
+	}
+	p.live.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CloseConnection closes the client connection with the given ID, it
+// reports whether the connection was found
+func (p *ProxyServer) CloseConnection(id uint64) bool {
+	p.live.mu.Lock()
+	var conn net.Conn
+	for c, info := range p.live.conns {
+		if info.ID == id {
+			conn = c
+			break
+		}
+	}
+	p.live.mu.Unlock()
+	if conn == nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Sessions returns the active WebSocket sessions, oldest first
+func (p *ProxyServer) Sessions() []SessionInfo {
+	p.live.mu.Lock()
+	list := make([]SessionInfo, 0, len(p.live.sessions))
+	for _, s := range p.live.sessions {
+		list = append(list, s.info)
+	}
+	p.live.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// liveSession returns the session with the given ID, nil if it ended
+func (p *ProxyServer) liveSession(id uint64) *liveSession {
+	p.live.mu.Lock()
+	defer p.live.mu.Unlock()
+	return p.live.sessions[id]
+}
+
+// flowLog keeps the most recent flows within a number of flows and a
+// byte budget, the newest flow is kept even if it alone exceeds the budget
+type flowLog struct {
+	mu       sync.Mutex
+	flows    []*Flow
+	size     int64
+	maxFlows int
+	maxBytes int64
+}
+
+func newFlowLog(maxFlows int, maxBytes int64) *flowLog {
+	return &flowLog{maxFlows: maxFlows, maxBytes: maxBytes}
+}
+
+// add keeps f, dropping the oldest flows beyond the limits
+func (l *flowLog) add(f *Flow) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flows = append(l.flows, f)
+	l.size += flowSize(f)
+	for len(l.flows) > 1 && (len(l.flows) > l.maxFlows || (l.maxBytes > 0 && l.size > l.maxBytes)) {
+		l.size -= flowSize(l.flows[0])
+		l.flows[0] = nil
+		l.flows = l.flows[1:]
+	}
+}
+
+// list returns the kept flows, oldest first
+func (l *flowLog) list() []*Flow {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*Flow(nil), l.flows...)
+}
+
+// get returns the kept flow with the given ID, nil if it was dropped
+func (l *flowLog) get(id uint64) *Flow {
+	for _, f := range l.list() {
+		if f.ID == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// flowSize is the number of bytes of the bodies and messages of f
+func flowSize(f *Flow) int64 {
+	n := len(f.Request.Body) + len(f.Request.OriginalBody)
+	if f.Response != nil {
+		n += len(f.Response.Body) + len(f.Response.OriginalBody)
+	}
+	for _, m := range f.Messages {
+		n += len(m.Data) + len(m.OriginalData)
+	}
+	return int64(n)
+}
+
+// keptFlow returns the copy of f kept by the admin API, without the
+// context of the exchange and with the bodies cut at limit. Other
+// observers may have asked for more of the bodies.
+func keptFlow(f *Flow, limit int64) *Flow {
+	kept := *f
+	kept.ctx = nil
+	if limit <= 0 {
+		return &kept
+	}
+	req := *f.Request
+	var cut, cutOriginal bool
+	req.Body, cut = cutBody(req.Body, limit)
+	req.OriginalBody, cutOriginal = cutBody(req.OriginalBody, limit)
+	req.Truncated = req.Truncated || cut || cutOriginal
+	kept.Request = &req
+	if f.Response != nil {
+		resp := *f.Response
+		resp.Body, cut = cutBody(resp.Body, limit)
+		resp.OriginalBody, cutOriginal = cutBody(resp.OriginalBody, limit)
+		resp.Truncated = resp.Truncated || cut || cutOriginal
+		kept.Response = &resp
+	}
+	return &kept
+}
+
+// cutBody returns a copy of the first limit bytes of body when it is
+// longer, so the rest can be freed
+func cutBody(body []byte, limit int64) ([]byte, bool) {
+	if int64(len(body)) <= limit {
+		return body, false
+	}
+	return append([]byte(nil), body[:limit]...), true
+}
+
+// flowSummary is a flow in the flow list of the admin API
+type flowSummary struct {
+	ID         uint64    `json:"id"`
+	Start      time.Time `json:"start"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	// Size is the length of the response body sent to the client
+	Size     int           `json:"size"`
+	Duration time.Duration `json:"duration"`
+	Messages int           `json:"messages"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func summarizeFlow(f *Flow) flowSummary {
+	s := flowSummary{
+		ID:       f.ID,
+		Start:    f.Start,
+		Method:   f.Request.Method,
+		URL:      f.Request.URL,
+		Duration: f.Timings.Send + f.Timings.Wait + f.Timings.Receive,
+		Messages: len(f.Messages),
+		Error:    f.Error,
+	}
+	if f.Response != nil {
+		s.StatusCode = f.Response.StatusCode
+		s.Size = len(f.Response.Body)
+	}
+	return s
+}
+
+// adminAPI serves the admin API of a proxy
+type adminAPI struct {
+	p     *ProxyServer
+	cfg   AdminConfig
+	flows *flowLog
+	ui    http.Handler
+
+	// resent maps the requests sent by resend to the ID of their flow
+	resent sync.Map
+
+	subMu sync.Mutex
+	subs  map[chan adminEvent]struct{}
+}
+
+// adminEvent is a server-sent event of /api/events
+type adminEvent struct {
+	name string
+	data []byte
+}
+
+// CaptureFlow records every flow with the body limit of the config
+func (a *adminAPI) CaptureFlow(ctx *ProxyCtx) (int64, bool) {
+	return captureLimit(a.cfg.MaxBodySize), true
+}
+
+func (a *adminAPI) ObserveFlow(f *Flow) {
+	if f.ctx != nil {
+		if _, ok := a.resent.Load(f.ctx.Req); ok {
+			a.resent.Store(f.ctx.Req, f.ID)
+		}
+	}
+	kept := keptFlow(f, captureLimit(a.cfg.MaxBodySize))
+	a.flows.add(kept)
+	a.publish("flow", summarizeFlow(kept))
+}
+
+func (a *adminAPI) ObserveMessage(flowID uint64, m *FlowMessage) {
+	a.publish("message", struct {
+		FlowID  uint64       `json:"flowId"`
+		Message *FlowMessage `json:"message"`
+	}{flowID, m})
+}
+
+// publish sends an event to the subscribers, events are dropped for
+// subscribers that do not keep up
+func (a *adminAPI) publish(name string, v any) {
+	a.subMu.Lock()
+	defer a.subMu.Unlock()
+	if len(a.subs) == 0 {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	for ch := range a.subs {
+		select {
+		case ch <- adminEvent{name: name, data: data}:
+		default:
+		}
+	}
+}
+
+func (a *adminAPI) subscribe() chan adminEvent {
+	ch := make(chan adminEvent, 256)
+	a.subMu.Lock()
+	if a.subs == nil {
+		a.subs = make(map[chan adminEvent]struct{})
+	}
+	a.subs[ch] = struct{}{}
+	a.subMu.Unlock()
+	return ch
+}
+
+func (a *adminAPI) unsubscribe(ch chan adminEvent) {
+	a.subMu.Lock()
+	delete(a.subs, ch)
+	a.subMu.Unlock()
+}
+
+// ListenAdmin serves a JSON API on addr for inspecting and controlling the
+// proxy while it runs, and the web UI at "/". It blocks until Stop is
+// called. The API exposes decrypted traffic, addr must be a loopback
+// address unless cfg.Token is set; the UI then takes the token as
+// "/?token=<token>". Requests changing state must be sent as
+// application/json, and requests from pages of other origins are
+// rejected.
+//
+//	GET    /api/connections              active client connections
+//	DELETE /api/connections/{id}         close a connection
+//	GET    /api/sessions                 active WebSocket sessions
+//	DELETE /api/sessions/{id}            close a session
+//	GET    /api/sessions/{id}/messages   messages relayed so far
+//	POST   /api/sessions/{id}/messages   inject {"to", "type", "data", "base64"}
+//	GET    /api/flows?limit=n            recent flows
+//	GET    /api/flows/{id}               a flow with headers, bodies and messages
+//	GET    /api/flows/{id}/body?part=request|response&original=1
+//	                                     a body without Content-Encoding
+//	POST   /api/flows/{id}/replay        send the request of a flow again
+//	POST   /api/requests                 send a request, a FlowRequest in JSON
+//	GET    /api/events                   server-sent "flow" and "message" events
+//	GET    /api/handlers                 registered handlers
+//	PUT    /api/handlers/{id}            {"enabled": bool}
+//	GET    /api/verbose, PUT /api/verbose {"verbose": bool}
+//	GET    /api/ca?format=der            the CA certificate, PEM by default
+func (p *ProxyServer) ListenAdmin(addr string, cfg AdminConfig) error {
+	if cfg.MaxFlows <= 0 {
+		cfg.MaxFlows = DefaultAdminMaxFlows
+	}
+	if cfg.MaxFlowBytes == 0 {
+		cfg.MaxFlowBytes = DefaultAdminMaxFlowBytes
+	}
+	if cfg.Token == "" && !isLoopbackAddr(addr) {
+		return fmt.Errorf("admin API on %s requires a token, only loopback addresses may be used without one", addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	api := &adminAPI{p: p, cfg: cfg, flows: newFlowLog(cfg.MaxFlows, cfg.MaxFlowBytes), ui: webUIHandler()}
+	defer p.AddFlowObserver(api)()
+	server := &http.Server{Handler: api}
+	p.trackListener(server)
+	p.logger.Info("Starting admin API on %s", l.Addr())
+	if err := server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 防止 DNS 重绑定，页面也只通过允许的主机名提供
+	if !a.allowedHost(r.Host) {
+		adminError(w, http.StatusForbidden, "host "+r.Host+" not allowed")
+		return
+	}
+	path, ok := strings.CutPrefix(r.URL.Path, "/api/")
+	if !ok {
+		// 页面本身不含数据，令牌由页面在调用接口时带上
+		a.ui.ServeHTTP(w, r)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(origin, r.Host) {
+		adminError(w, http.StatusForbidden, "origin "+origin+" not allowed")
+		return
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if !a.authorized(r, parts[0]) {
+		adminError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	// 其他站点的表单只能发送简单请求，要求 JSON 使跨站请求无法直接改变状态
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+			adminError(w, http.StatusUnsupportedMediaType, "requests must be sent as application/json")
+			return
+		}
+	}
+	var id uint64
+	if len(parts) > 1 {
+		var err error
+		if id, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			adminError(w, http.StatusBadRequest, "invalid id "+parts[1])
+			return
+		}
+	}
+
+	route := parts[0]
+	if len(parts) > 1 {
+		route += "/{id}"
+	}
+	if len(parts) > 2 {
+		route += "/" + strings.Join(parts[2:], "/")
+	}
+	switch r.Method + " " + route {
+	case "GET connections":
+		writeJSON(w, http.StatusOK, a.p.Connections())
+	case "DELETE connections/{id}":
+		if !a.p.CloseConnection(id) {
+			adminError(w, http.StatusNotFound, "connection not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "GET sessions":
+		writeJSON(w, http.StatusOK, a.p.Sessions())
+	case "DELETE sessions/{id}":
+		s := a.p.liveSession(id)
+		if s == nil {
+			adminError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		s.ctx.WSSession.Close()
+		w.WriteHeader(http.StatusNoContent)
+	case "GET sessions/{id}/messages":
+		s := a.p.liveSession(id)
+		if s == nil {
+			adminError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		messages := s.ctx.flow.messages()
+		if messages == nil {
+			messages = []*FlowMessage{}
+		}
+		writeJSON(w, http.StatusOK, messages)
+	case "POST sessions/{id}/messages":
+		a.injectMessage(w, r, id)
+	case "GET flows":
+		a.listFlows(w, r)
+	case "GET flows/{id}":
+		f := a.flows.get(id)
+		if f == nil {
+			adminError(w, http.StatusNotFound, "flow not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, f)
+	case "GET flows/{id}/body":
+		f := a.flows.get(id)
+		if f == nil {
+			adminError(w, http.StatusNotFound, "flow not found")
+			return
+		}
+		a.flowBody(w, r, f)
+	case "POST flows/{id}/replay":
+		f := a.flows.get(id)
+		if f == nil {
+			adminError(w, http.StatusNotFound, "flow not found")
+			return
+		}
+		if f.Messages != nil || (f.Response != nil && f.Response.StatusCode == http.StatusSwitchingProtocols) {
+			adminError(w, http.StatusBadRequest, "WebSocket sessions cannot be replayed")
+			return
+		}
+		if f.Request.Truncated {
+			adminError(w, http.StatusConflict, "the recorded request body is truncated")
+			return
+		}
+		a.resend(w, r, f.Request)
+	case "POST requests":
+		var req FlowRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a.resend(w, r, &req)
+	case "GET events":
+		a.serveEvents(w, r)
+	case "GET handlers":
+		list := a.p.Handlers().List()
+		if list == nil {
+			list = []HandlerInfo{}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case "PUT handlers/{id}":
+		var body struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !a.p.Handlers().SetEnabled(id, body.Enabled) {
+			adminError(w, http.StatusNotFound, "handler not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "GET verbose":
+		writeJSON(w, http.StatusOK, map[string]bool{"verbose": a.p.isVerbose()})
+	case "PUT verbose":
+		var body struct {
+			Verbose bool `json:"verbose"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a.p.SetVerbose(body.Verbose)
+		w.WriteHeader(http.StatusNoContent)
+	case "GET ca":
+		a.downloadCA(w, r)
+	default:
+		adminError(w, http.StatusNotFound, "no route for "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// authorized checks the token of r for the given route when one is
+// configured
+func (a *adminAPI) authorized(r *http.Request, route string) bool {
+	if a.cfg.Token == "" {
+		return true
+	}
+	var token string
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = auth
+	} else if r.Method == http.MethodGet && route == "events" {
+		// EventSource 无法设置请求头，只有事件流接受 URL 中的令牌
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.Token)) == 1
+}
+
+// allowedHost reports whether host, the Host header of a request, is an IP
+// address, localhost or one of the configured host names
+func (a *adminAPI) allowedHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	for _, h := range a.cfg.Hosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether origin is the admin API served at host
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Scheme == "http" && strings.EqualFold(u.Host, host)
+}
+
+// isLoopbackAddr reports whether the listen address addr only accepts
+// connections from this machine
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *adminAPI) listFlows(w http.ResponseWriter, r *http.Request) {
+	flows := a.flows.list()
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			adminError(w, http.StatusBadRequest, "invalid limit "+v)
+			return
+		}
+		if limit < len(flows) {
+			flows = flows[len(flows)-limit:]
+		}
+	}
+	list := make([]flowSummary, len(flows))
+	for i, f := range flows {
+		list[i] = summarizeFlow(f)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// injectMessage sends a message into a live WebSocket session, it is
+// recorded in the flow of the session like a relayed message
+func (a *adminAPI) injectMessage(w http.ResponseWriter, r *http.Request, id uint64) {
+	var msg struct {
+		// To is "server" or "client"
+		To string `json:"to"`
+		// Type is "text" or "binary"
+		Type   string `json:"type"`
+		Data   string `json:"data"`
+		Base64 bool   `json:"base64"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var dir Direction
+	switch msg.To {
+	case "server":
+		dir = ClientToServer
+	case "client":
+		dir = ServerToClient
+	default:
+		adminError(w, http.StatusBadRequest, `"to" must be "server" or "client"`)
+		return
+	}
+	msgType := websocket.TextMessage
+	switch msg.Type {
+	case "", "text":
+	case "binary":
+		msgType = websocket.BinaryMessage
+	default:
+		adminError(w, http.StatusBadRequest, `"type" must be "text" or "binary"`)
+		return
+	}
+	data := []byte(msg.Data)
+	if msg.Base64 {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(msg.Data); err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	s := a.p.liveSession(id)
+	if s == nil {
+		adminError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err := s.ctx.WSSession.send(dir, msgType, data); err != nil {
+		adminError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	s.ctx.flow.message(dir, msgType, data, data)
+	if a.p.isVerbose() {
+		a.p.logger.Debug("Injected %d bytes %s into %s", len(data), dir, s.info.URL)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// flowBody serves a recorded body with the Content-Encoding removed, it is
+// kept in X-Flow-Content-Encoding when the body is truncated or decodes to
+// more than the body limit. The body is always served as binary so it
+// cannot run in the page, its content type is in X-Flow-Content-Type.
+func (a *adminAPI) flowBody(w http.ResponseWriter, r *http.Request, f *Flow) {
+	var header http.Header
+	var body []byte
+	var truncated bool
+	original := r.URL.Query().Get("original") == "1"
+	switch r.URL.Query().Get("part") {
+	case "request":
+		header, body, truncated = f.Request.Header, f.Request.Body, f.Request.Truncated
+		if original {
+			header = f.Request.OriginalHeader
+			if f.Request.OriginalBody != nil {
+				body = f.Request.OriginalBody
+			}
+		}
+	case "", "response":
+		if f.Response == nil {
+			adminError(w, http.StatusNotFound, "the flow has no response")
+			return
+		}
+		header, body, truncated = f.Response.Header, f.Response.Body, f.Response.Truncated
+		if original {
+			header = f.Response.OriginalHeader
+			if f.Response.OriginalBody != nil {
+				body = f.Response.OriginalBody
+			}
+		}
+	default:
+		adminError(w, http.StatusBadRequest, `"part" must be "request" or "response"`)
+		return
+	}
+	// 截断的内容无法解压，原样返回
+	enc := contentEncoding(header)
+	if enc != "" && len(body) > 0 && !truncated {
+		if plain, err := decodeBytes(enc, body, captureLimit(a.cfg.MaxBodySize)); err == nil {
+			body, enc = plain, ""
+		}
+	}
+	if enc != "" && len(body) > 0 {
+		w.Header().Set("X-Flow-Content-Encoding", enc)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Flow-Content-Type", header.Get("Content-Type"))
+	w.Header().Set("X-Flow-Truncated", strconv.FormatBool(truncated))
+	w.Write(body)
+}
+
+// resend sends req through the handlers and upstream like a request of a
+// client and answers with the ID of the new flow
+func (a *adminAPI) resend(w http.ResponseWriter, r *http.Request, fr *FlowRequest) {
+	u, err := url.Parse(fr.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		adminError(w, http.StatusBadRequest, "invalid url "+fr.URL)
+		return
+	}
+	method := fr.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(fr.Body))
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for k, vs := range fr.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Del("Content-Length")
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	req.RemoteAddr = r.RemoteAddr
+	if a.p.isVerbose() {
+		a.p.logger.Debug("Resending %s %s from the admin API", req.Method, req.URL)
+	}
+
+	rw := &resendWriter{header: make(http.Header)}
+	a.resent.Store(req, uint64(0))
+	defer a.resent.Delete(req)
+	func() {
+		// 处理函数丢弃请求时 forward 以 ErrAbortHandler 中止
+		defer func() {
+			if v := recover(); v != nil && v != http.ErrAbortHandler {
+				panic(v)
+			}
+		}()
+		a.p.forward(rw, req, a.p.transport)
+	}()
+
+	id, _ := a.resent.Load(req)
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "statusCode": rw.status})
+}
+
+// resendWriter discards the response of a resent request, it is recorded
+// in the flow
+type resendWriter struct {
+	header http.Header
+	status int
+}
+
+func (rw *resendWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *resendWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (rw *resendWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+// serveEvents streams flow and message events until the client leaves
+func (a *adminAPI) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		adminError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	ch := a.subscribe()
+	defer a.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data)
+			flusher.Flush()
+		}
+	}
+}
+
+// downloadCA serves the CA certificate to install on devices
+func (a *adminAPI) downloadCA(w http.ResponseWriter, r *http.Request) {
+	raw := a.p.ca.Certificate.Raw
+	name := "gamemitm-ca.crt"
+	if r.URL.Query().Get("format") == "der" {
+		name = "gamemitm-ca.cer"
+	} else {
+		raw = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
+	w.Write(raw)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
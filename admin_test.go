@@ -0,0 +1,410 @@
+package gamemitm
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startAdmin runs the admin API of p and returns its base URL
+func startAdmin(t *testing.T, p *ProxyServer, cfg AdminConfig) string {
+	t.Helper()
+	addr := freeAddr(t)
+	go p.ListenAdmin(addr, cfg)
+	waitListening(t, addr)
+	return "http://" + addr
+}
+
+// adminDo sends a request to the admin API with the token, JSON requests
+// when body is set
+func adminDo(t *testing.T, method, target, token, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+// adminJSON sends a request to the admin API and decodes the answer into v
+func adminJSON(t *testing.T, method, target, token, body string, v any) {
+	t.Helper()
+	resp, data := adminDo(t, method, target, token, body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s: status %d, %s", method, target, resp.StatusCode, data)
+	}
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenAdminNeedsTokenOffLoopback(t *testing.T) {
+	p := NewProxy()
+	if err := p.ListenAdmin("0.0.0.0:0", AdminConfig{}); err == nil {
+		t.Fatal("admin API listened on every interface without a token")
+	}
+	for addr, want := range map[string]bool{
+		"127.0.0.1:1":   true,
+		"[::1]:1":       true,
+		"localhost:1":   true,
+		":1":            false,
+		"0.0.0.0:1":     false,
+		"192.168.1.2:1": false,
+	} {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("isLoopbackAddr(%q) = %v", addr, got)
+		}
+	}
+}
+
+func TestAdminRequestChecks(t *testing.T) {
+	p, _ := newTestProxy(t)
+	base := startAdmin(t, p, AdminConfig{Token: "secret", Hosts: []string{"mitm.lan"}})
+	_, port, _ := strings.Cut(strings.TrimPrefix(base, "http://"), ":")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header map[string]string
+		body   string
+		want   int
+	}{
+		{"no token", "GET", "/api/verbose", nil, "", http.StatusUnauthorized},
+		{"wrong token", "GET", "/api/verbose", map[string]string{"Authorization": "Bearer nope"}, "", http.StatusUnauthorized},
+		{"query token", "GET", "/api/verbose?token=secret", nil, "", http.StatusUnauthorized},
+		{"header token", "GET", "/api/verbose", map[string]string{"Authorization": "Bearer secret"}, "", http.StatusOK},
+		{"query token outside events", "HEAD", "/api/events?token=secret", nil, "", http.StatusUnauthorized},
+		{"form post", "PUT", "/api/verbose", map[string]string{"Authorization": "Bearer secret", "Content-Type": "text/plain"}, `{"verbose":true}`, http.StatusUnsupportedMediaType},
+		{"json put", "PUT", "/api/verbose", map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json; charset=utf-8"}, `{"verbose":true}`, http.StatusNoContent},
+		{"delete without type", "DELETE", "/api/connections/1", map[string]string{"Authorization": "Bearer secret"}, "", http.StatusUnsupportedMediaType},
+		{"rebound host", "GET", "/api/verbose", map[string]string{"Authorization": "Bearer secret", "Host": "evil.test:" + port}, "", http.StatusForbidden},
+		{"rebound host page", "GET", "/", map[string]string{"Host": "evil.test"}, "", http.StatusForbidden},
+		{"localhost", "GET", "/api/verbose", map[string]string{"Authorization": "Bearer secret", "Host": "localhost:" + port}, "", http.StatusOK},
+		{"configured host", "GET", "/api/verbose", map[string]string{"Authorization": "Bearer secret", "Host": "MITM.lan:" + port}, "", http.StatusOK},
+		{"foreign origin", "PUT", "/api/verbose", map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json", "Origin": "http://evil.test"}, `{"verbose":true}`, http.StatusForbidden},
+		{"same origin", "PUT", "/api/verbose", map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json", "Origin": base}, `{"verbose":true}`, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, base+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			req.Host = req.Header.Get("Host")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+	if !p.isVerbose() {
+		t.Fatal("PUT /api/verbose did not enable verbose logging")
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	p, client := newTestProxy(t)
+	base := startAdmin(t, p, AdminConfig{Token: "secret"})
+	upstream := echoServer(t)
+
+	resp, err := http.Get(base + "/api/events?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	doText(t, client, "GET", upstream.URL+"/events", "")
+	r := bufio.NewReader(resp.Body)
+	if line, err := r.ReadString('\n'); err != nil || line != "event: flow\n" {
+		t.Fatalf("first event line %q, %v", line, err)
+	}
+	line, _ := r.ReadString('\n')
+	var s flowSummary
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &s); err != nil || !strings.HasSuffix(s.URL, "/events") {
+		t.Fatalf("event data %q, %v", line, err)
+	}
+}
+
+func TestAdminFlows(t *testing.T) {
+	p, client := newTestProxy(t)
+	base := startAdmin(t, p, AdminConfig{})
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("compressed body"))
+	zw.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(gz.Bytes())
+	}))
+	defer upstream.Close()
+
+	doText(t, client, "POST", upstream.URL+"/login", "hello")
+	var flows []flowSummary
+	waitFor(t, func() bool {
+		adminJSON(t, "GET", base+"/api/flows", "", "", &flows)
+		return len(flows) == 1
+	})
+	id := strconv.FormatUint(flows[0].ID, 10)
+	if flows[0].Method != "POST" || flows[0].StatusCode != http.StatusOK {
+		t.Fatalf("summary = %+v", flows[0])
+	}
+
+	resp, body := adminDo(t, "GET", base+"/api/flows/"+id+"/body", "", "")
+	if body != "compressed body" || resp.Header.Get("X-Flow-Content-Type") != "text/plain" {
+		t.Fatalf("body %q, content type %q", body, resp.Header.Get("X-Flow-Content-Type"))
+	}
+	if _, body := adminDo(t, "GET", base+"/api/flows/"+id+"/body?part=request", "", ""); body != "hello" {
+		t.Fatalf("request body %q", body)
+	}
+
+	// 重放的请求生成新的流量，接口返回它的 ID
+	var replayed struct {
+		ID         uint64 `json:"id"`
+		StatusCode int    `json:"statusCode"`
+	}
+	adminJSON(t, "POST", base+"/api/flows/"+id+"/replay", "", "", &replayed)
+	if replayed.ID == 0 || replayed.ID == flows[0].ID || replayed.StatusCode != http.StatusOK {
+		t.Fatalf("replay = %+v", replayed)
+	}
+	var f Flow
+	adminJSON(t, "GET", base+"/api/flows/"+strconv.FormatUint(replayed.ID, 10), "", "", &f)
+	if f.Request.Method != "POST" || string(f.Request.Body) != "hello" {
+		t.Fatalf("replayed request %s %q", f.Request.Method, f.Request.Body)
+	}
+
+	adminJSON(t, "POST", base+"/api/requests", "", `{"method":"PUT","url":"`+upstream.URL+`/edited","body":"ZWRpdGVk"}`, &replayed)
+	adminJSON(t, "GET", base+"/api/flows/"+strconv.FormatUint(replayed.ID, 10), "", "", &f)
+	if f.Request.Method != "PUT" || !strings.HasSuffix(f.Request.URL, "/edited") || string(f.Request.Body) != "edited" {
+		t.Fatalf("sent request %s %s %q", f.Request.Method, f.Request.URL, f.Request.Body)
+	}
+}
+
+func TestAdminBodyLimit(t *testing.T) {
+	p, client := newTestProxy(t)
+	base := startAdmin(t, p, AdminConfig{MaxBodySize: 100})
+	// 录制 HAR 的观察者保留完整内容，管理接口仍按自己的限制保存
+	if _, err := p.RecordHAR(HARConfig{Dir: t.TempDir(), MaxBodySize: -1}); err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(bytes.Repeat([]byte("a"), 1000))
+	zw.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gz.Bytes())
+			return
+		}
+		w.Write(bytes.Repeat([]byte("b"), 1000))
+	}))
+	defer upstream.Close()
+
+	doText(t, client, "GET", upstream.URL+"/plain", "")
+	doText(t, client, "GET", upstream.URL+"/gzip", "")
+	var flows []flowSummary
+	waitFor(t, func() bool {
+		adminJSON(t, "GET", base+"/api/flows", "", "", &flows)
+		return len(flows) == 2
+	})
+	for _, s := range flows {
+		id := strconv.FormatUint(s.ID, 10)
+		resp, body := adminDo(t, "GET", base+"/api/flows/"+id+"/body", "", "")
+		switch {
+		case strings.HasSuffix(s.URL, "/plain"):
+			if body != strings.Repeat("b", 100) || resp.Header.Get("X-Flow-Truncated") != "true" {
+				t.Fatalf("plain body of %d bytes, truncated %s", len(body), resp.Header.Get("X-Flow-Truncated"))
+			}
+		default:
+			// 解压后超出限制，返回压缩的原始内容
+			if body != gz.String() || resp.Header.Get("X-Flow-Content-Encoding") != "gzip" {
+				t.Fatalf("gzip body of %d bytes, encoding %q", len(body), resp.Header.Get("X-Flow-Content-Encoding"))
+			}
+		}
+	}
+}
+
+func TestFlowLogLimits(t *testing.T) {
+	flow := func(id uint64, size int) *Flow {
+		return &Flow{ID: id, Request: &FlowRequest{Body: make([]byte, size)}}
+	}
+	ids := func(l *flowLog) []uint64 {
+		var list []uint64
+		for _, f := range l.list() {
+			list = append(list, f.ID)
+		}
+		return list
+	}
+
+	l := newFlowLog(2, -1)
+	for i := uint64(1); i <= 3; i++ {
+		l.add(flow(i, 10))
+	}
+	if got := ids(l); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatalf("count limit kept %v", got)
+	}
+
+	l = newFlowLog(100, 25)
+	for i := uint64(1); i <= 3; i++ {
+		l.add(flow(i, 10))
+	}
+	if got := ids(l); len(got) != 2 || got[0] != 2 || l.size != 20 {
+		t.Fatalf("byte budget kept %v, %d bytes", got, l.size)
+	}
+	l.add(flow(4, 100))
+	if got := ids(l); len(got) != 1 || got[0] != 4 {
+		t.Fatalf("kept %v, want only the newest flow", got)
+	}
+}
+
+func TestKeptFlow(t *testing.T) {
+	f := &Flow{
+		ID:       1,
+		Request:  &FlowRequest{Body: []byte("0123456789")},
+		Response: &FlowResponse{Body: []byte("short"), OriginalBody: []byte("0123456789")},
+		ctx:      &ProxyCtx{},
+	}
+	kept := keptFlow(f, 6)
+	if kept.ctx != nil {
+		t.Fatal("kept flow references the exchange context")
+	}
+	if string(kept.Request.Body) != "012345" || !kept.Request.Truncated {
+		t.Fatalf("request body %q, truncated %v", kept.Request.Body, kept.Request.Truncated)
+	}
+	if string(kept.Response.Body) != "short" || string(kept.Response.OriginalBody) != "012345" || !kept.Response.Truncated {
+		t.Fatalf("response %q, original %q", kept.Response.Body, kept.Response.OriginalBody)
+	}
+	if string(f.Request.Body) != "0123456789" || f.Request.Truncated || f.ctx == nil {
+		t.Fatal("keptFlow modified the flow shared with other observers")
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	p, client := newTestProxy(t)
+	base := startAdmin(t, p, AdminConfig{})
+	upstream := wsEchoServer(t)
+	conn, _ := dialWebSocket(t, client, "ws"+strings.TrimPrefix(upstream.URL, "http")+"/ws", nil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var sessions []SessionInfo
+	adminJSON(t, "GET", base+"/api/sessions", "", "", &sessions)
+	if len(sessions) != 1 || !strings.HasSuffix(sessions[0].URL, "/ws") {
+		t.Fatalf("sessions = %+v", sessions)
+	}
+	id := strconv.FormatUint(sessions[0].ID, 10)
+
+	if resp, body := adminDo(t, "POST", base+"/api/sessions/"+id+"/messages", "", `{"to":"client","data":"pushed"}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("inject status %d, %s", resp.StatusCode, body)
+	}
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "pushed" {
+		t.Fatalf("client received %q, %v", data, err)
+	}
+	var messages []struct {
+		Direction string
+		Data      []byte
+	}
+	adminJSON(t, "GET", base+"/api/sessions/"+id+"/messages", "", "", &messages)
+	if len(messages) != 1 || string(messages[0].Data) != "pushed" || messages[0].Direction != ServerToClient.String() {
+		t.Fatalf("messages = %+v", messages)
+	}
+
+	if resp, _ := adminDo(t, "DELETE", base+"/api/sessions/"+id, "", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("close status %d", resp.StatusCode)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("session still open after DELETE")
+	}
+}
+
+func TestAdminVerboseWhileServing(t *testing.T) {
+	p, client := newTestProxy(t)
+	base := startAdmin(t, p, AdminConfig{})
+	upstream := echoServer(t)
+
+	// 切换日志详细程度与处理请求并发进行
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			body := `{"verbose":` + strconv.FormatBool(i%2 == 0) + `}`
+			req, _ := http.NewRequest("PUT", base+"/api/verbose", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		doText(t, client, "GET", upstream.URL, "")
+	}
+	wg.Wait()
+	var v struct{ Verbose bool }
+	adminJSON(t, "GET", base+"/api/verbose", "", "", &v)
+	if v.Verbose {
+		t.Fatal("verbose after the last PUT disabled it")
+	}
+}
+
+func TestAdminInjectValidation(t *testing.T) {
+	p, _ := newTestProxy(t)
+	base := startAdmin(t, p, AdminConfig{})
+	for _, body := range []string{`{"to":"nobody"}`, `{"to":"client","type":"ping"}`, `{"to":"client","base64":true,"data":"%%"}`} {
+		if resp, _ := adminDo(t, "POST", base+"/api/sessions/1/messages", "", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d", body, resp.StatusCode)
+		}
+	}
+	if resp, _ := adminDo(t, "POST", base+"/api/sessions/1/messages", "", `{"to":"client"}`); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown session: status %d", resp.StatusCode)
+	}
+}
+
+func TestVerboseFieldAndSetter(t *testing.T) {
+	p := NewProxy()
+	if !p.isVerbose() {
+		t.Fatal("new proxy is not verbose")
+	}
+	p.Verbose = false
+	if p.isVerbose() {
+		t.Fatal("Verbose field ignored")
+	}
+	p.SetVerbose(true)
+	if !p.isVerbose() {
+		t.Fatal("SetVerbose ignored")
+	}
+}
@@ -0,0 +1,146 @@
+package gamemitm
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxBodySize is the largest body buffered for Handle functions
+const DefaultMaxBodySize = 32 << 20
+
+// StreamHandle transforms a body chunk by chunk. It reads the body from r
+// and writes the result to w; returning an error aborts the transfer.
+type StreamHandle func(r io.Reader, w io.Writer, ctx *ProxyCtx) error
+
+// SetMaxBodySize sets the largest body buffered for Handle functions.
+// Larger bodies skip Handle functions and are streamed, n <= 0 removes
+// the limit.
+func (p *ProxyServer) SetMaxBodySize(n int64) {
+	p.maxBodySize = n
+}
+
+// processBody runs the handlers of the given type over body. The body is
+// only buffered when a Handle matches and it fits the max body size, in
+// every other case it is streamed. Handlers see decoded content when the
+// Content-Encoding is supported, and gRPC bodies are handled message by
+// message. It returns the new body and its length, -1 if unknown.
+func (p *ProxyServer) processBody(handleType int, body io.ReadCloser, length int64, ctx *ProxyCtx) (io.ReadCloser, int64, error) {
+	if body == nil {
+		body = http.NoBody
+	}
+	var handles, streams []*handleEntry
+	for _, e := range p.Handlers().chain(handleType) {
+		if !e.matcher.Match(ctx) {
+			continue
+		}
+		if e.handle != nil {
+			handles = append(handles, e)
+		} else if e.stream != nil {
+			streams = append(streams, e)
+		}
+	}
+	if len(handles) == 0 && len(streams) == 0 {
+		// 没有处理函数，原样转发
+		return body, length, nil
+	}
+
+	var header http.Header
+	if handleType == Response && ctx.Resp != nil {
+		header = ctx.Resp.Header
+	} else if ctx.Req != nil {
+		header = ctx.Req.Header
+	}
+	encoding := ""
+	if header != nil {
+		encoding = contentEncoding(header)
+	}
+	// decoded 表示 body 当前是否为解压后的内容
+	decoded := false
+
+	if len(handles) > 0 && header != nil && isGRPC(header) {
+		// gRPC 按消息逐条调用处理函数
+		body = p.grpcBody(handles, body, header.Get("Grpc-Encoding"), ctx)
+		length = -1
+		encoding = ""
+	} else if len(handles) > 0 {
+		max := p.maxBodySize
+		if max > 0 && length > max {
+			p.logger.Warn("Body of %d bytes exceeds %d bytes, streaming without handlers", length, max)
+			encoding = ""
+		} else {
+			var data []byte
+			var err error
+			if max > 0 {
+				data, err = io.ReadAll(io.LimitReader(body, max+1))
+			} else {
+				data, err = io.ReadAll(body)
+			}
+			if err != nil {
+				body.Close()
+				return nil, 0, err
+			}
+			if max > 0 && int64(len(data)) > max {
+				// 超出限制，已读取部分与剩余部分拼接后以流方式转发
+				p.logger.Warn("Body exceeds %d bytes, streaming without handlers", max)
+				body = &readCloser{Reader: io.MultiReader(bytes.NewReader(data), body), closer: body}
+				encoding = ""
+			} else {
+				body.Close()
+				if encoding != "" && len(data) > 0 {
+					if plain, err := decodeBytes(encoding, data, max); err == nil {
+						data = plain
+						decoded = true
+					} else {
+						p.logger.Warn("Failed to decode %s body, handlers get raw bytes: %v", encoding, err)
+						encoding = ""
+					}
+				}
+				for _, e := range handles {
+					data = e.handle(data, ctx)
+				}
+				if decoded && len(streams) == 0 {
+					if data, err = p.encodeBytes(encoding, data, header); err != nil {
+						return nil, 0, err
+					}
+					decoded = false
+				}
+				length = int64(len(data))
+				body = io.NopCloser(bytes.NewReader(data))
+			}
+		}
+	}
+
+	if len(streams) > 0 {
+		if encoding != "" && !decoded && length != 0 {
+			body = &lazyDecoder{encoding: encoding, body: body}
+			decoded = true
+		}
+		for _, e := range streams {
+			pr, pw := io.Pipe()
+			go func(in io.ReadCloser, out *io.PipeWriter, f StreamHandle) {
+				out.CloseWithError(f(in, out, ctx))
+				in.Close()
+			}(body, pw, e.stream)
+			body = pr
+		}
+		if decoded {
+			body = p.encodeStream(encoding, body, header)
+		}
+		length = -1
+	}
+	if length == 0 {
+		body.Close()
+		body = http.NoBody
+	}
+	return body, length, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	return rc.closer.Close()
+}
@@ -0,0 +1,76 @@
+package gamemitm
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBodyOverLimitSkipsHandles(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+	p.SetMaxBodySize(16)
+	var called atomic.Bool
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		called.Store(true)
+		return body
+	})
+
+	large := strings.Repeat("x", 100)
+	if _, body := doText(t, client, "POST", upstream.URL, large); body != large {
+		t.Fatalf("large body was changed, got %d bytes", len(body))
+	}
+	if called.Load() {
+		t.Fatal("Handle ran on a body over the limit")
+	}
+
+	// 长度未知的请求体读取超限后同样原样转发
+	req, _ := http.NewRequest("POST", upstream.URL, io.MultiReader(strings.NewReader(large)))
+	req.ContentLength = -1
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != large || called.Load() {
+		t.Fatalf("chunked body over the limit: got %d bytes, handler called %v", len(data), called.Load())
+	}
+}
+
+func TestDoStreamTransformsBody(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+	p.OnResponse(All).DoStream(func(r io.Reader, w io.Writer, ctx *ProxyCtx) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bytes.ToUpper(data))
+		return err
+	})
+	p.OnResponse(All).Priority(-1).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return append(body, "-handled"...)
+	})
+
+	_, body := doText(t, client, "POST", upstream.URL, "stream")
+	if body != "STREAM-HANDLED" {
+		t.Fatalf("body = %q, want %q", body, "STREAM-HANDLED")
+	}
+}
+
+func TestProcessBodyWithoutHandlersKeepsBody(t *testing.T) {
+	p := NewProxy()
+	p.SetLogger(discardLogger{})
+	in := io.NopCloser(strings.NewReader("abc"))
+	body, length, err := p.processBody(Request, in, 3, &ProxyCtx{Proxy: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != in || length != 3 {
+		t.Fatalf("body was wrapped or length changed to %d", length)
+	}
+}
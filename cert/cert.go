@@ -94,6 +94,11 @@ func (cm *CertificateManager) generateCertificateForDomain(domain string) (*tls.
 			"wss." + host,
 		},
 	}
+	// 按 IP 访问且没有 SNI 的客户端需要证书包含该 IP
+	if ip := net.ParseIP(host); ip != nil {
+		template.DNSNames = nil
+		template.IPAddresses = []net.IP{ip}
+	}
 
 	// Create certificate using CA
 	derBytes, err := x509.CreateCertificate(
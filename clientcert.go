@@ -0,0 +1,100 @@
+package gamemitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// clientCert is a client certificate presented to matching upstream hosts
+type clientCert struct {
+	hosts *hostList
+	cert  *tls.Certificate
+}
+
+// AddClientCertificate presents cert to upstream servers matching one of
+// the patterns (host globs, IPs, CIDRs or ":port") when they ask for a
+// client certificate. The first matching certificate is used.
+func (p *ProxyServer) AddClientCertificate(cert tls.Certificate, patterns ...string) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("client certificate is empty")
+	}
+	hosts, err := parseHostList(patterns)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("invalid client certificate: %v", err)
+		}
+	}
+	p.clientCerts = append(p.clientCerts, clientCert{hosts: hosts, cert: &cert})
+	return nil
+}
+
+// AddClientCertificatePEM is AddClientCertificate for a PEM encoded
+// certificate chain and private key
+func (p *ProxyServer) AddClientCertificatePEM(certPEM, keyPEM []byte, patterns ...string) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	return p.AddClientCertificate(cert, patterns...)
+}
+
+// AddClientCertificatePKCS12 is AddClientCertificate for a PKCS#12 (.p12,
+// .pfx) file protected by password
+func (p *ProxyServer) AddClientCertificatePKCS12(data []byte, password string, patterns ...string) error {
+	key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return err
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return p.AddClientCertificate(cert, patterns...)
+}
+
+// SetRequestClientCertificate makes the proxy ask downstream clients for a
+// certificate during the TLS handshake. The certificate is not verified,
+// handlers read it with ProxyCtx.ClientCertificate.
+func (p *ProxyServer) SetRequestClientCertificate(request bool) {
+	p.requestClientCert = request
+}
+
+// clientCertificate returns the certificate for host ("host:port") or its
+// serverName, an empty certificate when none is configured
+func (p *ProxyServer) clientCertificate(host, serverName string) *tls.Certificate {
+	_, port, _ := net.SplitHostPort(host)
+	for _, c := range p.clientCerts {
+		if c.hosts.match(host) || (serverName != "" && c.hosts.match(net.JoinHostPort(serverName, port))) {
+			if p.isVerbose() {
+				p.logger.Debug("Sending client certificate %s to %s", c.cert.Leaf.Subject, host)
+			}
+			return c.cert
+		}
+	}
+	// 没有配置证书时返回空证书，握手继续由服务器决定是否接受
+	return &tls.Certificate{}
+}
+
+// ClientCertificate returns the certificate sent by the downstream client,
+// nil when it sent none or SetRequestClientCertificate is off
+func (ctx *ProxyCtx) ClientCertificate() *x509.Certificate {
+	state := ctx.ClientTLS
+	if state == nil && ctx.Req != nil {
+		state = ctx.Req.TLS
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
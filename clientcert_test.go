@@ -0,0 +1,144 @@
+package gamemitm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// selfSignedCert creates a client certificate with the given common name
+func selfSignedCert(t *testing.T, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// mtlsServer requires a client certificate and answers with its common
+// name
+func mtlsServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClientCertificatePEM(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := mtlsServer(t)
+	cert, key := selfSignedCert(t, "game-client")
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := p.AddClientCertificatePEM(certPEM, keyPEM, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, body := doText(t, client, "GET", upstream.URL, ""); body != "game-client" {
+		t.Fatalf("upstream saw client certificate %q", body)
+	}
+}
+
+func TestClientCertificatePKCS12(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := mtlsServer(t)
+	cert, key := selfSignedCert(t, "p12-client")
+	data, err := pkcs12.Modern.Encode(key, cert, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddClientCertificatePKCS12(data, "wrong", "127.0.0.1"); err == nil {
+		t.Fatal("PKCS#12 file accepted with a wrong password")
+	}
+	if err := p.AddClientCertificatePKCS12(data, "secret", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, body := doText(t, client, "GET", upstream.URL, ""); body != "p12-client" {
+		t.Fatalf("upstream saw client certificate %q", body)
+	}
+}
+
+func TestClientCertificateOnlyForMatchingHosts(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := mtlsServer(t)
+	cert, key := selfSignedCert(t, "other-client")
+	tlsCert := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+	if err := p.AddClientCertificate(tlsCert, "*.game.test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddClientCertificate(tls.Certificate{}, "*"); err == nil {
+		t.Fatal("empty certificate accepted")
+	}
+	// 无法解析的证书在添加时报错，而不是在握手时使日志崩溃
+	if err := p.AddClientCertificate(tls.Certificate{Certificate: [][]byte{[]byte("not DER")}, PrivateKey: key}, "*"); err == nil {
+		t.Fatal("certificate that does not parse accepted")
+	}
+
+	// 没有匹配的证书，要求客户端证书的服务器拒绝握手
+	if resp, _ := doText(t, client, "GET", upstream.URL, ""); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+}
+
+func TestRequestClientCertificate(t *testing.T) {
+	p, client := newTestProxy(t)
+	p.SetRequestClientCertificate(true)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	seen := make(chan string, 1)
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		cn := ""
+		if cert := ctx.ClientCertificate(); cert != nil {
+			cn = cert.Subject.CommonName
+		}
+		select {
+		case seen <- cn:
+		default:
+		}
+		return body
+	})
+
+	cert, key := selfSignedCert(t, "downstream")
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+	doText(t, client, "GET", upstream.URL, "")
+	if cn := <-seen; cn != "downstream" {
+		t.Fatalf("ClientCertificate = %q", cn)
+	}
+}
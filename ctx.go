@@ -1,12 +1,158 @@
 package gamemitm
 
-import "net/http"
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
 
 type ProxyCtx struct {
-	Req       *http.Request
-	Resp      *http.Response
-	WSSession *Session
-	UserData  any
-	Proxy     *ProxyServer
+	Req        *http.Request
+	Resp       *http.Response
+	WSSession  *Session
+	Stream     *StreamSession
+	UDPSession *UDPSession
+	// ClientTLS is the handshake with the client and UpstreamTLS the one
+	// with the server, nil for plain connections. UpstreamTLS is set once
+	// the response arrives.
+	ClientTLS   *tls.ConnectionState
+	UpstreamTLS *tls.ConnectionState
+	UserData    any
+	Proxy       *ProxyServer
+
+	// response is set by Respond, the request is then not sent upstream
+	response *http.Response
+	dropped  bool
+	// flow records the exchange for the flow observers
+	flow *flowRecord
 }
 type Handle func(body []byte, ctx *ProxyCtx) []byte
+
+// Respond answers the request with resp instead of contacting the target
+// server. It is meant for request handlers; the response handlers still
+// run on resp.
+func (ctx *ProxyCtx) Respond(resp *http.Response) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+	} else if resp.ContentLength == 0 {
+		resp.ContentLength = -1
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if resp.Request == nil {
+		resp.Request = ctx.Req
+	}
+	ctx.response = resp
+}
+
+// Drop closes the client connection without sending any response and
+// without contacting the target server
+func (ctx *ProxyCtx) Drop() {
+	ctx.dropped = true
+}
+
+// NewResponse creates a response with the given status code, content type
+// and body, e.g. for ProxyCtx.Respond
+func NewResponse(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	resp := &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+	return resp
+}
+
+// SetMethod changes the method of the request sent upstream
+func (ctx *ProxyCtx) SetMethod(method string) {
+	ctx.Req.Method = method
+}
+
+// SetURL changes the request URL. An absolute URL also changes the target
+// server, a relative one only replaces path and query.
+func (ctx *ProxyCtx) SetURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.IsAbs() {
+		ctx.Req.URL = u
+		ctx.Req.Host = u.Host
+		return nil
+	}
+	ctx.Req.URL.Path = u.Path
+	ctx.Req.URL.RawPath = u.RawPath
+	ctx.Req.URL.RawQuery = u.RawQuery
+	return nil
+}
+
+// SetPath changes the request path
+func (ctx *ProxyCtx) SetPath(path string) {
+	ctx.Req.URL.Path = path
+	ctx.Req.URL.RawPath = ""
+}
+
+// SetQuery replaces the request query
+func (ctx *ProxyCtx) SetQuery(query url.Values) {
+	ctx.Req.URL.RawQuery = query.Encode()
+}
+
+// SetTargetHost redirects the request to another backend, host may carry
+// a port. The Host header is changed accordingly.
+func (ctx *ProxyCtx) SetTargetHost(host string) {
+	ctx.Req.URL.Host = host
+	ctx.Req.Host = host
+}
+
+func (ctx *ProxyCtx) SetRequestHeader(key, value string) {
+	ctx.Req.Header.Set(key, value)
+}
+
+func (ctx *ProxyCtx) AddRequestHeader(key, value string) {
+	ctx.Req.Header.Add(key, value)
+}
+
+func (ctx *ProxyCtx) DelRequestHeader(key string) {
+	ctx.Req.Header.Del(key)
+}
+
+// SetResponseHeader sets a header of the response sent to the client,
+// it has no effect before the response is available
+func (ctx *ProxyCtx) SetResponseHeader(key, value string) {
+	if ctx.Resp != nil {
+		ctx.Resp.Header.Set(key, value)
+	}
+}
+
+func (ctx *ProxyCtx) AddResponseHeader(key, value string) {
+	if ctx.Resp != nil {
+		ctx.Resp.Header.Add(key, value)
+	}
+}
+
+func (ctx *ProxyCtx) DelResponseHeader(key string) {
+	if ctx.Resp != nil {
+		ctx.Resp.Header.Del(key)
+	}
+}
+
+// SetStatusCode changes the status code of the response sent to the client
+func (ctx *ProxyCtx) SetStatusCode(code int) {
+	if ctx.Resp != nil {
+		ctx.Resp.StatusCode = code
+		ctx.Resp.Status = strconv.Itoa(code) + " " + http.StatusText(code)
+	}
+}
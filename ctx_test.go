@@ -0,0 +1,162 @@
+package gamemitm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestModifyRequest(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		ctx.SetMethod("PUT")
+		ctx.SetPath("/rewritten")
+		ctx.SetQuery(url.Values{"v": {"2"}})
+		ctx.SetRequestHeader("X-Set", "1")
+		ctx.DelRequestHeader("X-Secret")
+		return body
+	})
+	p.OnResponse(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		ctx.SetStatusCode(http.StatusAccepted)
+		ctx.SetResponseHeader("X-Seen-Header", ctx.Req.Header.Get("X-Set")+ctx.Req.Header.Get("X-Secret"))
+		ctx.DelResponseHeader("X-Host")
+		return body
+	})
+
+	req, _ := http.NewRequest("POST", upstream.URL+"/orig?v=1", strings.NewReader("body"))
+	req.Header.Set("X-Secret", "s")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("status = %d, want 202", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Method"); got != "PUT" {
+		t.Errorf("upstream method = %q", got)
+	}
+	if got := resp.Header.Get("X-Path"); got != "/rewritten?v=2" {
+		t.Errorf("upstream path = %q", got)
+	}
+	if got := resp.Header.Get("X-Seen-Header"); got != "1" {
+		t.Errorf("headers seen by the response handler = %q", got)
+	}
+	if _, ok := resp.Header["X-Host"]; ok {
+		t.Error("deleted response header was sent")
+	}
+}
+
+func TestSetTargetHostAndURL(t *testing.T) {
+	p, client := newTestProxy(t)
+	original := echoServer(t)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other " + r.URL.RequestURI()))
+	}))
+	defer other.Close()
+	otherHost := other.Listener.Addr().String()
+	p.OnRequestMatch(PathPrefix("/host")).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		ctx.SetTargetHost(otherHost)
+		return body
+	})
+	p.OnRequestMatch(PathPrefix("/abs")).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		if err := ctx.SetURL(other.URL + "/moved?a=b"); err != nil {
+			t.Error(err)
+		}
+		return body
+	})
+
+	if _, body := doText(t, client, "GET", original.URL+"/host", ""); body != "other /host" {
+		t.Errorf("SetTargetHost: body = %q", body)
+	}
+	if _, body := doText(t, client, "GET", original.URL+"/abs", ""); body != "other /moved?a=b" {
+		t.Errorf("SetURL: body = %q", body)
+	}
+}
+
+// wsEchoServer echoes WebSocket messages, the X-Token header of the
+// handshake is sent back in the response
+func wsEchoServer(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := http.Header{"X-Token": {r.Header.Get("X-Token")}}
+		conn, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dialWebSocket connects to the WebSocket server through the proxy of
+// client
+func dialWebSocket(t *testing.T, client *http.Client, target string, header http.Header) (*websocket.Conn, *http.Response) {
+	t.Helper()
+	transport := client.Transport.(*http.Transport)
+	dialer := websocket.Dialer{Proxy: transport.Proxy, TLSClientConfig: transport.TLSClientConfig}
+	conn, resp, err := dialer.Dial(target, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, resp
+}
+
+func TestHandshakeHandlers(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := wsEchoServer(t)
+	var plain atomic.Int32
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		plain.Add(1)
+		return append(body, '!')
+	})
+	p.OnRequest(All).Handshake().Do(func(body []byte, ctx *ProxyCtx) []byte {
+		if ctx.WSSession == nil {
+			ctx.SetRequestHeader("X-Token", "from-handshake")
+		}
+		return body
+	})
+	p.OnResponse(All).Handshake().Do(func(body []byte, ctx *ProxyCtx) []byte {
+		if ctx.WSSession == nil {
+			ctx.SetResponseHeader("X-Handshake", "seen")
+		}
+		return body
+	})
+
+	conn, resp := dialWebSocket(t, client, "ws"+strings.TrimPrefix(upstream.URL, "http"), nil)
+	if got := resp.Header.Get("X-Token"); got != "from-handshake" {
+		t.Errorf("upstream saw X-Token %q", got)
+	}
+	if got := resp.Header.Get("X-Handshake"); got != "seen" {
+		t.Errorf("response handshake header = %q", got)
+	}
+	if n := plain.Load(); n != 0 {
+		t.Errorf("plain request handler ran %d times on the handshake", n)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("hi"))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hi!" {
+		t.Errorf("echo = %q, want the message handler to run", data)
+	}
+}
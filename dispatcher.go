@@ -1,5 +1,11 @@
 package gamemitm
 
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
 const (
 	All = "*"
 )
@@ -7,65 +13,444 @@ const (
 	Request = iota + 1000
 	Response
 	Connected
+	Stream
+	UDP
 )
 
+// handleEntry is a single handler registered in a chain
+type handleEntry struct {
+	matcher  Matcher
+	priority int
+	seq      uint64
+	name     string
+	disabled atomic.Bool
+	// handshake runs the handler on WebSocket upgrades too
+	handshake bool
+	handle    Handle
+	stream    StreamHandle
+	message   MessageHandle
+	framer    Framer
+}
+
+// handleTypeNames names the handler types in HandlerInfo
+var handleTypeNames = map[int]string{
+	Request:   "request",
+	Response:  "response",
+	Connected: "connected",
+	Stream:    "stream",
+	UDP:       "datagram",
+}
+
+// HandlerInfo describes a registered handler
+type HandlerInfo struct {
+	// ID identifies the handler within its set
+	ID uint64 `json:"id"`
+	// Type is "request", "response", "connected", "stream" or "datagram"
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// handleTable is an immutable snapshot of the handler chains of a set
+type handleTable map[int][]*handleEntry
+
+// HandlerSet holds the handler chains used by a proxy. It is safe for
+// concurrent use: readers work on immutable snapshots while registrations
+// and removals replace the snapshot.
+type HandlerSet struct {
+	mu    sync.Mutex
+	seq   uint64
+	table atomic.Pointer[handleTable]
+}
+
+// NewHandlerSet creates an empty handler set, see ProxyServer.ReplaceHandlers
+func NewHandlerSet() *HandlerSet {
+	s := &HandlerSet{}
+	s.table.Store(&handleTable{})
+	return s
+}
+
+func (s *HandlerSet) OnRequest(url string) *Dispatcher {
+	return s.OnRequestMatch(urlMatcher(url)).Name(url)
+}
+
+func (s *HandlerSet) OnResponse(url string) *Dispatcher {
+	return s.OnResponseMatch(urlMatcher(url)).Name(url)
+}
+
+func (s *HandlerSet) OnConnected(url string) *Dispatcher {
+	return s.OnConnectedMatch(urlMatcher(url)).Name(url)
+}
+
+func (s *HandlerSet) OnRequestMatch(m Matcher) *Dispatcher {
+	return &Dispatcher{handleType: Request, matcher: m, set: s}
+}
+
+func (s *HandlerSet) OnResponseMatch(m Matcher) *Dispatcher {
+	return &Dispatcher{handleType: Response, matcher: m, set: s}
+}
+
+func (s *HandlerSet) OnConnectedMatch(m Matcher) *Dispatcher {
+	return &Dispatcher{handleType: Connected, matcher: m, set: s}
+}
+
+// OnStream registers message handlers for raw TCP streams selected by m,
+// see ProxyServer.OnStream
+func (s *HandlerSet) OnStream(m Matcher) *StreamDispatcher {
+	return &StreamDispatcher{matcher: m, set: s}
+}
+
+// OnDatagram registers handlers for UDP datagrams of flows selected by m,
+// see ProxyServer.OnDatagram
+func (s *HandlerSet) OnDatagram(m Matcher) *DatagramDispatcher {
+	return &DatagramDispatcher{matcher: m, set: s}
+}
+
+// chain returns the current enabled handlers of the given type
+func (s *HandlerSet) chain(handleType int) []*handleEntry {
+	chain := (*s.table.Load())[handleType]
+	for i, e := range chain {
+		if !e.disabled.Load() {
+			continue
+		}
+		// 只有存在禁用的处理函数时才复制
+		enabled := append([]*handleEntry(nil), chain[:i]...)
+		for _, e := range chain[i+1:] {
+			if !e.disabled.Load() {
+				enabled = append(enabled, e)
+			}
+		}
+		return enabled
+	}
+	return chain
+}
+
+// List returns the registered handlers, disabled ones included, grouped
+// by type in the order they run
+func (s *HandlerSet) List() []HandlerInfo {
+	table := *s.table.Load()
+	var list []HandlerInfo
+	for _, handleType := range []int{Request, Response, Connected, Stream, UDP} {
+		for _, e := range table[handleType] {
+			list = append(list, HandlerInfo{
+				ID:       e.seq,
+				Type:     handleTypeNames[handleType],
+				Name:     e.name,
+				Priority: e.priority,
+				Enabled:  !e.disabled.Load(),
+			})
+		}
+	}
+	return list
+}
+
+// SetEnabled enables or disables the handler with the given ID, see
+// Registration.SetEnabled. It reports whether the handler exists.
+func (s *HandlerSet) SetEnabled(id uint64, enabled bool) bool {
+	for _, chain := range *s.table.Load() {
+		for _, e := range chain {
+			if e.seq == id {
+				e.disabled.Store(!enabled)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// update replaces the chain of the given type with the result of f
+func (s *HandlerSet) update(handleType int, f func(chain []*handleEntry) []*handleEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := *s.table.Load()
+	table := make(handleTable, len(old)+1)
+	for k, v := range old {
+		table[k] = v
+	}
+	// 复制后再修改，避免影响正在读取旧快照的请求
+	chain := make([]*handleEntry, len(old[handleType]))
+	copy(chain, old[handleType])
+	table[handleType] = f(chain)
+	s.table.Store(&table)
+}
+
+// add inserts e into the chain of the given type, keeping it sorted
+func (s *HandlerSet) add(handleType int, e *handleEntry) {
+	s.update(handleType, func(chain []*handleEntry) []*handleEntry {
+		s.seq++
+		e.seq = s.seq
+		chain = append(chain, e)
+		sort.SliceStable(chain, func(i, j int) bool {
+			if chain[i].priority != chain[j].priority {
+				return chain[i].priority < chain[j].priority
+			}
+			return chain[i].seq < chain[j].seq
+		})
+		return chain
+	})
+}
+
+// remove drops e from the chain of the given type
+func (s *HandlerSet) remove(handleType int, e *handleEntry) {
+	s.update(handleType, func(chain []*handleEntry) []*handleEntry {
+		for i, c := range chain {
+			if c == e {
+				return append(chain[:i], chain[i+1:]...)
+			}
+		}
+		return chain
+	})
+}
+
 type Dispatcher struct {
 	handleType int
-	url        string
-	p          *ProxyServer
+	matcher    Matcher
+	priority   int
+	name       string
+	handshake  bool
+	set        *HandlerSet
 }
 
 func NewDispatcher(handleType int, url string, p *ProxyServer) *Dispatcher {
-	return &Dispatcher{handleType: handleType, url: url, p: p}
-}
-func (d *Dispatcher) Do(f Handle) {
-	switch d.handleType {
-	case Request:
-		d.p.reqHandles[d.url] = f
-	case Response:
-		d.p.respHandles[d.url] = f
-	case Connected:
-		d.p.connectedHandles[d.url] = f
+	return NewMatchDispatcher(handleType, urlMatcher(url), p).Name(url)
+}
+
+// NewMatchDispatcher creates a dispatcher selecting exchanges with m
+func NewMatchDispatcher(handleType int, m Matcher, p *ProxyServer) *Dispatcher {
+	return &Dispatcher{handleType: handleType, matcher: m, set: p.Handlers()}
+}
+
+// Priority sets the position of the handler in its chain. Handlers run in
+// ascending priority order, handlers with equal priority run in the order
+// they were registered. The default priority is 0.
+func (d *Dispatcher) Priority(priority int) *Dispatcher {
+	d.priority = priority
+	return d
+}
+
+// Name labels the handler in HandlerSet.List, it defaults to the url of
+// OnRequest, OnResponse and OnConnected
+func (d *Dispatcher) Name(name string) *Dispatcher {
+	d.name = name
+	return d
+}
+
+// Handshake also runs the request or response handler on WebSocket
+// upgrades, with an empty body and ctx.WSSession nil, e.g. to change the
+// target or the headers of the handshake. Other handlers only see the
+// messages of the session.
+func (d *Dispatcher) Handshake() *Dispatcher {
+	d.handshake = true
+	return d
+}
+
+// Do appends f to the handler chain. Every matching handler receives the
+// body returned by the previous one.
+func (d *Dispatcher) Do(f Handle) *Registration {
+	e := &handleEntry{
+		matcher:   d.matcher,
+		priority:  d.priority,
+		name:      d.name,
+		handshake: d.handshake,
+		handle:    f,
 	}
+	r := &Registration{handleType: d.handleType, entry: e, set: d.set}
+	if f != nil {
+		d.set.add(d.handleType, e)
+	}
+	return r
 }
-func (p *ProxyServer) OnRequest(url string) *Dispatcher {
-	d := NewDispatcher(Request, url, p)
-	if p.hasReqHandle {
-		p.logger.Warn("request handle [*] already exists")
-		return d
+
+// DoStream appends f to the chain of stream handlers. Stream handlers run
+// after the Handle functions and are piped into each other; they also see
+// bodies too large to be buffered. WebSocket messages never reach them.
+func (d *Dispatcher) DoStream(f StreamHandle) *Registration {
+	e := &handleEntry{
+		matcher:  d.matcher,
+		priority: d.priority,
+		name:     d.name,
+		stream:   f,
 	}
-	if url == All {
-		p.hasReqHandle = true
-		p.reqHandles = make(map[string]Handle)
+	r := &Registration{handleType: d.handleType, entry: e, set: d.set}
+	if f != nil {
+		d.set.add(d.handleType, e)
 	}
-	p.reqHandles[url] = nil
+	return r
+}
+
+// StreamDispatcher registers handlers for the messages of raw TCP streams
+type StreamDispatcher struct {
+	matcher  Matcher
+	priority int
+	name     string
+	framer   Framer
+	set      *HandlerSet
+}
+
+// Priority sets the position of the handler in the stream chain, see
+// Dispatcher.Priority
+func (d *StreamDispatcher) Priority(priority int) *StreamDispatcher {
+	d.priority = priority
 	return d
 }
 
-func (p *ProxyServer) OnResponse(url string) *Dispatcher {
-	d := NewDispatcher(Response, url, p)
-	if p.hasRespHandle {
-		p.logger.Warn("response handle [*] already exists.")
-		return d
+// Name labels the handler in HandlerSet.List
+func (d *StreamDispatcher) Name(name string) *StreamDispatcher {
+	d.name = name
+	return d
+}
+
+// Framer sets how the stream is split into messages. A stream uses the
+// framer of the first matching handler that has one; without a framer
+// handlers see the data in the chunks it was received.
+func (d *StreamDispatcher) Framer(f Framer) *StreamDispatcher {
+	d.framer = f
+	return d
+}
+
+// Do appends f to the stream handler chain
+func (d *StreamDispatcher) Do(f MessageHandle) *Registration {
+	e := &handleEntry{
+		matcher:  d.matcher,
+		priority: d.priority,
+		name:     d.name,
+		message:  f,
+		framer:   d.framer,
 	}
-	if url == All {
-		p.hasRespHandle = true
-		p.respHandles = make(map[string]Handle)
+	r := &Registration{handleType: Stream, entry: e, set: d.set}
+	if f != nil {
+		d.set.add(Stream, e)
 	}
-	p.respHandles[url] = nil
+	return r
+}
+
+// DatagramDispatcher registers handlers for UDP datagrams
+type DatagramDispatcher struct {
+	matcher  Matcher
+	priority int
+	name     string
+	set      *HandlerSet
+}
+
+// Priority sets the position of the handler in the datagram chain, see
+// Dispatcher.Priority
+func (d *DatagramDispatcher) Priority(priority int) *DatagramDispatcher {
+	d.priority = priority
 	return d
 }
 
+// Name labels the handler in HandlerSet.List
+func (d *DatagramDispatcher) Name(name string) *DatagramDispatcher {
+	d.name = name
+	return d
+}
+
+// Do appends f to the datagram handler chain
+func (d *DatagramDispatcher) Do(f MessageHandle) *Registration {
+	e := &handleEntry{
+		matcher:  d.matcher,
+		priority: d.priority,
+		name:     d.name,
+		message:  f,
+	}
+	r := &Registration{handleType: UDP, entry: e, set: d.set}
+	if f != nil {
+		d.set.add(UDP, e)
+	}
+	return r
+}
+
+// Registration identifies a handler added with Dispatcher.Do
+type Registration struct {
+	handleType int
+	entry      *handleEntry
+	set        *HandlerSet
+}
+
+// Remove unregisters the handler. Exchanges already running the chain
+// may still call it once.
+func (r *Registration) Remove() {
+	r.set.remove(r.handleType, r.entry)
+}
+
+// ID returns the ID of the handler in HandlerSet.List, 0 if no handler was
+// registered
+func (r *Registration) ID() uint64 {
+	return r.entry.seq
+}
+
+// SetEnabled enables or disables the handler without changing its place
+// in the chain. Handlers are enabled when registered.
+func (r *Registration) SetEnabled(enabled bool) {
+	r.entry.disabled.Store(!enabled)
+}
+
+func (p *ProxyServer) OnRequest(url string) *Dispatcher {
+	return NewDispatcher(Request, url, p)
+}
+
+func (p *ProxyServer) OnResponse(url string) *Dispatcher {
+	return NewDispatcher(Response, url, p)
+}
+
 func (p *ProxyServer) OnConnected(url string) *Dispatcher {
-	d := NewDispatcher(Connected, url, p)
-	if p.hasConnectedHandle {
-		p.logger.Warn("connected handle [*] already exists")
-		return d
+	return NewDispatcher(Connected, url, p)
+}
+
+// OnRequestMatch registers request handlers for exchanges selected by m
+func (p *ProxyServer) OnRequestMatch(m Matcher) *Dispatcher {
+	return NewMatchDispatcher(Request, m, p)
+}
+
+// OnResponseMatch registers response handlers for exchanges selected by m
+func (p *ProxyServer) OnResponseMatch(m Matcher) *Dispatcher {
+	return NewMatchDispatcher(Response, m, p)
+}
+
+// OnConnectedMatch registers WebSocket connected handlers selected by m
+func (p *ProxyServer) OnConnectedMatch(m Matcher) *Dispatcher {
+	return NewMatchDispatcher(Connected, m, p)
+}
+
+// OnStream registers message handlers for TCP streams selected by m, with
+// or without TLS. Selected connections are not parsed as HTTP; matchers see
+// ctx.Stream instead of ctx.Req.
+func (p *ProxyServer) OnStream(m Matcher) *StreamDispatcher {
+	return p.Handlers().OnStream(m)
+}
+
+// Handlers returns the handler set currently used by the proxy
+func (p *ProxyServer) Handlers() *HandlerSet {
+	return p.handlers.Load()
+}
+
+// ReplaceHandlers atomically swaps the handler set used by the proxy and
+// returns the previous one. Exchanges that are already running keep the
+// chain they started with for the current phase.
+func (p *ProxyServer) ReplaceHandlers(s *HandlerSet) *HandlerSet {
+	if s == nil {
+		s = NewHandlerSet()
 	}
-	if url == All {
-		p.hasConnectedHandle = true
-		p.connectedHandles = make(map[string]Handle)
+	return p.handlers.Swap(s)
+}
+
+// runHandshake runs the handlers of the given type registered with
+// Dispatcher.Handshake on a WebSocket upgrade
+func (p *ProxyServer) runHandshake(handleType int, ctx *ProxyCtx) {
+	for _, e := range p.Handlers().chain(handleType) {
+		if e.handshake && e.handle != nil && e.matcher.Match(ctx) {
+			e.handle([]byte{}, ctx)
+		}
 	}
-	p.connectedHandles[url] = nil
-	return d
+}
+
+// runHandles passes body through every handler of the given type matching ctx
+func (p *ProxyServer) runHandles(handleType int, body []byte, ctx *ProxyCtx) []byte {
+	for _, e := range p.Handlers().chain(handleType) {
+		if e.handle != nil && e.matcher.Match(ctx) {
+			body = e.handle(body, ctx)
+		}
+	}
+	return body
 }
@@ -0,0 +1,49 @@
+package gamemitm
+
+import (
+	"testing"
+)
+
+func TestHandlerChainOrder(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+
+	appendTo := func(s string) Handle {
+		return func(body []byte, ctx *ProxyCtx) []byte {
+			return append(body, s...)
+		}
+	}
+	p.OnRequest(All).Do(appendTo("b"))
+	p.OnRequest(All).Priority(-1).Do(appendTo("a"))
+	p.OnRequest(All).Do(appendTo("c"))
+	p.OnRequest("no-such-host").Priority(-2).Do(appendTo("x"))
+	p.OnResponse(All).Do(appendTo("!"))
+
+	_, body := doText(t, client, "POST", upstream.URL, "-")
+	if body != "-abc!" {
+		t.Fatalf("body = %q, want %q", body, "-abc!")
+	}
+}
+
+func TestHandlerChainSeesPreviousBody(t *testing.T) {
+	s := NewHandlerSet()
+	var seen []string
+	s.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		seen = append(seen, string(body))
+		return []byte("second")
+	})
+	s.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		seen = append(seen, string(body))
+		return []byte("third")
+	})
+	p := NewProxy()
+	p.ReplaceHandlers(s)
+
+	body := p.runHandles(Request, []byte("first"), &ProxyCtx{Proxy: p})
+	if string(body) != "third" {
+		t.Fatalf("body = %q, want %q", body, "third")
+	}
+	if len(seen) != 2 || seen[0] != "first" || seen[1] != "second" {
+		t.Fatalf("handlers saw %q", seen)
+	}
+}
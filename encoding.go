@@ -0,0 +1,165 @@
+package gamemitm
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// SetKeepContentEncoding controls what happens to a compressed body after
+// handlers processed its decoded form: it is compressed again with the
+// original Content-Encoding (the default) or sent uncompressed with the
+// Content-Encoding header removed.
+func (p *ProxyServer) SetKeepContentEncoding(keep bool) {
+	p.keepEncoding = keep
+}
+
+// contentEncoding returns the Content-Encoding of header if the proxy can
+// decode it, or "" for identity and unsupported encodings
+func contentEncoding(header http.Header) string {
+	encoding := strings.ToLower(strings.TrimSpace(strings.Join(header.Values("Content-Encoding"), ",")))
+	switch encoding {
+	case "gzip", "x-gzip", "deflate", "br", "zstd":
+		return encoding
+	}
+	return ""
+}
+
+// newDecoder returns a reader producing the decoded content of r
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// 规范要求 zlib 格式，但部分服务器直接发送原始 deflate 数据
+		br := bufio.NewReader(r)
+		head, err := br.Peek(2)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(head) == 2 && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// newEncoder returns a writer compressing into w
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// decodeBytes decodes data, failing if the result exceeds max bytes
+func decodeBytes(encoding string, data []byte, max int64) ([]byte, error) {
+	r, err := newDecoder(encoding, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if max <= 0 {
+		return io.ReadAll(r)
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > max {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", max)
+	}
+	return decoded, nil
+}
+
+// encodeBytes compresses data again or drops the Content-Encoding header,
+// depending on the proxy settings
+func (p *ProxyServer) encodeBytes(encoding string, data []byte, header http.Header) ([]byte, error) {
+	if !p.keepEncoding {
+		header.Del("Content-Encoding")
+		return data, nil
+	}
+	var buf bytes.Buffer
+	w, err := newEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeStream is the streaming counterpart of encodeBytes
+func (p *ProxyServer) encodeStream(encoding string, body io.ReadCloser, header http.Header) io.ReadCloser {
+	if !p.keepEncoding {
+		header.Del("Content-Encoding")
+		return body
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := newEncoder(encoding, pw)
+		if err == nil {
+			if _, err = io.Copy(w, body); err == nil {
+				err = w.Close()
+			}
+		}
+		pw.CloseWithError(err)
+		body.Close()
+	}()
+	return pr
+}
+
+// lazyDecoder creates its decoder on the first read, so that empty bodies
+// of compressed responses (HEAD, 304) do not fail
+type lazyDecoder struct {
+	encoding string
+	body     io.ReadCloser
+	r        io.ReadCloser
+	err      error
+}
+
+func (d *lazyDecoder) Read(b []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = newDecoder(d.encoding, d.body)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(b)
+}
+
+func (d *lazyDecoder) Close() error {
+	if d.r != nil {
+		d.r.Close()
+	}
+	return d.body.Close()
+}
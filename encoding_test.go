@@ -0,0 +1,97 @@
+package gamemitm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncodingRoundTrip(t *testing.T) {
+	p := NewProxy()
+	data := []byte(strings.Repeat("game data ", 100))
+	for _, encoding := range []string{"gzip", "deflate", "br", "zstd"} {
+		encoded, err := p.encodeBytes(encoding, data, http.Header{})
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		decoded, err := decodeBytes(encoding, encoded, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("%s: round trip changed the data", encoding)
+		}
+		if _, err := decodeBytes(encoding, encoded, 10); err == nil {
+			t.Fatalf("%s: decoding past the limit did not fail", encoding)
+		}
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	for value, want := range map[string]string{
+		"gzip":     "gzip",
+		" GZIP ":   "gzip",
+		"br":       "br",
+		"identity": "",
+		"gzip, br": "",
+	} {
+		if got := contentEncoding(http.Header{"Content-Encoding": {value}}); got != want {
+			t.Errorf("contentEncoding(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+// gzipServer answers with the gzip compressed text, streamed in chunks
+func gzipServer(t *testing.T, text string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, text)
+		zw.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHandlersSeeDecodedBody(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := gzipServer(t, "hello")
+	seen := make(chan string, 1)
+	p.OnResponse(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		seen <- string(body)
+		return []byte("HELLO")
+	})
+
+	resp, body := doText(t, client, "GET", upstream.URL, "")
+	if got := <-seen; got != "hello" {
+		t.Fatalf("handler saw %q, want the decoded body", got)
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip kept", resp.Header.Get("Content-Encoding"))
+	}
+	plain, err := decodeBytes("gzip", []byte(body), 0)
+	if err != nil || string(plain) != "HELLO" {
+		t.Fatalf("client got %q (%v), want the handler result compressed", plain, err)
+	}
+}
+
+func TestDropContentEncoding(t *testing.T) {
+	p, client := newTestProxy(t)
+	p.SetKeepContentEncoding(false)
+	upstream := gzipServer(t, "hello")
+	p.OnResponse(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return bytes.ToUpper(body)
+	})
+
+	resp, body := doText(t, client, "GET", upstream.URL, "")
+	if resp.Header.Get("Content-Encoding") != "" || body != "HELLO" {
+		t.Fatalf("got %q with Content-Encoding %q, want plain HELLO", body, resp.Header.Get("Content-Encoding"))
+	}
+	if resp.ContentLength != 5 {
+		t.Fatalf("Content-Length = %d, want 5", resp.ContentLength)
+	}
+}
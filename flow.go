@@ -0,0 +1,476 @@
+package gamemitm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flow is a completed HTTP exchange or WebSocket session. Bodies are kept
+// as they went over the wire, compressed if the Content-Encoding says so,
+// and cut at the max body size.
+type Flow struct {
+	ID       uint64        `json:"id"`
+	Start    time.Time     `json:"start"`
+	Request  *FlowRequest  `json:"request"`
+	Response *FlowResponse `json:"response"`
+	// Messages are the WebSocket messages in the order they were relayed,
+	// nil for plain HTTP
+	Messages []*FlowMessage `json:"messages,omitempty"`
+	Timings  FlowTimings    `json:"timings"`
+	// Error is set when the exchange did not complete, e.g. the upstream
+	// could not be reached or a handler dropped the request
+	Error string `json:"error,omitempty"`
+
+	ctx *ProxyCtx
+}
+
+// FlowRequest is the request of a flow
+type FlowRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Proto  string `json:"proto"`
+	// Header is the header sent upstream and OriginalHeader the one
+	// received from the client
+	Header         http.Header `json:"header"`
+	OriginalHeader http.Header `json:"originalHeader"`
+	// Body is the body sent upstream, OriginalBody the one received from
+	// the client when the handlers changed it
+	Body         []byte `json:"body"`
+	OriginalBody []byte `json:"originalBody,omitempty"`
+	Truncated    bool   `json:"truncated,omitempty"`
+}
+
+// FlowResponse is the response of a flow, nil when none was received
+type FlowResponse struct {
+	StatusCode int    `json:"statusCode"`
+	Status     string `json:"status"`
+	Proto      string `json:"proto"`
+	// Header is the header sent to the client and OriginalHeader the one
+	// received from the server
+	Header         http.Header `json:"header"`
+	OriginalHeader http.Header `json:"originalHeader"`
+	// Body is the body sent to the client, OriginalBody the one received
+	// from the server when the handlers changed it
+	Body         []byte `json:"body"`
+	OriginalBody []byte `json:"originalBody,omitempty"`
+	Truncated    bool   `json:"truncated,omitempty"`
+}
+
+// FlowMessage is a WebSocket message of a flow
+type FlowMessage struct {
+	Time      time.Time `json:"time"`
+	Direction Direction `json:"direction"`
+	// Type is websocket.TextMessage or websocket.BinaryMessage
+	Type int `json:"type"`
+	// Data is the relayed message, OriginalData the received one when the
+	// handlers changed it
+	Data         []byte `json:"data"`
+	OriginalData []byte `json:"originalData,omitempty"`
+}
+
+// FlowTimings splits the duration of a flow, in nanoseconds in JSON
+type FlowTimings struct {
+	// Send lasts until the request is handed to the upstream connection,
+	// including the request handlers
+	Send time.Duration `json:"send"`
+	// Wait lasts until the response headers arrive
+	Wait time.Duration `json:"wait"`
+	// Receive lasts until the response is written to the client
+	Receive time.Duration `json:"receive"`
+}
+
+// Match reports whether m matches the flow, as it would the context of
+// the exchange
+func (f *Flow) Match(m Matcher) bool {
+	return f.ctx != nil && m.Match(f.ctx)
+}
+
+// errDropped is the error of flows dropped with ProxyCtx.Drop
+var errDropped = errors.New("dropped by a handler")
+
+// FlowObserver is notified of every completed flow. ObserveFlow is called
+// on the connection goroutine and must not modify the flow.
+type FlowObserver interface {
+	ObserveFlow(f *Flow)
+}
+
+// FlowObserverFunc adapts a function to FlowObserver
+type FlowObserverFunc func(f *Flow)
+
+func (fn FlowObserverFunc) ObserveFlow(f *Flow) {
+	fn(f)
+}
+
+// StreamObserver is implemented by flow observers that also want the
+// intercepted raw TCP streams. ObserveStream gets the bytes written to the
+// peer, framing included, on the stream goroutines.
+type StreamObserver interface {
+	ObserveStream(ctx *ProxyCtx, dir Direction, data []byte)
+	StreamClosed(ctx *ProxyCtx)
+}
+
+// DefaultCaptureSize is the number of body bytes recorded for observers
+// that do not implement CaptureFilter
+const DefaultCaptureSize = 4 << 20
+
+// CaptureFilter is implemented by flow observers that only want some flows
+// or choose how much of the bodies to keep. CaptureFlow is called when the
+// request arrives, before the handlers run: matchers only see the request,
+// those depending on the response such as ContentType do not match. limit
+// is the number of bytes kept of each body, 0 or less for all of them.
+// Flows are only recorded when an observer wants them.
+type CaptureFilter interface {
+	CaptureFlow(ctx *ProxyCtx) (limit int64, ok bool)
+}
+
+// captureLimit returns the capture limit for a MaxBodySize setting of an
+// observer: DefaultCaptureSize for 0, no limit when negative
+func captureLimit(maxBodySize int64) int64 {
+	switch {
+	case maxBodySize == 0:
+		return DefaultCaptureSize
+	case maxBodySize < 0:
+		return 0
+	}
+	return maxBodySize
+}
+
+// MessageObserver is implemented by flow observers that also want the
+// WebSocket messages of sessions still in progress. ObserveMessage is
+// called on the relay goroutines as each message is relayed.
+type MessageObserver interface {
+	ObserveMessage(flowID uint64, m *FlowMessage)
+}
+
+// sessionMessageObserver is MessageObserver for the recorders of this
+// package that also need the context of the session
+type sessionMessageObserver interface {
+	observeSessionMessage(ctx *ProxyCtx, flowID uint64, m *FlowMessage)
+}
+
+// flowObservers is the list of observers of a proxy, flows are only
+// recorded while it is not empty
+type flowObservers struct {
+	mu   sync.Mutex
+	list atomic.Pointer[[]*FlowObserver]
+	seq  atomic.Uint64
+}
+
+// AddFlowObserver registers o and returns a function removing it
+func (p *ProxyServer) AddFlowObserver(o FlowObserver) (remove func()) {
+	entry := &o
+	obs := &p.flowObservers
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	var list []*FlowObserver
+	if cur := obs.list.Load(); cur != nil {
+		list = append(list, *cur...)
+	}
+	list = append(list, entry)
+	obs.list.Store(&list)
+
+	return func() {
+		obs.mu.Lock()
+		defer obs.mu.Unlock()
+		var list []*FlowObserver
+		for _, e := range *obs.list.Load() {
+			if e != entry {
+				list = append(list, e)
+			}
+		}
+		obs.list.Store(&list)
+	}
+}
+
+// streamObservers returns the observers implementing StreamObserver
+func (p *ProxyServer) streamObservers() []StreamObserver {
+	list := p.flowObservers.list.Load()
+	if list == nil {
+		return nil
+	}
+	var observers []StreamObserver
+	for _, o := range *list {
+		if so, ok := (*o).(StreamObserver); ok {
+			observers = append(observers, so)
+		}
+	}
+	return observers
+}
+
+// flowRecord collects a flow while the exchange is in progress, its
+// methods do nothing on a nil record
+type flowRecord struct {
+	p   *ProxyServer
+	ctx *ProxyCtx
+	// observers are the flow observers that want the flow
+	observers []FlowObserver
+	flow      *Flow
+	limit     int64
+	mu        sync.Mutex
+	sentAt    time.Time
+	headerAt  time.Time
+	done      bool
+
+	reqOriginal, reqSent   *captureBuffer
+	respOriginal, respSent *captureBuffer
+	respHeader             http.Header
+}
+
+// startFlow starts recording the exchange of ctx, nil when no observer
+// wants it. It must be called before the request handlers run.
+func (p *ProxyServer) startFlow(ctx *ProxyCtx) *flowRecord {
+	list := p.flowObservers.list.Load()
+	if list == nil || len(*list) == 0 {
+		return nil
+	}
+	var observers []FlowObserver
+	// -1 表示尚无观察者
+	limit := int64(-1)
+	for _, o := range *list {
+		want := int64(DefaultCaptureSize)
+		if cf, ok := (*o).(CaptureFilter); ok {
+			l, ok := cf.CaptureFlow(ctx)
+			if !ok {
+				continue
+			}
+			want = l
+		}
+		observers = append(observers, *o)
+		// 取各观察者中最大的限制，任一不限制则全部保留
+		switch {
+		case want <= 0:
+			limit = 0
+		case limit != 0 && want > limit:
+			limit = want
+		}
+	}
+	if len(observers) == 0 {
+		return nil
+	}
+	f := &flowRecord{
+		p:         p,
+		ctx:       ctx,
+		observers: observers,
+		limit:     limit,
+		flow: &Flow{
+			ID:      p.flowObservers.seq.Add(1),
+			Start:   time.Now(),
+			Request: &FlowRequest{OriginalHeader: ctx.Req.Header.Clone()},
+			ctx:     ctx,
+		},
+	}
+	ctx.flow = f
+	return f
+}
+
+// original records the body received for the given handle type, before
+// the handlers run. For responses it also marks the arrival of the
+// response headers.
+func (f *flowRecord) original(handleType int, body io.ReadCloser) io.ReadCloser {
+	if f == nil {
+		return body
+	}
+	buf := &captureBuffer{limit: f.limit}
+	f.mu.Lock()
+	if handleType == Response {
+		f.headerAt = time.Now()
+		if f.sentAt.IsZero() {
+			f.sentAt = f.headerAt
+		}
+		if f.ctx.Resp != nil {
+			f.respHeader = f.ctx.Resp.Header.Clone()
+		}
+		f.respOriginal = buf
+	} else {
+		f.reqOriginal = buf
+	}
+	f.mu.Unlock()
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	return &captureBody{ReadCloser: body, buf: buf}
+}
+
+// processed records the body sent on for the given handle type, after the
+// handlers ran. For requests it also marks the request as sent.
+func (f *flowRecord) processed(handleType int, body io.ReadCloser) io.ReadCloser {
+	if f == nil {
+		return body
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	original := f.reqOriginal
+	if handleType == Response {
+		original = f.respOriginal
+	} else {
+		f.sentAt = time.Now()
+	}
+	// 没有处理函数时 body 原样返回，无需再记录一份
+	if c, ok := body.(*captureBody); ok && c.buf == original {
+		return body
+	}
+	buf := &captureBuffer{limit: f.limit}
+	if handleType == Response {
+		f.respSent = buf
+	} else {
+		f.reqSent = buf
+	}
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	return &captureBody{ReadCloser: body, buf: buf}
+}
+
+// message records a relayed WebSocket message, data is nil when the
+// handlers dropped it
+func (f *flowRecord) message(dir Direction, msgType int, original, data []byte) {
+	if f == nil {
+		return
+	}
+	m := &FlowMessage{Time: time.Now(), Direction: dir, Type: msgType, Data: data}
+	if !bytes.Equal(original, data) {
+		m.OriginalData = append([]byte(nil), original...)
+	}
+	f.mu.Lock()
+	// 会话结束后另一方向可能仍在转发，此时流量已交给观察者
+	done := f.done
+	if !done {
+		f.flow.Messages = append(f.flow.Messages, m)
+	}
+	f.mu.Unlock()
+	if done {
+		return
+	}
+	for _, o := range f.observers {
+		switch mo := o.(type) {
+		case sessionMessageObserver:
+			mo.observeSessionMessage(f.ctx, f.flow.ID, m)
+		case MessageObserver:
+			mo.ObserveMessage(f.flow.ID, m)
+		}
+	}
+}
+
+// messages returns the WebSocket messages recorded so far
+func (f *flowRecord) messages() []*FlowMessage {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*FlowMessage(nil), f.flow.Messages...)
+}
+
+// fail records why the exchange did not complete
+func (f *flowRecord) fail(err error) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.flow.Error = err.Error()
+	f.mu.Unlock()
+}
+
+// finish completes the flow and hands it to the observers
+func (f *flowRecord) finish() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.done = true
+	flow := f.flow
+	now := time.Now()
+	req := f.ctx.Req
+	flow.Request.Method = req.Method
+	flow.Request.URL = req.URL.String()
+	flow.Request.Proto = req.Proto
+	flow.Request.Header = req.Header.Clone()
+	flow.Request.Body, flow.Request.OriginalBody, flow.Request.Truncated = capturedBodies(f.reqOriginal, f.reqSent)
+	if resp := f.ctx.Resp; resp != nil && !f.headerAt.IsZero() {
+		flow.Response = &FlowResponse{
+			StatusCode:     resp.StatusCode,
+			Status:         resp.Status,
+			Proto:          resp.Proto,
+			Header:         resp.Header.Clone(),
+			OriginalHeader: f.respHeader,
+		}
+		flow.Response.Body, flow.Response.OriginalBody, flow.Response.Truncated = capturedBodies(f.respOriginal, f.respSent)
+		flow.Timings = FlowTimings{
+			Send:    f.sentAt.Sub(flow.Start),
+			Wait:    f.headerAt.Sub(f.sentAt),
+			Receive: now.Sub(f.headerAt),
+		}
+	} else {
+		flow.Timings.Send = now.Sub(flow.Start)
+	}
+	f.mu.Unlock()
+
+	for _, o := range f.observers {
+		o.ObserveFlow(flow)
+	}
+}
+
+// capturedBodies returns the body that was sent on and the original one
+// when they differ
+func capturedBodies(original, sent *captureBuffer) (body, orig []byte, truncated bool) {
+	if original != nil {
+		body, truncated = original.bytes()
+	}
+	if sent == nil {
+		return body, nil, truncated
+	}
+	data, t := sent.bytes()
+	if bytes.Equal(data, body) {
+		return data, nil, truncated || t
+	}
+	return data, body, truncated || t
+}
+
+// captureBuffer keeps the first limit bytes written to it, all of them
+// when limit <= 0
+type captureBuffer struct {
+	mu        sync.Mutex
+	limit     int64
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	if b.limit > 0 {
+		if room := b.limit - int64(b.buf.Len()); int64(n) > room {
+			p = p[:room]
+			b.truncated = true
+		}
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+func (b *captureBuffer) bytes() ([]byte, bool) {
+	if b == nil {
+		return nil, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...), b.truncated
+}
+
+// captureBody copies everything read from a body to buf
+type captureBody struct {
+	io.ReadCloser
+	buf *captureBuffer
+}
+
+func (c *captureBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
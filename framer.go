@@ -0,0 +1,270 @@
+package gamemitm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Framer splits a TCP byte stream into messages and frames them back
+type Framer interface {
+	// ReadMessage reads the next whole message from r
+	ReadMessage(r *bufio.Reader) ([]byte, error)
+	// WriteMessage writes msg with its framing to w
+	WriteMessage(w io.Writer, msg []byte) error
+}
+
+// LengthPrefixFramer frames messages with a length prefix, handlers see
+// the payload without the prefix
+type LengthPrefixFramer struct {
+	// Size is the size of the prefix in bytes: 1, 2, 4 or 8
+	Size int
+	// ByteOrder of the prefix, big endian when nil
+	ByteOrder binary.ByteOrder
+	// Inclusive means the length counts the prefix itself
+	Inclusive bool
+	// MaxSize is the largest accepted payload, DefaultMaxBodySize when 0
+	MaxSize int
+}
+
+func (f *LengthPrefixFramer) ReadMessage(r *bufio.Reader) ([]byte, error) {
+	if err := checkLengthSize(f.Size); err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, f.Size)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	n, err := readLength(prefix, f.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+	if f.Inclusive {
+		if n < uint64(f.Size) {
+			return nil, fmt.Errorf("frame length %d is smaller than its prefix", n)
+		}
+		n -= uint64(f.Size)
+	}
+	if err := checkFrameSize(n, f.MaxSize); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	return msg, noEOF(err)
+}
+
+func (f *LengthPrefixFramer) WriteMessage(w io.Writer, msg []byte) error {
+	if err := checkLengthSize(f.Size); err != nil {
+		return err
+	}
+	n := uint64(len(msg))
+	if f.Inclusive {
+		n += uint64(f.Size)
+	}
+	prefix := make([]byte, f.Size)
+	if err := putLength(prefix, n, f.ByteOrder); err != nil {
+		return err
+	}
+	_, err := w.Write(append(prefix, msg...))
+	return err
+}
+
+// DelimiterFramer frames messages ending with a delimiter such as "\n" or
+// "\x00", handlers see the message without the delimiter
+type DelimiterFramer struct {
+	Delimiter []byte
+	// MaxSize is the largest accepted message, DefaultMaxBodySize when 0
+	MaxSize int
+}
+
+func (f *DelimiterFramer) ReadMessage(r *bufio.Reader) ([]byte, error) {
+	if len(f.Delimiter) == 0 {
+		return nil, errors.New("empty frame delimiter")
+	}
+	last := f.Delimiter[len(f.Delimiter)-1]
+	var msg []byte
+	for {
+		chunk, err := r.ReadSlice(last)
+		msg = append(msg, chunk...)
+		if err == nil && bytes.HasSuffix(msg, f.Delimiter) {
+			return msg[:len(msg)-len(f.Delimiter)], nil
+		}
+		if err := checkFrameSize(uint64(len(msg)), f.MaxSize); err != nil {
+			return nil, err
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			if len(msg) > 0 {
+				return nil, noEOF(err)
+			}
+			return nil, err
+		}
+	}
+}
+
+func (f *DelimiterFramer) WriteMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(msg[:len(msg):len(msg)], f.Delimiter...))
+	return err
+}
+
+// FixedHeaderFramer frames messages that start with a fixed size header
+// holding the length at a known offset. Handlers see the whole frame,
+// header included; the length field is rewritten when the frame is sent.
+type FixedHeaderFramer struct {
+	// HeaderSize is the size of the header in bytes
+	HeaderSize int
+	// LengthOffset and LengthSize locate the length field in the header,
+	// LengthSize is 1, 2, 4 or 8
+	LengthOffset int
+	LengthSize   int
+	// ByteOrder of the length field, big endian when nil
+	ByteOrder binary.ByteOrder
+	// LengthAdjust is added to HeaderSize plus the length field to get the
+	// frame size, e.g. -HeaderSize when the field holds the frame size
+	LengthAdjust int
+	// MaxSize is the largest accepted frame, DefaultMaxBodySize when 0
+	MaxSize int
+}
+
+// check validates the configuration of the framer
+func (f *FixedHeaderFramer) check() error {
+	if err := checkLengthSize(f.LengthSize); err != nil {
+		return err
+	}
+	if f.LengthOffset < 0 || f.LengthOffset+f.LengthSize > f.HeaderSize {
+		return errors.New("length field is outside of the frame header")
+	}
+	return nil
+}
+
+func (f *FixedHeaderFramer) ReadMessage(r *bufio.Reader) ([]byte, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	header := make([]byte, f.HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	n, err := readLength(header[f.LengthOffset:f.LengthOffset+f.LengthSize], f.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(f.HeaderSize) + int64(n) + int64(f.LengthAdjust)
+	if size < int64(f.HeaderSize) {
+		return nil, fmt.Errorf("frame size %d is smaller than its header", size)
+	}
+	if err := checkFrameSize(uint64(size), f.MaxSize); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	copy(msg, header)
+	_, err = io.ReadFull(r, msg[f.HeaderSize:])
+	return msg, noEOF(err)
+}
+
+func (f *FixedHeaderFramer) WriteMessage(w io.Writer, msg []byte) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	if len(msg) < f.HeaderSize {
+		return fmt.Errorf("message of %d bytes is shorter than the frame header", len(msg))
+	}
+	n := int64(len(msg)) - int64(f.HeaderSize) - int64(f.LengthAdjust)
+	if n < 0 {
+		return fmt.Errorf("message of %d bytes is too short for its length field", len(msg))
+	}
+	// 按实际长度重写长度字段，处理函数修改消息后无需自行计算
+	frame := make([]byte, len(msg))
+	copy(frame, msg)
+	if err := putLength(frame[f.LengthOffset:f.LengthOffset+f.LengthSize], uint64(n), f.ByteOrder); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// rawFramer hands out whatever has been read so far, it is used when no
+// framer is configured
+type rawFramer struct{}
+
+func (rawFramer) ReadMessage(r *bufio.Reader) ([]byte, error) {
+	if _, err := r.Peek(1); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, r.Buffered())
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func (rawFramer) WriteMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(msg)
+	return err
+}
+
+// checkLengthSize checks the size of a length field, 1, 2, 4 or 8 bytes
+func checkLengthSize(size int) error {
+	switch size {
+	case 1, 2, 4, 8:
+		return nil
+	}
+	return fmt.Errorf("unsupported length field size %d", size)
+}
+
+func readLength(b []byte, order binary.ByteOrder) (uint64, error) {
+	if order == nil {
+		order = binary.BigEndian
+	}
+	switch len(b) {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(order.Uint16(b)), nil
+	case 4:
+		return uint64(order.Uint32(b)), nil
+	case 8:
+		return order.Uint64(b), nil
+	}
+	return 0, fmt.Errorf("unsupported length field size %d", len(b))
+}
+
+func putLength(b []byte, n uint64, order binary.ByteOrder) error {
+	if order == nil {
+		order = binary.BigEndian
+	}
+	if len(b) < 8 && n >= 1<<(8*len(b)) {
+		return fmt.Errorf("length %d does not fit in %d bytes", n, len(b))
+	}
+	switch len(b) {
+	case 1:
+		b[0] = byte(n)
+	case 2:
+		order.PutUint16(b, uint16(n))
+	case 4:
+		order.PutUint32(b, uint32(n))
+	case 8:
+		order.PutUint64(b, n)
+	default:
+		return fmt.Errorf("unsupported length field size %d", len(b))
+	}
+	return nil
+}
+
+func checkFrameSize(n uint64, max int) error {
+	if max <= 0 {
+		max = DefaultMaxBodySize
+	}
+	if n > uint64(max) {
+		return fmt.Errorf("frame of %d bytes exceeds %d bytes", n, max)
+	}
+	return nil
+}
+
+// noEOF turns an EOF in the middle of a frame into io.ErrUnexpectedEOF
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -2,4 +2,15 @@ module github.com/husanpao/game-mitm
 
 go 1.20
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.17.9
+	golang.org/x/net v0.35.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
+)
+
+require (
+	golang.org/x/crypto v0.33.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+)
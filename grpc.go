@@ -0,0 +1,99 @@
+package gamemitm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// isGRPC reports whether header describes a gRPC message stream
+func isGRPC(header http.Header) bool {
+	ct := header.Get("Content-Type")
+	return ct == "application/grpc" ||
+		strings.HasPrefix(ct, "application/grpc+") ||
+		strings.HasPrefix(ct, "application/grpc;")
+}
+
+// grpcBody runs handles on every length-prefixed gRPC message in body
+// instead of the body as a whole, so streaming calls keep streaming
+func (p *ProxyServer) grpcBody(handles []*handleEntry, body io.ReadCloser, encoding string, ctx *ProxyCtx) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(p.processGRPCMessages(handles, body, pw, encoding, ctx))
+		body.Close()
+	}()
+	return pr
+}
+
+func (p *ProxyServer) processGRPCMessages(handles []*handleEntry, r io.Reader, w io.Writer, encoding string, ctx *ProxyCtx) error {
+	header := make([]byte, 5)
+	for {
+		// 每条消息：1字节压缩标志 + 4字节大端长度 + 消息体
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		compressed := header[0]&1 == 1
+		length := binary.BigEndian.Uint32(header[1:])
+		if p.maxBodySize > 0 && int64(length) > p.maxBodySize {
+			p.logger.Warn("gRPC message of %d bytes exceeds %d bytes, forwarding without handlers", length, p.maxBodySize)
+			if _, err := w.Write(header); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, r, int64(length)); err != nil {
+				return err
+			}
+			continue
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return err
+		}
+
+		if compressed && encoding != "gzip" {
+			// 不支持的压缩算法，原样转发
+			if _, err := w.Write(header); err != nil {
+				return err
+			}
+			if _, err := w.Write(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		if compressed {
+			zr, err := gzip.NewReader(bytes.NewReader(msg))
+			if err != nil {
+				return err
+			}
+			if msg, err = io.ReadAll(zr); err != nil {
+				return err
+			}
+		}
+		for _, e := range handles {
+			msg = e.handle(msg, ctx)
+		}
+		if compressed {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(msg); err != nil {
+				return err
+			}
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			msg = buf.Bytes()
+		}
+		binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+	}
+}
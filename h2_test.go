@@ -0,0 +1,35 @@
+package gamemitm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTP2Interception(t *testing.T) {
+	p, client := newTestProxy(t)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Proto", r.Proto)
+		echoHandler(w, r)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	p.OnResponse(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return append(body, " via "+ctx.Req.Proto...)
+	})
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, body := doText(t, client, "POST", upstream.URL+path, path)
+		if resp.ProtoMajor != 2 {
+			t.Errorf("%s: client spoke %s, want HTTP/2", path, resp.Proto)
+		}
+		if want := path + " via HTTP/2.0"; body != want {
+			t.Errorf("%s: body = %q, want %q", path, body, want)
+		}
+		if got := resp.Header.Get("X-Upstream-Proto"); got != "HTTP/2.0" {
+			t.Errorf("%s: upstream saw %s", path, got)
+		}
+	}
+}
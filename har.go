@@ -0,0 +1,412 @@
+package gamemitm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HARConfig configures a HARRecorder
+type HARConfig struct {
+	// Dir is the directory the HAR files are written to, it is created if
+	// needed
+	Dir string
+	// Filter selects the recorded flows, every flow when nil. It is matched
+	// when the request arrives, see CaptureFilter.
+	Filter Matcher
+	// MaxEntries starts a new file once the current one holds that many
+	// entries, 0 means no limit
+	MaxEntries int
+	// MaxAge starts a new file once the current one is older, 0 means no
+	// limit
+	MaxAge time.Duration
+	// MaxBodySize is the number of bytes kept of each body, before and
+	// after decompression, DefaultCaptureSize when 0 and no limit when
+	// negative
+	MaxBodySize int64
+}
+
+// HARRecorder writes flows to HAR 1.2 files, WebSocket messages are stored
+// in the _webSocketMessages extension read by Chrome DevTools. Bodies
+// changed by handlers keep the received version in _originalText. Files
+// stay valid JSON while they are written.
+type HARRecorder struct {
+	p      *ProxyServer
+	cfg    HARConfig
+	remove func()
+	mu     sync.Mutex
+	file   *os.File
+	opened time.Time
+	count  int
+	seq    int
+}
+
+// harTail closes the entries array and the log object of a HAR file
+const harTail = "\n]}}\n"
+
+// RecordHAR starts recording the flows of p into HAR files in cfg.Dir
+// until the recorder is closed
+func (p *ProxyServer) RecordHAR(cfg HARConfig) (*HARRecorder, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &HARRecorder{p: p, cfg: cfg}
+	r.remove = p.AddFlowObserver(r)
+	p.logger.Info("Recording flows to HAR files in %s", cfg.Dir)
+	return r, nil
+}
+
+// CaptureFlow selects the flows recorded with the filter of the config
+func (r *HARRecorder) CaptureFlow(ctx *ProxyCtx) (int64, bool) {
+	if r.cfg.Filter != nil && !r.cfg.Filter.Match(ctx) {
+		return 0, false
+	}
+	return captureLimit(r.cfg.MaxBodySize), true
+}
+
+// ObserveFlow appends f to the current file
+func (r *HARRecorder) ObserveFlow(f *Flow) {
+	entry, err := json.Marshal(harEntryOf(f, captureLimit(r.cfg.MaxBodySize)))
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.write(entry); err != nil {
+		// 写入失败时换新文件重试一次
+		r.closeFile()
+		if err := r.write(entry); err != nil {
+			r.p.logger.Error("Failed to write HAR entry for %s: %v", f.Request.URL, err)
+		}
+	}
+}
+
+// Rotate closes the current file, the next flow starts a new one
+func (r *HARRecorder) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeFile()
+}
+
+// Close stops recording and closes the current file
+func (r *HARRecorder) Close() error {
+	r.remove()
+	return r.Rotate()
+}
+
+// write appends entry to the current file, starting a new one when needed
+func (r *HARRecorder) write(entry []byte) error {
+	if r.file != nil && ((r.cfg.MaxEntries > 0 && r.count >= r.cfg.MaxEntries) ||
+		(r.cfg.MaxAge > 0 && time.Since(r.opened) >= r.cfg.MaxAge)) {
+		r.closeFile()
+	}
+	sep := ",\n"
+	if r.file == nil {
+		if err := r.openFile(); err != nil {
+			return err
+		}
+		sep = "\n"
+	}
+	// 覆盖文件末尾的结束符，写入新条目后再补上
+	if _, err := r.file.Seek(-int64(len(harTail)), io.SeekEnd); err != nil {
+		return err
+	}
+	data := append([]byte(sep), entry...)
+	if _, err := r.file.Write(append(data, harTail...)); err != nil {
+		return err
+	}
+	r.count++
+	return nil
+}
+
+func (r *HARRecorder) openFile() error {
+	now := time.Now()
+	r.seq++
+	name := filepath.Join(r.cfg.Dir, fmt.Sprintf("gamemitm-%s-%03d.har", now.Format("20060102-150405"), r.seq))
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	head := `{"log":{"version":"1.2","creator":{"name":"game-mitm","version":"1.0"},"pages":[],"entries":[`
+	if _, err := file.WriteString(head + harTail); err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.opened, r.count = file, now, 0
+	return nil
+}
+
+func (r *HARRecorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+type harEntry struct {
+	StartedDateTime string              `json:"startedDateTime"`
+	Time            float64             `json:"time"`
+	Request         harRequest          `json:"request"`
+	Response        harResponse         `json:"response"`
+	Cache           struct{}            `json:"cache"`
+	Timings         harTimings          `json:"timings"`
+	Comment         string              `json:"comment,omitempty"`
+	ResourceType    string              `json:"_resourceType,omitempty"`
+	Messages        []harWebSocketFrame `json:"_webSocketMessages,omitempty"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harNV      `json:"cookies"`
+	Headers     []harNV      `json:"headers"`
+	QueryString []harNV      `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harNV    `json:"cookies"`
+	Headers     []harNV    `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int        `json:"bodySize"`
+}
+
+// harContent marks text that is still compressed, because it was
+// truncated or decodes to more than the body limit, with _contentEncoding
+type harContent struct {
+	Size             int     `json:"size"`
+	MimeType         string  `json:"mimeType"`
+	Text             string  `json:"text"`
+	Encoding         string  `json:"encoding,omitempty"`
+	ContentEncoding  string  `json:"_contentEncoding,omitempty"`
+	OriginalText     *string `json:"_originalText,omitempty"`
+	OriginalEncoding string  `json:"_originalEncoding,omitempty"`
+	Truncated        bool    `json:"_truncated,omitempty"`
+}
+
+// harPostData has no encoding field in HAR 1.2, binary bodies are marked
+// with _encoding
+type harPostData struct {
+	MimeType         string  `json:"mimeType"`
+	Params           []harNV `json:"params"`
+	Text             string  `json:"text"`
+	Encoding         string  `json:"_encoding,omitempty"`
+	OriginalText     *string `json:"_originalText,omitempty"`
+	OriginalEncoding string  `json:"_originalEncoding,omitempty"`
+	Truncated        bool    `json:"_truncated,omitempty"`
+}
+
+type harNV struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harWebSocketFrame stores binary frames as base64 like Chrome, text
+// frames that are not valid UTF-8 are base64 too and marked with _encoding
+type harWebSocketFrame struct {
+	Type             string  `json:"type"`
+	Time             float64 `json:"time"`
+	Opcode           int     `json:"opcode"`
+	Data             string  `json:"data"`
+	Encoding         string  `json:"_encoding,omitempty"`
+	OriginalData     *string `json:"_originalData,omitempty"`
+	OriginalEncoding string  `json:"_originalEncoding,omitempty"`
+}
+
+// harEntryOf converts f, decompressed bodies are kept up to limit bytes
+func harEntryOf(f *Flow, limit int64) *harEntry {
+	e := &harEntry{
+		StartedDateTime: f.Start.Format(time.RFC3339Nano),
+		Time:            millis(f.Timings.Send + f.Timings.Wait + f.Timings.Receive),
+		Timings: harTimings{
+			Blocked: -1, DNS: -1, Connect: -1, SSL: -1,
+			Send:    millis(f.Timings.Send),
+			Wait:    millis(f.Timings.Wait),
+			Receive: millis(f.Timings.Receive),
+		},
+		Comment: f.Error,
+	}
+
+	req := f.Request
+	e.Request = harRequest{
+		Method:      req.Method,
+		URL:         req.URL,
+		HTTPVersion: req.Proto,
+		Cookies:     harCookies((&http.Request{Header: req.Header}).Cookies()),
+		Headers:     harHeaders(req.Header),
+		QueryString: []harNV{},
+		HeadersSize: -1,
+		BodySize:    len(req.Body),
+	}
+	if u, err := url.Parse(req.URL); err == nil && u.RawQuery != "" {
+		// 按原始顺序保存查询参数
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			name, value, _ := strings.Cut(pair, "=")
+			name, _ = url.QueryUnescape(name)
+			value, _ = url.QueryUnescape(value)
+			e.Request.QueryString = append(e.Request.QueryString, harNV{Name: name, Value: value})
+		}
+	}
+	if len(req.Body) > 0 || len(req.OriginalBody) > 0 {
+		c := harContentOf(req.Header, req.OriginalHeader, req.Body, req.OriginalBody, req.Truncated, limit)
+		e.Request.PostData = &harPostData{
+			MimeType:         c.MimeType,
+			Params:           []harNV{},
+			Text:             c.Text,
+			Encoding:         c.Encoding,
+			OriginalText:     c.OriginalText,
+			OriginalEncoding: c.OriginalEncoding,
+			Truncated:        c.Truncated,
+		}
+	}
+
+	e.Response = harResponse{Cookies: []harNV{}, Headers: []harNV{}, HeadersSize: -1, BodySize: -1}
+	if resp := f.Response; resp != nil {
+		e.Response = harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" "),
+			HTTPVersion: resp.Proto,
+			Cookies:     harCookies((&http.Response{Header: resp.Header}).Cookies()),
+			Headers:     harHeaders(resp.Header),
+			Content:     harContentOf(resp.Header, resp.OriginalHeader, resp.Body, resp.OriginalBody, resp.Truncated, limit),
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(resp.Body),
+		}
+	}
+
+	if f.Messages != nil {
+		e.ResourceType = "websocket"
+		e.Messages = []harWebSocketFrame{}
+	}
+	for _, m := range f.Messages {
+		frame := harWebSocketFrame{
+			Type:   "send",
+			Time:   float64(m.Time.UnixNano()) / float64(time.Second),
+			Opcode: m.Type,
+		}
+		if m.Direction == ServerToClient {
+			frame.Type = "receive"
+		}
+		// 与 Chrome 一致，二进制帧以 base64 保存
+		frame.Data, frame.Encoding = harFrameData(m.Data, m.Type)
+		if m.OriginalData != nil {
+			var data string
+			data, frame.OriginalEncoding = harFrameData(m.OriginalData, m.Type)
+			frame.OriginalData = &data
+		}
+		e.Messages = append(e.Messages, frame)
+	}
+	return e
+}
+
+// harContentOf decodes body and original according to their headers,
+// binary content is stored as base64
+func harContentOf(header, originalHeader http.Header, body, original []byte, truncated bool, limit int64) harContent {
+	text, encoding, contentEnc, size := harText(header, body, truncated, limit)
+	c := harContent{
+		Size:            size,
+		MimeType:        header.Get("Content-Type"),
+		Text:            text,
+		Encoding:        encoding,
+		ContentEncoding: contentEnc,
+		Truncated:       truncated,
+	}
+	if original != nil {
+		if originalHeader == nil {
+			originalHeader = header
+		}
+		text, encoding, _, _ := harText(originalHeader, original, truncated, limit)
+		c.OriginalText, c.OriginalEncoding = &text, encoding
+	}
+	return c
+}
+
+// harText returns body as text or base64, decompressed unless it is
+// returned in contentEnc
+func harText(header http.Header, body []byte, truncated bool, limit int64) (text, encoding, contentEnc string, size int) {
+	// 截断或解压后超过限制的内容原样保存
+	if contentEnc = contentEncoding(header); contentEnc != "" && len(body) > 0 && !truncated {
+		if plain, err := decodeBytes(contentEnc, body, limit); err == nil {
+			body, contentEnc = plain, ""
+		}
+	}
+	if len(body) == 0 {
+		contentEnc = ""
+	}
+	if utf8.Valid(body) {
+		return string(body), "", contentEnc, len(body)
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64", contentEnc, len(body)
+}
+
+// harFrameData returns the data of a WebSocket frame and its encoding,
+// "base64" for text frames that are not valid UTF-8
+func harFrameData(data []byte, msgType int) (string, string) {
+	switch {
+	case msgType == websocket.BinaryMessage:
+		return base64.StdEncoding.EncodeToString(data), ""
+	case !utf8.Valid(data):
+		return base64.StdEncoding.EncodeToString(data), "base64"
+	}
+	return string(data), ""
+}
+
+func harHeaders(header http.Header) []harNV {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nv := []harNV{}
+	for _, name := range names {
+		for _, v := range header[name] {
+			nv = append(nv, harNV{Name: name, Value: v})
+		}
+	}
+	return nv
+}
+
+func harCookies(cookies []*http.Cookie) []harNV {
+	nv := []harNV{}
+	for _, c := range cookies {
+		nv = append(nv, harNV{Name: c.Name, Value: c.Value})
+	}
+	return nv
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,214 @@
+package gamemitm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// harEntries reads the entries of every HAR file in dir
+func harEntries(t *testing.T, dir string) []harEntry {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.har"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []harEntry
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var har struct {
+			Log struct {
+				Entries []harEntry `json:"entries"`
+			} `json:"log"`
+		}
+		if err := json.Unmarshal(data, &har); err != nil {
+			t.Fatalf("%s is not valid JSON: %v", name, err)
+		}
+		entries = append(entries, har.Log.Entries...)
+	}
+	return entries
+}
+
+// waitHAREntries waits until dir holds n entries
+func waitHAREntries(t *testing.T, dir string, n int) []harEntry {
+	t.Helper()
+	var entries []harEntry
+	waitFor(t, func() bool {
+		entries = harEntries(t, dir)
+		return len(entries) >= n
+	})
+	return entries
+}
+
+func TestRecordHAR(t *testing.T) {
+	p, client := newTestProxy(t)
+	dir := t.TempDir()
+	rec, err := p.RecordHAR(HARConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return bytes.ToUpper(body)
+	})
+	upstream := echoServer(t)
+
+	doText(t, client, "POST", upstream.URL+"/login?user=a%20b", "hello")
+	e := waitHAREntries(t, dir, 1)[0]
+	if e.Request.Method != "POST" || !strings.HasSuffix(e.Request.URL, "/login?user=a%20b") {
+		t.Fatalf("request = %s %s", e.Request.Method, e.Request.URL)
+	}
+	if len(e.Request.QueryString) != 1 || e.Request.QueryString[0] != (harNV{Name: "user", Value: "a b"}) {
+		t.Fatalf("queryString = %+v", e.Request.QueryString)
+	}
+	post := e.Request.PostData
+	if post == nil || post.Text != "HELLO" || post.OriginalText == nil || *post.OriginalText != "hello" {
+		t.Fatalf("postData = %+v", post)
+	}
+	if e.Response.Status != http.StatusOK || e.Response.Content.Text != "HELLO" {
+		t.Fatalf("response = %d %q", e.Response.Status, e.Response.Content.Text)
+	}
+}
+
+func TestHARFilterAppliesBeforeCapture(t *testing.T) {
+	p, client := newTestProxy(t)
+	dir := t.TempDir()
+	rec, err := p.RecordHAR(HARConfig{Dir: dir, Filter: PathPrefix("/api/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	upstream := echoServer(t)
+
+	// 未选中的请求不记录流量，也不缓存消息体
+	req := httptest.NewRequest("GET", upstream.URL+"/static/a.png", nil)
+	if f := p.startFlow(&ProxyCtx{Req: req, Proxy: p}); f != nil {
+		t.Fatal("flow recorded for a request the filter rejects")
+	}
+	doText(t, client, "GET", upstream.URL+"/static/a.png", "")
+	doText(t, client, "GET", upstream.URL+"/api/login", "")
+	entries := waitHAREntries(t, dir, 1)
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Request.URL, "/api/login") {
+		t.Fatalf("entries = %d, first %q", len(entries), entries[0].Request.URL)
+	}
+}
+
+func TestHARMaxBodySize(t *testing.T) {
+	p, client := newTestProxy(t)
+	dir := t.TempDir()
+	rec, err := p.RecordHAR(HARConfig{Dir: dir, MaxBodySize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	upstream := echoServer(t)
+
+	doText(t, client, "POST", upstream.URL, strings.Repeat("x", 100))
+	e := waitHAREntries(t, dir, 1)[0]
+	if c := e.Response.Content; c.Text != strings.Repeat("x", 10) || !c.Truncated {
+		t.Fatalf("content = %q, truncated %v", c.Text, c.Truncated)
+	}
+}
+
+func TestHARDecodeLimit(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(bytes.Repeat([]byte("a"), 1000))
+	zw.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name     string
+		limit    int64
+		encoding string
+	}{
+		{"decoded", 0, ""},
+		// 压缩后的内容在限制内，解压后超出，保存原始数据
+		{"over limit", 100, "base64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, client := newTestProxy(t)
+			dir := t.TempDir()
+			rec, err := p.RecordHAR(HARConfig{Dir: dir, MaxBodySize: tt.limit})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rec.Close()
+			doText(t, client, "GET", upstream.URL, "")
+			c := waitHAREntries(t, dir, 1)[0].Response.Content
+			if c.Encoding != tt.encoding {
+				t.Fatalf("encoding = %q, want %q", c.Encoding, tt.encoding)
+			}
+			if tt.encoding == "" && c.Text != strings.Repeat("a", 1000) {
+				t.Fatalf("text = %q", c.Text)
+			}
+		})
+	}
+}
+
+func TestHARRotation(t *testing.T) {
+	p, client := newTestProxy(t)
+	dir := t.TempDir()
+	rec, err := p.RecordHAR(HARConfig{Dir: dir, MaxEntries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	upstream := echoServer(t)
+
+	doText(t, client, "GET", upstream.URL+"/1", "")
+	waitHAREntries(t, dir, 1)
+	doText(t, client, "GET", upstream.URL+"/2", "")
+	waitHAREntries(t, dir, 2)
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.har")); len(files) != 2 {
+		t.Fatalf("%d files, want one per entry", len(files))
+	}
+}
+
+// limitObserver wants every flow with a fixed capture limit
+type limitObserver int64
+
+func (o limitObserver) ObserveFlow(*Flow) {}
+
+func (o limitObserver) CaptureFlow(*ProxyCtx) (int64, bool) {
+	return int64(o), true
+}
+
+func TestCaptureLimitOfObservers(t *testing.T) {
+	tests := []struct {
+		name      string
+		observers []FlowObserver
+		want      int64
+	}{
+		{"largest", []FlowObserver{limitObserver(5), limitObserver(10)}, 10},
+		{"unlimited wins", []FlowObserver{limitObserver(5), limitObserver(0), limitObserver(10)}, 0},
+		{"default", []FlowObserver{limitObserver(5), FlowObserverFunc(func(*Flow) {})}, DefaultCaptureSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProxy()
+			for _, o := range tt.observers {
+				p.AddFlowObserver(o)
+			}
+			req := &http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "game.test", Path: "/"}, Header: http.Header{}}
+			if f := p.startFlow(&ProxyCtx{Req: req, Proxy: p}); f == nil || f.limit != tt.want {
+				t.Fatalf("limit = %v, want %d", f, tt.want)
+			}
+		})
+	}
+}
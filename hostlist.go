@@ -0,0 +1,78 @@
+package gamemitm
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// hostList matches "host:port" addresses against host globs such as
+// "*.example.com", IP addresses or CIDRs such as "10.0.0.0/8", and ports
+// written as ":443"
+type hostList struct {
+	globs []string
+	nets  []*net.IPNet
+	ports []string
+}
+
+func parseHostList(patterns []string) (*hostList, error) {
+	l := &hostList{}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+		case strings.HasPrefix(pattern, ":"):
+			l.ports = append(l.ports, pattern[1:])
+		case strings.Contains(pattern, "/"):
+			_, ipNet, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %v", pattern, err)
+			}
+			l.nets = append(l.nets, ipNet)
+		default:
+			if ip := net.ParseIP(strings.Trim(pattern, "[]")); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				l.nets = append(l.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid host pattern %q: %v", pattern, err)
+			}
+			l.globs = append(l.globs, pattern)
+		}
+	}
+	return l, nil
+}
+
+func (l *hostList) match(addr string) bool {
+	if l == nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	for _, p := range l.ports {
+		if p == port {
+			return true
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range l.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, g := range l.globs {
+		if ok, _ := path.Match(g, host); ok {
+			return true
+		}
+	}
+	return false
+}
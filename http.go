@@ -1,84 +1,87 @@
 package gamemitm
 
 import (
-	"bytes"
+	"github.com/gorilla/websocket"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 // handleHTTP handles HTTP requests
 func (p *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	// 创建目标URL
-	targetURL := *r.URL
-	targetURL.Scheme = "http"
-	targetURL.Host = r.Host
-	if r.URL.Host != "" {
-		targetURL.Host = r.URL.Host
+	// 补全目标URL
+	r.URL.Scheme = "http"
+	if r.URL.Host == "" {
+		r.URL.Host = r.Host
 	}
+	if websocket.IsWebSocketUpgrade(r) {
+		if p.isVerbose() {
+			p.logger.Debug("Handling WebSocket (WS) connection for %s", r.URL.Host)
+		}
+		p.handleWebSocket(w, r, false)
+		return
+	}
+	p.forward(w, r, p.transport)
+}
 
+// forward sends r to the server in r.URL through transport and writes the
+// response to w, running the request and response handlers on the way.
+// Handlers may change method, URL, target host and headers of r.
+func (p *ProxyServer) forward(w http.ResponseWriter, r *http.Request, transport http.RoundTripper) {
+	targetURL := r.URL.String()
 	ctx := &ProxyCtx{
-		Req: r,
+		Req:       r,
+		Proxy:     p,
+		ClientTLS: r.TLS,
 	}
+	defer p.startFlow(ctx).finish()
 
-	// 读取请求体
-	reqBody, err := io.ReadAll(r.Body)
+	// 处理请求体，没有匹配的处理函数时直接以流方式转发
+	reqBody, reqLength, err := p.processBody(Request, ctx.flow.original(Request, r.Body), r.ContentLength, ctx)
 	if err != nil {
-		p.logger.Error("Failed to read request body for %s: %v", r.URL, err)
+		p.logger.Error("Failed to read request body for %s: %v", targetURL, err)
+		ctx.flow.fail(err)
 		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 		return
 	}
-	defer r.Body.Close()
-	modifiedReqBody := reqBody
-	for url, handle := range p.reqHandles {
-		if url == All || strings.Contains(r.Host, url) {
-			if handle != nil {
-				modifiedReqBody = handle(reqBody, ctx)
-			}
-		}
-	}
-
-	// 创建新的请求发送到目标服务器
-	req, err := http.NewRequest(r.Method, targetURL.String(), bytes.NewReader(modifiedReqBody))
-	if err != nil {
-		p.logger.Error("Failed to create request for %s: %v", targetURL.String(), err)
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
-		return
-	}
 
-	// 复制原始请求头部
-	for key, values := range r.Header {
-		for _, value := range values {
-			req.Header.Add(key, value)
+	if ctx.dropped {
+		reqBody.Close()
+		if p.isVerbose() {
+			p.logger.Debug("Dropping request %s", targetURL)
 		}
+		ctx.flow.fail(errDropped)
+		panic(http.ErrAbortHandler)
 	}
 
 	// 发送请求到目标服务器
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := p.roundTrip(ctx, ctx.flow.processed(Request, reqBody), reqLength, transport)
 	if err != nil {
-		p.logger.Error("Failed to send request to target server %s: %v", targetURL.String(), err)
-		http.Error(w, "Failed to send request to target server", http.StatusBadGateway)
+		p.logger.Error("Failed to send request to target server %s: %v", r.URL, err)
+		ctx.flow.fail(err)
+		http.Error(w, upstreamErrorText(err), http.StatusBadGateway)
 		return
 	}
+	p.respond(w, ctx, resp)
+}
+
+// respond runs the response handlers on resp and writes it to w
+func (p *ProxyServer) respond(w http.ResponseWriter, ctx *ProxyCtx, resp *http.Response) {
 	defer resp.Body.Close()
+	targetURL := ctx.Req.URL.String()
 
-	// 读取响应体
-	respBody, err := io.ReadAll(resp.Body)
+	// 处理响应体
+	ctx.Resp = resp
+	respBody, respLength, err := p.processBody(Response, ctx.flow.original(Response, resp.Body), resp.ContentLength, ctx)
 	if err != nil {
-		p.logger.Error("Failed to read response body for %s: %v", targetURL.String(), err)
+		p.logger.Error("Failed to read response body for %s: %v", targetURL, err)
+		ctx.flow.fail(err)
 		http.Error(w, "Failed to read response body", http.StatusInternalServerError)
 		return
 	}
-	ctx.Resp = resp
-	modifiedRespBody := respBody
-	for url, handle := range p.respHandles {
-		if url == All || strings.Contains(r.Host, url) {
-			if handle != nil {
-				modifiedRespBody = handle(respBody, ctx)
-			}
-		}
-	}
+	respBody = ctx.flow.processed(Response, respBody)
+	defer respBody.Close()
 
 	// 复制响应头部到客户端
 	for key, values := range resp.Header {
@@ -86,13 +89,121 @@ func (p *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add(key, value)
 		}
 	}
+	removeHopHeaders(w.Header())
+	w.Header().Del("Content-Length")
+	if respLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(respLength, 10))
+	}
 
 	// 设置响应状态码
 	w.WriteHeader(resp.StatusCode)
 
 	// 写入修改后的响应体
-	_, err = w.Write(modifiedRespBody)
+	_, err = io.Copy(newFlushWriter(w), respBody)
+	if err != nil {
+		p.logger.Error("Failed to write modified response body for %s: %v", targetURL, err)
+		ctx.flow.fail(err)
+		return
+	}
+
+	// 转发响应尾部，gRPC 的状态码通过尾部返回
+	for key, values := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+key] = values
+	}
+}
+
+// roundTrip sends the request of ctx with the processed body through
+// transport, or returns the response set with ProxyCtx.Respond
+func (p *ProxyServer) roundTrip(ctx *ProxyCtx, body io.ReadCloser, length int64, transport http.RoundTripper) (*http.Response, error) {
+	r := ctx.Req
+	if ctx.response != nil {
+		body.Close()
+		if p.isVerbose() {
+			p.logger.Debug("Answering %s without contacting the target server", r.URL)
+		}
+		return ctx.response, nil
+	}
+	if replay := p.replayer.Load(); replay != nil {
+		var resp *http.Response
+		if resp, body = replay.respond(r, body); resp != nil {
+			return resp, nil
+		}
+	}
+
+	// 创建新的请求发送到目标服务器
+	req, err := http.NewRequest(r.Method, r.URL.String(), body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	req.ContentLength = length
+	req.Host = r.Host
+	// 请求尾部在请求体读取完毕后才会填充，共享同一个map即可转发
+	req.Trailer = r.Trailer
+
+	// 复制原始请求头部
+	for key, values := range r.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	removeHopHeaders(req.Header)
+	resp, err := transport.RoundTrip(req)
 	if err != nil {
-		p.logger.Error("Failed to write modified response body for %s: %v", r.URL, err)
+		return nil, err
+	}
+	ctx.UpstreamTLS = resp.TLS
+	return resp, nil
+}
+
+// flushWriter flushes every write so streamed bodies reach the client
+// without waiting for the response buffer to fill
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) io.Writer {
+	if f, ok := w.(http.Flusher); ok {
+		return &flushWriter{w: w, f: f}
+	}
+	return w
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
+}
+
+// hopHeaders are meaningful only for a single transport-level connection
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hop-by-hop headers, including the ones listed
+// in the Connection header. "Te: trailers" is kept as gRPC requires it.
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	te := header.Get("Te")
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	if strings.EqualFold(te, "trailers") {
+		header.Set("Te", te)
 	}
 }
@@ -2,139 +2,229 @@ package gamemitm
 
 import (
 	"bufio"
-	"bytes"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
 	"io"
 	"net"
 	"net/http"
 	"strings"
 )
 
-// proxyHTTPS handles HTTPS request/response cycle
-func (p *ProxyServer) proxyHTTPS(clientConn *tls.Conn, destConn *tls.Conn, host string) {
-	// Read client request
-	httpReader := bufio.NewReader(clientConn)
-	req, err := http.ReadRequest(httpReader)
-	if err != nil {
-		p.logger.Error("Failed to read client request from %s: %v", host, err)
-		return
-	}
-	ctx := &ProxyCtx{
-		Req: req,
+// proxyHTTP1 serves every HTTP/1.x request sent by the client over the
+// intercepted connection until either side asks to close it. scheme is
+// the scheme used upstream, "https" or "http", hostHeader replaces the
+// Host of every request when not empty.
+func (p *ProxyServer) proxyHTTP1(clientConn net.Conn, scheme, host, hostHeader string, transport http.RoundTripper) {
+	reader := bufio.NewReader(clientConn)
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := unwrapConn(clientConn).(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		tlsState = &state
 	}
+	for {
+		// Read client request
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				p.logger.Error("Failed to read client request from %s: %v", host, err)
+			}
+			return
+		}
+		// 补全请求URL，方便匹配器和处理函数使用完整地址
+		req.URL.Scheme = scheme
+		req.URL.Host = host
+		if hostHeader != "" {
+			req.Host = hostHeader
+		}
+		req.TLS = tlsState
+		req.RemoteAddr = clientConn.RemoteAddr().String()
 
-	// 检测是否为WebSocket升级请求
-	if websocket.IsWebSocketUpgrade(req) {
-		if p.Verbose {
-			p.logger.Debug("Handling WebSocket (WSS) connection for %s", host)
+		// 检测是否为WebSocket升级请求
+		if websocket.IsWebSocketUpgrade(req) {
+			if p.isVerbose() {
+				p.logger.Debug("Handling WebSocket (%s) connection for %s", strings.ToUpper(scheme), host)
+			}
+
+			rwAdapter := newConnResponseWriter(clientConn, reader)
+			p.handleWebSocket(rwAdapter, req, scheme == "https")
+			return
 		}
 
-		rwAdapter := newTLSResponseWriter(clientConn)
-		p.handleWebSocket(rwAdapter, req, true)
-		return
+		keepAlive := p.proxyHTTP1Request(clientConn, req, host, transport)
+		// 确保请求体被完整读取，以便读取下一个请求
+		req.Body.Close()
+		if !keepAlive {
+			return
+		}
 	}
+}
 
-	// Read request body
-	reqBody, err := io.ReadAll(req.Body)
-	if err != nil {
-		p.logger.Error("Failed to read request body for %s: %v", host, err)
-		return
-	}
-	req.Body.Close()
-	modifiedReqBody := reqBody
-	for url, handle := range p.reqHandles {
-		if url == All || strings.Contains(req.Host, url) {
-			if handle != nil {
-				modifiedReqBody = handle(reqBody, ctx)
+// proxyH2 serves the HTTP/2 streams of the intercepted connection, every
+// stream goes through the same handlers as an HTTP/1.1 request. scheme is
+// the scheme used upstream, hostHeader as for proxyHTTP1.
+func (p *ProxyServer) proxyH2(clientConn net.Conn, scheme, host, hostHeader string, transport http.RoundTripper) {
+	server := &http2.Server{}
+	server.ServeConn(clientConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// 补全请求URL，方便匹配器和处理函数使用完整地址
+			r.URL.Scheme = scheme
+			r.URL.Host = host
+			if hostHeader != "" {
+				r.Host = hostHeader
 			}
-		}
+			p.forward(w, r, transport)
+		}),
+	})
+}
+
+// proxyHTTP1Request handles a single request/response cycle and reports
+// whether the client connection can be reused
+func (p *ProxyServer) proxyHTTP1Request(clientConn net.Conn, req *http.Request, host string, transport http.RoundTripper) bool {
+	ctx := &ProxyCtx{
+		Req:       req,
+		Proxy:     p,
+		ClientTLS: req.TLS,
 	}
+	defer p.startFlow(ctx).finish()
 
-	// Create new request to target server
-	outReq, err := http.NewRequest(req.Method, "https://"+host+req.URL.String(), bytes.NewReader(modifiedReqBody))
+	// Process request body
+	reqBody, reqLength, err := p.processBody(Request, ctx.flow.original(Request, req.Body), req.ContentLength, ctx)
 	if err != nil {
-		p.logger.Error("Failed to create request for %s: %v", host, err)
-		return
+		p.logger.Error("Failed to read request body for %s: %v", host, err)
+		ctx.flow.fail(err)
+		return false
 	}
 
-	// Copy request headers
-	for key, values := range req.Header {
-		for _, value := range values {
-			outReq.Header.Add(key, value)
+	if ctx.dropped {
+		reqBody.Close()
+		if p.isVerbose() {
+			p.logger.Debug("Dropping request %s", req.URL)
 		}
+		ctx.flow.fail(errDropped)
+		return false
 	}
 
-	// Send request to target server
-	outReq.Write(destConn)
-
-	// Read response from target server
-	respReader := bufio.NewReader(destConn)
-	resp, err := http.ReadResponse(respReader, outReq)
+	// Send request to target server, the connection is reused when possible
+	resp, err := p.roundTrip(ctx, ctx.flow.processed(Request, reqBody), reqLength, transport)
 	if err != nil {
-		p.logger.Error("Failed to read server response for %s: %v", host, err)
-		return
+		p.logger.Error("Failed to send request to target server %s: %v", host, err)
+		ctx.flow.fail(err)
+		writeErrorResponse(clientConn, req, http.StatusBadGateway, upstreamErrorText(err))
+		return !req.Close
 	}
+	defer resp.Body.Close()
 
-	// Read response body
-	respBody, err := io.ReadAll(resp.Body)
+	// Process response body
+	ctx.Resp = resp
+	respBody, respLength, err := p.processBody(Response, ctx.flow.original(Response, resp.Body), resp.ContentLength, ctx)
 	if err != nil {
 		p.logger.Error("Failed to read response body for %s: %v", host, err)
-		return
-	}
-	resp.Body.Close()
-	ctx.Resp = resp
-	modifiedRespBody := respBody
-	for url, handle := range p.respHandles {
-		if url == All || strings.Contains(req.Host, url) {
-			if handle != nil {
-				modifiedRespBody = handle(respBody, ctx)
-			}
-		}
+		ctx.flow.fail(err)
+		return false
 	}
+	respBody = ctx.flow.processed(Response, respBody)
+	defer respBody.Close()
 
 	// Create new response to send to client
 	outResp := &http.Response{
 		Status:        resp.Status,
 		StatusCode:    resp.StatusCode,
-		Proto:         resp.Proto,
-		ProtoMajor:    resp.ProtoMajor,
-		ProtoMinor:    resp.ProtoMinor,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
 		Header:        resp.Header,
-		Body:          io.NopCloser(bytes.NewReader(modifiedRespBody)),
-		ContentLength: int64(len(modifiedRespBody)),
+		Body:          respBody,
+		ContentLength: respLength,
+		Request:       req,
+		Close:         req.Close || resp.Close,
+	}
+	removeHopHeaders(outResp.Header)
+	if respLength < 0 {
+		if req.ProtoAtLeast(1, 1) {
+			outResp.TransferEncoding = []string{"chunked"}
+		} else {
+			outResp.Close = true
+		}
 	}
 
 	// Send response to client
-	outResp.Write(clientConn)
+	w := bufio.NewWriter(clientConn)
+	if err := outResp.Write(w); err != nil {
+		p.logger.Error("Failed to write response for %s: %v", host, err)
+		ctx.flow.fail(err)
+		return false
+	}
+	if err := w.Flush(); err != nil {
+		return false
+	}
+	return !outResp.Close
+}
+
+// writeErrorResponse writes a plain text error response to the client
+func writeErrorResponse(w io.Writer, req *http.Request, code int, msg string) {
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(msg + "\n")),
+		ContentLength: int64(len(msg) + 1),
+		Request:       req,
+		Close:         req.Close,
+	}
+	resp.Write(w)
 }
 
-type tlsResponseWriter struct {
-	conn       *tls.Conn
-	header     http.Header
-	statusCode int
+// connResponseWriter adapts a raw client connection to http.ResponseWriter
+// for the WebSocket upgrade
+type connResponseWriter struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	header      http.Header
+	statusCode  int
+	wroteHeader bool
 }
 
-func newTLSResponseWriter(conn *tls.Conn) *tlsResponseWriter {
-	return &tlsResponseWriter{
+func newConnResponseWriter(conn net.Conn, reader *bufio.Reader) *connResponseWriter {
+	return &connResponseWriter{
 		conn:       conn,
+		reader:     reader,
 		header:     make(http.Header),
 		statusCode: http.StatusOK,
 	}
 }
 
-func (tw *tlsResponseWriter) Header() http.Header {
+func (tw *connResponseWriter) Header() http.Header {
 	return tw.header
 }
 
-func (tw *tlsResponseWriter) Write(data []byte) (int, error) {
+func (tw *connResponseWriter) Write(data []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
 	return tw.conn.Write(data)
 }
 
-func (tw *tlsResponseWriter) WriteHeader(statusCode int) {
+// WriteHeader writes the status line and headers, the connection is closed
+// after the response so the body needs no framing
+func (tw *connResponseWriter) WriteHeader(statusCode int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
 	tw.statusCode = statusCode
+	tw.header.Del("Content-Length")
+	tw.header.Set("Connection", "close")
+	w := bufio.NewWriter(tw.conn)
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	tw.header.Write(w)
+	w.WriteString("\r\n")
+	w.Flush()
 }
 
-func (tw *tlsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return tw.conn, bufio.NewReadWriter(bufio.NewReader(tw.conn), bufio.NewWriter(tw.conn)), nil
+func (tw *connResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return tw.conn, bufio.NewReadWriter(tw.reader, bufio.NewWriter(tw.conn)), nil
 }
@@ -0,0 +1,106 @@
+package gamemitm
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// proxyAddr returns the address of the proxy used by client
+func proxyAddr(t *testing.T, client *http.Client) string {
+	t.Helper()
+	u, err := client.Transport.(*http.Transport).Proxy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+// connectTunnel opens a CONNECT tunnel to target through the proxy of
+// client
+func connectTunnel(t *testing.T, client *http.Client, target string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr(t, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	// 逐字节读取响应头，避免吞掉隧道中的数据
+	var head []byte
+	buf := make([]byte, 1)
+	for !strings.HasSuffix(string(head), "\r\n\r\n") {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("reading CONNECT response: %v", err)
+		}
+		head = append(head, buf[0])
+	}
+	if !strings.HasPrefix(string(head), "HTTP/1.1 200") {
+		t.Fatalf("CONNECT answered %q", head)
+	}
+	return conn
+}
+
+func TestHTTPSKeepAlive(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	var dials atomic.Int32
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return append(body, '+')
+	})
+
+	for i := 0; i < 3; i++ {
+		resp, body := doText(t, client, "POST", upstream.URL+"/n", fmt.Sprint(i))
+		if want := fmt.Sprint(i, "+"); body != want {
+			t.Fatalf("request %d: body = %q, want %q", i, body, want)
+		}
+		if resp.TLS == nil {
+			t.Fatal("response did not come over TLS")
+		}
+	}
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("client opened %d tunnels, want 1", n)
+	}
+}
+
+func TestHTTPSPipelinedRequests(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	host := upstream.Listener.Addr().String()
+
+	conn := tls.Client(connectTunnel(t, client, host), &tls.Config{
+		RootCAs:    caPool(p),
+		ServerName: "127.0.0.1",
+		NextProtos: []string{"http/1.1"},
+	})
+	// 不等待响应，连续发送两个请求
+	io.WriteString(conn, "POST /a HTTP/1.1\r\nHost: "+host+"\r\nContent-Length: 3\r\n\r\none"+
+		"POST /b HTTP/1.1\r\nHost: "+host+"\r\nContent-Length: 3\r\n\r\ntwo")
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"/a one", "/b two"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("X-Path") + " " + string(body); got != want {
+			t.Fatalf("response = %q, want %q", got, want)
+		}
+	}
+}
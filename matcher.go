@@ -0,0 +1,240 @@
+package gamemitm
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matcher decides whether a handler applies to the current exchange
+type Matcher interface {
+	Match(ctx *ProxyCtx) bool
+}
+
+// MatcherFunc adapts an ordinary function to a Matcher
+type MatcherFunc func(ctx *ProxyCtx) bool
+
+func (f MatcherFunc) Match(ctx *ProxyCtx) bool {
+	return f(ctx)
+}
+
+// urlMatcher keeps the behaviour of the plain string keys: All matches
+// everything, anything else is a substring of the request host.
+func urlMatcher(url string) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		if url == All {
+			return true
+		}
+		return ctx.Req != nil && strings.Contains(ctx.Req.Host, url)
+	})
+}
+
+// Any matches every exchange
+func Any() Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		return true
+	})
+}
+
+// Host matches requests whose host (without port) equals one of hosts
+func Host(hosts ...string) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		h := ctx.hostname()
+		for _, host := range hosts {
+			if strings.EqualFold(h, host) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// HostGlob matches the host against a shell pattern such as "*.example.com"
+func HostGlob(pattern string) Matcher {
+	pattern = strings.ToLower(pattern)
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		ok, _ := path.Match(pattern, ctx.hostname())
+		return ok
+	})
+}
+
+// HostSuffix matches domain and all of its subdomains
+func HostSuffix(domain string) Matcher {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		h := ctx.hostname()
+		return h == domain || strings.HasSuffix(h, "."+domain)
+	})
+}
+
+// URLRegex matches the full request URL against expr. It panics if expr
+// cannot be compiled.
+func URLRegex(expr string) Matcher {
+	re := regexp.MustCompile(expr)
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		return ctx.Req != nil && re.MatchString(ctx.Req.URL.String())
+	})
+}
+
+// PathPrefix matches requests whose URL path starts with prefix
+func PathPrefix(prefix string) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		return ctx.Req != nil && strings.HasPrefix(ctx.Req.URL.Path, prefix)
+	})
+}
+
+// Method matches requests using one of methods
+func Method(methods ...string) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		if ctx.Req == nil {
+			return false
+		}
+		for _, m := range methods {
+			if strings.EqualFold(ctx.Req.Method, m) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Header matches requests carrying header name with a value accepted by
+// pred. A nil pred only checks that the header is present.
+func Header(name string, pred func(value string) bool) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		if ctx.Req == nil {
+			return false
+		}
+		values := ctx.Req.Header.Values(name)
+		if pred == nil {
+			return len(values) > 0
+		}
+		for _, v := range values {
+			if pred(v) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ContentType matches the media type of the response, or of the request
+// while no response is available yet, e.g. "application/json".
+func ContentType(types ...string) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		var header http.Header
+		if ctx.Resp != nil {
+			header = ctx.Resp.Header
+		} else if ctx.Req != nil {
+			header = ctx.Req.Header
+		}
+		if header == nil {
+			return false
+		}
+		mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil {
+			return false
+		}
+		for _, t := range types {
+			if strings.EqualFold(mediaType, t) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// And matches when every matcher matches
+func And(matchers ...Matcher) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		for _, m := range matchers {
+			if !m.Match(ctx) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Or matches when at least one matcher matches
+func Or(matchers ...Matcher) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		for _, m := range matchers {
+			if m.Match(ctx) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Not inverts m
+func Not(m Matcher) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		return !m.Match(ctx)
+	})
+}
+
+// Port matches exchanges whose target port is one of ports
+func Port(ports ...int) Matcher {
+	return MatcherFunc(func(ctx *ProxyCtx) bool {
+		port := ctx.port()
+		for _, p := range ports {
+			if p == port {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// hostname returns the lower-cased request host without port, for streams
+// the SNI when known and for datagrams the remote host
+func (ctx *ProxyCtx) hostname() string {
+	var host string
+	switch {
+	case ctx.Req != nil:
+		host = ctx.Req.Host
+		if host == "" {
+			host = ctx.Req.URL.Host
+		}
+	case ctx.Stream != nil:
+		host = ctx.Stream.ServerName
+		if host == "" {
+			host = ctx.Stream.Host
+		}
+	case ctx.UDPSession != nil:
+		host = ctx.UDPSession.Remote
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// port returns the target port, derived from the scheme when the request
+// URL has none
+func (ctx *ProxyCtx) port() int {
+	var host, scheme string
+	switch {
+	case ctx.Req != nil:
+		host, scheme = ctx.Req.URL.Host, ctx.Req.URL.Scheme
+	case ctx.Stream != nil:
+		host = ctx.Stream.Host
+	case ctx.UDPSession != nil:
+		host = ctx.UDPSession.Remote
+	}
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		if scheme == "https" || scheme == "wss" {
+			return 443
+		}
+		return 80
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
@@ -0,0 +1,93 @@
+package gamemitm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMatchers(t *testing.T) {
+	req := httptest.NewRequest("POST", "https://api.game.example.com:8443/v1/login?x=1", nil)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-Version", "1.2.3")
+	ctx := &ProxyCtx{Req: req}
+
+	tests := []struct {
+		name string
+		m    Matcher
+		want bool
+	}{
+		{"Any", Any(), true},
+		{"Host", Host("API.game.example.com"), true},
+		{"Host other", Host("game.example.com"), false},
+		{"HostGlob", HostGlob("*.game.example.com"), true},
+		{"HostGlob other", HostGlob("*.example.org"), false},
+		{"HostSuffix", HostSuffix("example.com"), true},
+		{"HostSuffix partial label", HostSuffix("ample.com"), false},
+		{"URLRegex", URLRegex(`/v1/log(in|out)\?`), true},
+		{"PathPrefix", PathPrefix("/v1/"), true},
+		{"PathPrefix other", PathPrefix("/v2/"), false},
+		{"Method", Method("get", "post"), true},
+		{"Method other", Method("GET"), false},
+		{"Header present", Header("X-Version", nil), true},
+		{"Header value", Header("X-Version", func(v string) bool { return strings.HasPrefix(v, "1.") }), true},
+		{"Header missing", Header("X-Missing", nil), false},
+		{"ContentType", ContentType("application/json"), true},
+		{"Port", Port(443, 8443), true},
+		{"Port other", Port(443), false},
+		{"And", And(Host("api.game.example.com"), Method("POST")), true},
+		{"And one false", And(Host("api.game.example.com"), Method("GET")), false},
+		{"Or", Or(Method("GET"), PathPrefix("/v1")), true},
+		{"Not", Not(Method("GET")), true},
+		{"url key", urlMatcher("game.example"), true},
+		{"url key All", urlMatcher(All), true},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Match(ctx); got != tt.want {
+			t.Errorf("%s: Match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContentTypePrefersResponse(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://example.com/", nil)
+	req.Header.Set("Content-Type", "application/json")
+	ctx := &ProxyCtx{Req: req}
+	m := ContentType("text/html")
+	if m.Match(ctx) {
+		t.Fatal("matched the request content type")
+	}
+	ctx.Resp = &http.Response{Header: http.Header{"Content-Type": {"text/html; charset=utf-8"}}}
+	if !m.Match(ctx) {
+		t.Fatal("did not match the response content type")
+	}
+}
+
+func TestMatchersOnStreams(t *testing.T) {
+	ctx := &ProxyCtx{Stream: &StreamSession{Host: "10.0.0.1:7000", ServerName: "Login.Game.Example.com"}}
+	if !HostSuffix("game.example.com").Match(ctx) {
+		t.Error("HostSuffix did not use the stream SNI")
+	}
+	if !Port(7000).Match(ctx) {
+		t.Error("Port did not use the stream address")
+	}
+	if Method("GET").Match(ctx) || PathPrefix("/").Match(ctx) {
+		t.Error("request matchers matched a stream")
+	}
+}
+
+func TestMatchRequestThroughProxy(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+	p.OnRequestMatch(And(Method("PUT"), PathPrefix("/api/"))).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return []byte("matched")
+	})
+
+	if _, body := doText(t, client, "PUT", upstream.URL+"/api/x", "orig"); body != "matched" {
+		t.Errorf("PUT /api/x body = %q, want %q", body, "matched")
+	}
+	if _, body := doText(t, client, "POST", upstream.URL+"/api/x", "orig"); body != "orig" {
+		t.Errorf("POST /api/x body = %q, want %q", body, "orig")
+	}
+}
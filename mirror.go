@@ -0,0 +1,158 @@
+package gamemitm
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorTimeout bounds the upstream handshake done before answering the
+// client
+const mirrorTimeout = 10 * time.Second
+
+// SetMirrorTLS controls whether the client handshake mirrors the upstream
+// server. When enabled, the default, the proxy first connects upstream
+// with the SNI, ALPN protocols, versions and cipher suites of the client's
+// ClientHello, then answers the client with the ALPN protocol, version
+// and, when the certificate allows it, the cipher suite the server chose.
+// If the upstream handshake fails the client is answered with defaults.
+func (p *ProxyServer) SetMirrorTLS(mirror bool) {
+	p.noMirrorTLS = !mirror
+}
+
+// connectUpstreamTLS performs the upstream handshake for a client that
+// sent hello over the connection in raw, or a new one when raw is empty. It
+// returns the error when the server cannot be reached or the handshake
+// fails, an *UpstreamCertError has already been reported.
+func (p *ProxyServer) connectUpstreamTLS(host string, hello *clientHello, raw *preConn) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	defer cancel()
+	conn := raw.take()
+	if conn == nil {
+		var err error
+		conn, err = p.dial(ctx, "tcp", host)
+		if err != nil {
+			if p.isVerbose() {
+				p.logger.Debug("Failed to connect to %s before the client handshake: %v", host, err)
+			}
+			return nil, err
+		}
+	}
+
+	config := p.upstreamTLSConfig(host, hello.serverName, hello.alpn)
+	config.MinVersion, config.MaxVersion = versionRange(hello.versions)
+	config.CipherSuites = knownCipherSuites(hello.cipherSuites)
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		var certErr *UpstreamCertError
+		if !errors.As(err, &certErr) {
+			p.logger.Warn("Upstream TLS handshake with %s failed, answering the client with defaults: %v", host, err)
+		}
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// mirrorTLS makes the client config negotiate what the upstream server
+// negotiated in state
+func mirrorTLS(config *tls.Config, state tls.ConnectionState) {
+	config.MinVersion = state.Version
+	config.MaxVersion = state.Version
+	config.NextProtos = nil
+	if state.NegotiatedProtocol != "" {
+		config.NextProtos = []string{state.NegotiatedProtocol}
+	}
+	// 证书为 RSA，无法使用 ECDSA 套件；TLS 1.3 的套件不可配置
+	if state.Version <= tls.VersionTLS12 && !strings.Contains(tls.CipherSuiteName(state.CipherSuite), "ECDSA") {
+		config.CipherSuites = []uint16{state.CipherSuite}
+	}
+}
+
+// versionRange returns the lowest and highest known TLS versions offered
+// by the client, a client without the supported_versions extension is
+// limited to TLS 1.2
+func versionRange(versions []uint16) (lo, hi uint16) {
+	for _, v := range versions {
+		// 跳过 GREASE 等未知取值
+		if v < tls.VersionTLS10 || v > tls.VersionTLS13 {
+			continue
+		}
+		if lo == 0 || v < lo {
+			lo = v
+		}
+		if v > hi {
+			hi = v
+		}
+	}
+	if hi == 0 {
+		return tls.VersionTLS10, tls.VersionTLS12
+	}
+	return lo, hi
+}
+
+// knownCipherSuites returns the suites offered by the client that crypto/tls
+// implements, nil to use the defaults
+func knownCipherSuites(offered []uint16) []uint16 {
+	known := make(map[uint16]bool)
+	for _, s := range tls.CipherSuites() {
+		known[s.ID] = true
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		known[s.ID] = true
+	}
+	var suites []uint16
+	for _, id := range offered {
+		if known[id] {
+			suites = append(suites, id)
+		}
+	}
+	return suites
+}
+
+// preConn hands a connection dialed in advance to the first dial for its
+// address, it is closed if nobody takes it. After a failed handshake it
+// holds the error instead, dials fail with it rather than connecting again.
+type preConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	err  error
+}
+
+func (c *preConn) take() net.Conn {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn := c.conn
+	c.conn = nil
+	return conn
+}
+
+// fail makes the dials for the address fail with err
+func (c *preConn) fail(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+// failed returns the error of fail, nil if the connection did not fail
+func (c *preConn) failed() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *preConn) Close() {
+	if conn := c.take(); conn != nil {
+		conn.Close()
+	}
+}
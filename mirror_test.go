@@ -0,0 +1,111 @@
+package gamemitm
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestVersionRange(t *testing.T) {
+	tests := []struct {
+		versions []uint16
+		lo, hi   uint16
+	}{
+		{nil, tls.VersionTLS10, tls.VersionTLS12},
+		{[]uint16{0x0a0a, tls.VersionTLS13, tls.VersionTLS12}, tls.VersionTLS12, tls.VersionTLS13},
+		{[]uint16{tls.VersionTLS13}, tls.VersionTLS13, tls.VersionTLS13},
+	}
+	for _, tt := range tests {
+		lo, hi := versionRange(tt.versions)
+		if lo != tt.lo || hi != tt.hi {
+			t.Errorf("versionRange(%x) = %x, %x, want %x, %x", tt.versions, lo, hi, tt.lo, tt.hi)
+		}
+	}
+}
+
+func TestKnownCipherSuites(t *testing.T) {
+	// GREASE 和未实现的套件被过滤
+	offered := []uint16{0x1a1a, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, 0xc0ff, tls.TLS_RSA_WITH_AES_128_CBC_SHA256}
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA256}
+	if got := knownCipherSuites(offered); !reflect.DeepEqual(got, want) {
+		t.Fatalf("knownCipherSuites = %x, want %x", got, want)
+	}
+}
+
+// tls12Server only speaks TLS 1.2 and HTTP/1.1
+func tls12Server(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(echoHandler))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12, NextProtos: []string{"http/1.1"}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// handshakeThroughProxy opens a TLS connection to target through the proxy
+// of client, offering HTTP/2 and HTTP/1.1 and every TLS version
+func handshakeThroughProxy(t *testing.T, p *ProxyServer, client *http.Client, target string) *tls.Conn {
+	t.Helper()
+	conn := tls.Client(connectTunnel(t, client, target), &tls.Config{
+		RootCAs:    caPool(p),
+		ServerName: "127.0.0.1",
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestMirrorTLS(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := tls12Server(t)
+	versions := make(chan [2]uint16, 1)
+	p.OnResponse(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		select {
+		case versions <- [2]uint16{ctx.ClientTLS.Version, ctx.UpstreamTLS.Version}:
+		default:
+		}
+		return body
+	})
+
+	conn := handshakeThroughProxy(t, p, client, upstream.Listener.Addr().String())
+	state := conn.ConnectionState()
+	if state.Version != tls.VersionTLS12 {
+		t.Errorf("client negotiated version %x, want TLS 1.2 like the server", state.Version)
+	}
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("client negotiated ALPN %q, want http/1.1 like the server", state.NegotiatedProtocol)
+	}
+
+	req, _ := http.NewRequest("GET", "https://"+upstream.Listener.Addr().String()+"/", nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if v := <-versions; v != [2]uint16{tls.VersionTLS12, tls.VersionTLS12} {
+		t.Fatalf("ctx ClientTLS, UpstreamTLS versions = %x", v)
+	}
+}
+
+func TestMirrorTLSDisabled(t *testing.T) {
+	p, client := newTestProxy(t)
+	p.SetMirrorTLS(false)
+	upstream := tls12Server(t)
+
+	// 不镜像时按默认配置应答客户端
+	state := handshakeThroughProxy(t, p, client, upstream.Listener.Addr().String()).ConnectionState()
+	if state.Version != tls.VersionTLS13 {
+		t.Errorf("client negotiated version %x, want the TLS 1.3 default", state.Version)
+	}
+	if state.NegotiatedProtocol != "h2" {
+		t.Errorf("client negotiated ALPN %q, want the h2 default", state.NegotiatedProtocol)
+	}
+}
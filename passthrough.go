@@ -0,0 +1,218 @@
+package gamemitm
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PassthroughReason tells why a connection is relayed without interception
+type PassthroughReason int
+
+const (
+	// PassthroughListed means the host matched the passthrough list
+	PassthroughListed PassthroughReason = iota
+	// PassthroughLearned means an earlier handshake for the host was
+	// rejected by the client
+	PassthroughLearned
+	// PassthroughHandshakeFailed means the client just rejected our
+	// certificate with a TLS alert, connections to the host are relayed
+	// for the next 30 minutes or until ClearLearnedPassthrough
+	PassthroughHandshakeFailed
+	// PassthroughClosedAfterHandshake means the client completed the
+	// handshake but closed the connection without sending anything, as
+	// clients checking a pinned certificate after the handshake do. The
+	// host is learned like PassthroughHandshakeFailed.
+	PassthroughClosedAfterHandshake
+)
+
+// learnedPassthroughTTL is how long a host whose client rejected our
+// certificate is relayed before interception is tried again
+const learnedPassthroughTTL = 30 * time.Minute
+
+// pinnedCloseWindow is how soon after the handshake a client closing the
+// connection without sending data is taken as rejecting our certificate
+const pinnedCloseWindow = time.Second
+
+// TLS alerts a client sends when it does not accept our certificate
+const (
+	alertBadCertificate     = 42
+	alertCertificateUnknown = 46
+	alertUnknownCA          = 48
+)
+
+func (r PassthroughReason) String() string {
+	switch r {
+	case PassthroughListed:
+		return "listed"
+	case PassthroughLearned:
+		return "learned"
+	case PassthroughClosedAfterHandshake:
+		return "closed after handshake"
+	default:
+		return "handshake failed"
+	}
+}
+
+// PassthroughHandle is called for every passthrough decision. host is the
+// tunnel address and serverName the ClientHello SNI, empty if unknown.
+type PassthroughHandle func(host, serverName string, reason PassthroughReason)
+
+// passthrough holds the hosts that are relayed without interception
+type passthrough struct {
+	list *hostList
+	// learned maps passthroughKey to the time the entry expires
+	learned sync.Map
+}
+
+// SetPassthrough relays connections to hosts matching one of the patterns
+// (host globs, IPs, CIDRs or ":port") without interception, e.g. for
+// certificate pinned hosts. Hosts learned from rejected handshakes are
+// forgotten.
+func (p *ProxyServer) SetPassthrough(patterns ...string) error {
+	list, err := parseHostList(patterns)
+	if err != nil {
+		return err
+	}
+	p.passthrough.Store(&passthrough{list: list})
+	return nil
+}
+
+// SetPassthroughHandle sets the callback reporting passthrough decisions
+func (p *ProxyServer) SetPassthroughHandle(h PassthroughHandle) {
+	if h == nil {
+		p.passthroughHandle.Store(nil)
+		return
+	}
+	p.passthroughHandle.Store(&h)
+}
+
+// passthroughListed reports whether host, or serverName on the port of
+// host, is in the passthrough list
+func (p *ProxyServer) passthroughListed(host, serverName string) bool {
+	list := p.passthrough.Load().list
+	if list.match(host) {
+		return true
+	}
+	return serverName != "" && list.match(passthroughKey(host, serverName))
+}
+
+// ClearLearnedPassthrough forgets the hosts learned from rejected
+// handshakes, their next connections are intercepted again
+func (p *ProxyServer) ClearLearnedPassthrough() {
+	learned := &p.passthrough.Load().learned
+	learned.Range(func(key, _ any) bool {
+		learned.Delete(key)
+		return true
+	})
+}
+
+// passthroughLearned reports whether the client rejected an earlier
+// handshake for the same host within learnedPassthroughTTL
+func (p *ProxyServer) passthroughLearned(host, serverName string) bool {
+	learned := &p.passthrough.Load().learned
+	key := passthroughKey(host, serverName)
+	expires, ok := learned.Load(key)
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires.(time.Time)) {
+		learned.Delete(key)
+		return false
+	}
+	return true
+}
+
+// learnPassthrough remembers the host when the client failed the handshake
+// because it rejected our certificate, e.g. because of certificate
+// pinning. Other failures such as a client closing the connection during
+// the handshake are not learned. It reports whether the host was learned.
+func (p *ProxyServer) learnPassthrough(host, serverName string, err error) bool {
+	alert, ok := clientAlert(err)
+	if !ok || alert != alertBadCertificate && alert != alertCertificateUnknown && alert != alertUnknownCA {
+		return false
+	}
+	p.rememberPassthrough(host, serverName)
+	return true
+}
+
+// rememberPassthrough relays the next connections to the host for
+// learnedPassthroughTTL
+func (p *ProxyServer) rememberPassthrough(host, serverName string) {
+	p.passthrough.Load().learned.Store(passthroughKey(host, serverName), time.Now().Add(learnedPassthroughTTL))
+}
+
+// watchPinnedClose wraps the client side of an intercepted TLS connection.
+// Clients that check a pinned certificate after the handshake, as most
+// HTTP libraries do, close the connection without sending a request; when
+// the first read of conn ends that way within pinnedCloseWindow the host is
+// learned. Clients that only reject the certificate later, after sending
+// data, are not detected and need SetPassthrough.
+func (p *ProxyServer) watchPinnedClose(conn *tls.Conn, host, serverName string) net.Conn {
+	return &pinnedCloseConn{Conn: conn, p: p, host: host, serverName: serverName, start: time.Now()}
+}
+
+// pinnedCloseConn learns the host when the client closes the connection
+// before its first data
+type pinnedCloseConn struct {
+	*tls.Conn
+	p                *ProxyServer
+	host, serverName string
+	start            time.Time
+	once             sync.Once
+}
+
+func (c *pinnedCloseConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 || err != nil {
+		c.once.Do(func() {
+			// 只有握手后很快、没有任何数据的正常关闭才视为拒绝证书
+			if n == 0 && err == io.EOF && time.Since(c.start) < pinnedCloseWindow {
+				c.p.rememberPassthrough(c.host, c.serverName)
+				c.p.reportPassthrough(c.host, c.serverName, PassthroughClosedAfterHandshake)
+			}
+		})
+	}
+	return n, err
+}
+
+// clientAlert returns the TLS alert the peer sent if err was caused by one
+func clientAlert(err error) (uint8, bool) {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return 0, false
+	}
+	// crypto/tls 的 alert 类型未导出，其底层类型为 uint8
+	v := reflect.ValueOf(opErr.Err)
+	if v.Kind() != reflect.Uint8 {
+		return 0, false
+	}
+	return uint8(v.Uint()), true
+}
+
+func (p *ProxyServer) reportPassthrough(host, serverName string, reason PassthroughReason) {
+	if p.isVerbose() {
+		p.logger.Debug("Passthrough %s (%s): %s", host, serverName, reason)
+	}
+	if h := p.passthroughHandle.Load(); h != nil {
+		(*h)(host, serverName, reason)
+	}
+}
+
+// passthroughKey is the SNI, or the tunnel host when there is none, with
+// the tunnel port
+func passthroughKey(host, serverName string) string {
+	if serverName == "" {
+		return strings.ToLower(host)
+	}
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.ToLower(serverName), port)
+}
@@ -0,0 +1,257 @@
+package gamemitm
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// passthroughEvents records the reports of a PassthroughHandle
+type passthroughEvents struct {
+	mu      sync.Mutex
+	reasons []PassthroughReason
+}
+
+func (e *passthroughEvents) handle(host, serverName string, reason PassthroughReason) {
+	e.mu.Lock()
+	e.reasons = append(e.reasons, reason)
+	e.mu.Unlock()
+}
+
+func (e *passthroughEvents) list() []PassthroughReason {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]PassthroughReason(nil), e.reasons...)
+}
+
+// tlsThroughTunnel handshakes with target through the proxy of client, it
+// returns the connection and the handshake error
+func tlsThroughTunnel(t *testing.T, client *http.Client, target string, config *tls.Config) (*tls.Conn, error) {
+	conn := tls.Client(connectTunnel(t, client, target), config)
+	return conn, conn.Handshake()
+}
+
+func TestPassthroughListed(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	events := &passthroughEvents{}
+	p.SetPassthroughHandle(events.handle)
+	if err := p.SetPassthrough("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 直连名单内的主机返回上游的原始证书
+	conn, err := tlsThroughTunnel(t, client, upstream.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.ConnectionState().PeerCertificates[0].Equal(upstream.Certificate()) {
+		t.Fatal("listed host was intercepted")
+	}
+	if got := events.list(); len(got) != 1 || got[0] != PassthroughListed {
+		t.Fatalf("reported %v", got)
+	}
+}
+
+func TestPassthroughLearnsRejectedCertificate(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+	events := &passthroughEvents{}
+	p.SetPassthroughHandle(events.handle)
+
+	// 不信任代理 CA 的客户端会发送证书告警
+	if _, err := tlsThroughTunnel(t, client, target, &tls.Config{ServerName: "pinned.test"}); err == nil {
+		t.Fatal("client accepted the proxy certificate")
+	}
+	waitFor(t, func() bool { return len(events.list()) == 1 })
+	if got := events.list(); got[0] != PassthroughHandshakeFailed {
+		t.Fatalf("reported %v", got)
+	}
+
+	conn, err := tlsThroughTunnel(t, client, target, &tls.Config{ServerName: "pinned.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.ConnectionState().PeerCertificates[0].Equal(upstream.Certificate()) {
+		t.Fatal("learned host was intercepted")
+	}
+
+	p.ClearLearnedPassthrough()
+	conn, err = tlsThroughTunnel(t, client, target, &tls.Config{ServerName: "pinned.test", RootCAs: caPool(p)})
+	if err != nil {
+		t.Fatalf("host still relayed after ClearLearnedPassthrough: %v", err)
+	}
+	conn.Close()
+}
+
+func TestPassthroughIgnoresClosedHandshake(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+	events := &passthroughEvents{}
+	p.SetPassthroughHandle(events.handle)
+
+	// 客户端发送 ClientHello 后直接断开，不应记住该主机
+	conn := connectTunnel(t, client, target)
+	go tls.Client(conn, &tls.Config{ServerName: "flaky.test", InsecureSkipVerify: true}).Handshake()
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if p.passthroughLearned(target, "flaky.test") {
+		t.Fatal("host was learned from a closed connection")
+	}
+	if got := events.list(); len(got) != 0 {
+		t.Fatalf("reported %v", got)
+	}
+}
+
+func TestPassthroughLearnsCloseAfterHandshake(t *testing.T) {
+	for _, proto := range []string{"", "http/1.1"} {
+		t.Run("alpn "+proto, func(t *testing.T) {
+			p, client := newTestProxy(t)
+			upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+			defer upstream.Close()
+			target := upstream.Listener.Addr().String()
+			events := &passthroughEvents{}
+			p.SetPassthroughHandle(events.handle)
+			config := &tls.Config{ServerName: "pinned.test", RootCAs: caPool(p)}
+			if proto != "" {
+				config.NextProtos = []string{proto}
+			}
+
+			// 握手成功后客户端校验证书固定失败，不发送数据直接关闭
+			conn, err := tlsThroughTunnel(t, client, target, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			waitFor(t, func() bool { return len(events.list()) == 1 })
+			if got := events.list(); got[0] != PassthroughClosedAfterHandshake {
+				t.Fatalf("reported %v", got)
+			}
+
+			conn, err = tlsThroughTunnel(t, client, target, &tls.Config{ServerName: "pinned.test", InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if !conn.ConnectionState().PeerCertificates[0].Equal(upstream.Certificate()) {
+				t.Fatal("learned host was intercepted")
+			}
+		})
+	}
+}
+
+func TestPassthroughIgnoresCloseAfterData(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+	events := &passthroughEvents{}
+	p.SetPassthroughHandle(events.handle)
+
+	// 发送过请求的连接正常关闭，不应记住该主机
+	conn, err := tlsThroughTunnel(t, client, target, &tls.Config{ServerName: "game.test", RootCAs: caPool(p)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: game.test\r\n\r\n")
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if p.passthroughLearned(target, "game.test") {
+		t.Fatal("host was learned from a connection that sent a request")
+	}
+	if got := events.list(); len(got) != 0 {
+		t.Fatalf("reported %v", got)
+	}
+}
+
+func TestPassthroughConcurrentConfig(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+
+	// 服务期间修改直连名单与回调不产生数据竞争
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			p.SetPassthrough("10.0.0.1")
+			p.SetPassthroughHandle((&passthroughEvents{}).handle)
+			p.ClearLearnedPassthrough()
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		conn, err := tlsThroughTunnel(t, client, target, &tls.Config{ServerName: "game.test", InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	<-done
+}
+
+func TestLearnPassthroughExpires(t *testing.T) {
+	p := NewProxy()
+	alert := &net.OpError{Op: "remote error", Err: tlsAlert(t, alertUnknownCA)}
+	if p.learnPassthrough("10.0.0.1:443", "game.test", io.EOF) {
+		t.Fatal("learned from EOF")
+	}
+	if p.learnPassthrough("10.0.0.1:443", "game.test", &net.OpError{Op: "remote error", Err: errors.New("x")}) {
+		t.Fatal("learned from a non-alert error")
+	}
+	if !p.learnPassthrough("10.0.0.1:443", "game.test", alert) || !p.passthroughLearned("10.0.0.1:443", "game.test") {
+		t.Fatal("unknown_ca alert was not learned")
+	}
+	p.passthrough.Load().learned.Store(passthroughKey("10.0.0.1:443", "game.test"), time.Now().Add(-time.Second))
+	if p.passthroughLearned("10.0.0.1:443", "game.test") {
+		t.Fatal("expired entry still relayed")
+	}
+}
+
+// tlsAlert returns the error crypto/tls reports for a received alert
+func tlsAlert(t *testing.T, code uint8) error {
+	client, server := net.Pipe()
+	go func() {
+		// 读取 ClientHello 后回复告警记录
+		buf := make([]byte, 4096)
+		server.Read(buf)
+		server.Write([]byte{21, 3, 3, 0, 2, 2, code})
+		server.Close()
+	}()
+	err := tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" {
+		t.Fatalf("handshake error = %v, want a remote alert", err)
+	}
+	return opErr.Err
+}
+
+// waitFor polls cond for up to five seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not met")
+}
@@ -0,0 +1,495 @@
+package gamemitm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// linkTypeRaw is LINKTYPE_RAW, packets start with the IP header
+	linkTypeRaw = 101
+	// pcapSegmentSize is the largest TCP payload of a synthesized packet
+	pcapSegmentSize = 16384
+)
+
+// SetKeyLogWriter writes the TLS secrets of both the client and upstream
+// connections to w in NSS key log format (SSLKEYLOGFILE), so captures of
+// the encrypted traffic can be decrypted in Wireshark
+func (p *ProxyServer) SetKeyLogWriter(w io.Writer) {
+	p.keyLogWriter = w
+}
+
+// PcapRecorder writes the plaintext traffic seen by the proxy to a pcapng
+// stream. Every HTTP exchange, WebSocket session and raw TCP stream gets
+// its own synthesized TCP connection; HTTP/2 exchanges are written as
+// HTTP/1.1 and decrypted HTTPS uses port 80 so Wireshark dissects it, the
+// original URL is in the packet comment. Server hostnames map to addresses
+// in 198.18.0.0/15 recorded in name resolution blocks. WebSocket messages
+// and stream data are written as they are relayed, HTTP exchanges once
+// complete; packet timestamps never go backwards.
+//
+// Connections relayed without interception, passthrough hosts and TCP
+// streams no OnStream handler selected, are not recorded: the proxy only
+// copies their bytes.
+type PcapRecorder struct {
+	p      *ProxyServer
+	w      io.Writer
+	filter Matcher
+	remove func()
+	mu     sync.Mutex
+	err    error
+	hosts  map[string]net.IP
+	port   uint16
+	conns  map[*ProxyCtx]*pcapConn
+	// sessions are the connections of WebSocket flows in progress
+	sessions map[uint64]*pcapConn
+	// last is the timestamp of the last packet written
+	last time.Time
+}
+
+// pcapConn is a synthesized TCP connection
+type pcapConn struct {
+	client, server         net.IP
+	clientPort, serverPort uint16
+	clientSeq, serverSeq   uint32
+}
+
+// RecordPcap starts writing the traffic of p to w in pcapng format until
+// the recorder is closed. Only flows and streams matched by filter are
+// written, all of them when filter is nil.
+func (p *ProxyServer) RecordPcap(w io.Writer, filter Matcher) (*PcapRecorder, error) {
+	r := &PcapRecorder{
+		p:        p,
+		w:        w,
+		filter:   filter,
+		hosts:    make(map[string]net.IP),
+		port:     40000,
+		conns:    make(map[*ProxyCtx]*pcapConn),
+		sessions: make(map[uint64]*pcapConn),
+	}
+	if err := r.writeHeader(); err != nil {
+		return nil, err
+	}
+	r.remove = p.AddFlowObserver(r)
+	return r, nil
+}
+
+// Close stops recording, w is closed if it is an io.Closer. It returns the
+// first write error, or else the error closing w.
+func (r *PcapRecorder) Close() error {
+	r.remove()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	if c, ok := r.w.(io.Closer); ok {
+		err = c.Close()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
+
+// CaptureFlow selects the flows written with the filter of the recorder
+func (r *PcapRecorder) CaptureFlow(ctx *ProxyCtx) (int64, bool) {
+	if r.filter != nil && !r.filter.Match(ctx) {
+		return 0, false
+	}
+	return DefaultCaptureSize, true
+}
+
+// ObserveFlow writes an HTTP exchange, or ends the connection of a
+// WebSocket session
+func (r *PcapRecorder) ObserveFlow(f *Flow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c := r.sessions[f.ID]; c != nil {
+		delete(r.sessions, f.ID)
+		r.close(c, time.Now())
+		return
+	}
+	u, err := url.Parse(f.Request.URL)
+	if err != nil {
+		return
+	}
+	c := r.openHTTP(clientAddr(f.ctx), u, f.Start)
+	sent := f.Start.Add(f.Timings.Send)
+	r.data(c, ClientToServer, sent, httpRequestBytes(f.Request.Method, u, f.Request.Header, f.Request.Body, f.Messages == nil))
+
+	end := sent
+	if resp := f.Response; resp != nil {
+		end = sent.Add(f.Timings.Wait)
+		r.data(c, ServerToClient, end, httpResponseBytes(resp.Status, resp.StatusCode, resp.Header, resp.Body))
+		end = end.Add(f.Timings.Receive)
+	}
+	r.close(c, end)
+}
+
+// observeSessionMessage writes a WebSocket message as it is relayed, the
+// first one also writes the handshake of the session
+func (r *PcapRecorder) observeSessionMessage(ctx *ProxyCtx, flowID uint64, m *FlowMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.sessions[flowID]
+	if c == nil {
+		req := ctx.Req
+		c = r.openHTTP(clientAddr(ctx), req.URL, m.Time)
+		r.data(c, ClientToServer, m.Time, httpRequestBytes(req.Method, req.URL, req.Header, nil, false))
+		if resp := ctx.Resp; resp != nil {
+			r.data(c, ServerToClient, m.Time, httpResponseBytes(resp.Status, resp.StatusCode, resp.Header, nil))
+		}
+		r.sessions[flowID] = c
+	}
+	r.data(c, m.Direction, m.Time, wsFrame(m.Type, m.Data, m.Direction == ClientToServer))
+}
+
+// openHTTP starts the connection of an exchange or session for u
+func (r *PcapRecorder) openHTTP(client net.IP, u *url.URL, t time.Time) *pcapConn {
+	port := u.Port()
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		// 解密后的内容使用 80 端口，Wireshark 才会按 HTTP 解析
+		port = "80"
+	} else if port == "" {
+		port = "80"
+	}
+	return r.open(client, u.Hostname(), port, t, u.String())
+}
+
+// httpRequestBytes synthesizes an HTTP/1.1 request
+func httpRequestBytes(method string, u *url.URL, header http.Header, body []byte, withLength bool) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", method, u.RequestURI(), u.Host)
+	writeHeaders(&b, header, len(body), withLength)
+	b.Write(body)
+	return b.Bytes()
+}
+
+// httpResponseBytes synthesizes an HTTP/1.1 response
+func httpResponseBytes(status string, code int, header http.Header, body []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %s\r\n", status)
+	writeHeaders(&b, header, len(body), code != http.StatusSwitchingProtocols)
+	b.Write(body)
+	return b.Bytes()
+}
+
+// ObserveStream writes the bytes of a raw TCP stream
+func (r *PcapRecorder) ObserveStream(ctx *ProxyCtx, dir Direction, data []byte) {
+	if r.filter != nil && !r.filter.Match(ctx) {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.conns[ctx]
+	if c == nil {
+		host, port, _ := net.SplitHostPort(ctx.Stream.Host)
+		comment := "tcp://" + ctx.Stream.Host
+		if ctx.Stream.TLS {
+			comment = "tls://" + ctx.Stream.Host
+		}
+		c = r.open(clientAddr(ctx), host, port, now, comment)
+		r.conns[ctx] = c
+	}
+	r.data(c, dir, now, data)
+}
+
+// StreamClosed ends the TCP connection of a raw stream
+func (r *PcapRecorder) StreamClosed(ctx *ProxyCtx) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c := r.conns[ctx]; c != nil {
+		r.close(c, time.Now())
+		delete(r.conns, ctx)
+	}
+}
+
+// clientAddr returns the address of the client of ctx, 127.0.0.1 when it
+// is unknown
+func clientAddr(ctx *ProxyCtx) net.IP {
+	var addr string
+	switch {
+	case ctx == nil:
+	case ctx.Req != nil:
+		addr = ctx.Req.RemoteAddr
+	case ctx.Stream != nil && ctx.Stream.Client != nil:
+		addr = ctx.Stream.Client.RemoteAddr().String()
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// writeHeaders writes header and the end of the header block, the body
+// length replaces the framing headers when withLength is set
+func writeHeaders(b *bytes.Buffer, header http.Header, length int, withLength bool) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "Host" || (withLength && (name == "Content-Length" || name == "Transfer-Encoding")) {
+			continue
+		}
+		for _, v := range header[name] {
+			fmt.Fprintf(b, "%s: %s\r\n", name, v)
+		}
+	}
+	if withLength {
+		fmt.Fprintf(b, "Content-Length: %d\r\n", length)
+	}
+	b.WriteString("\r\n")
+}
+
+// wsFrame encodes a WebSocket message as a single frame, client frames are
+// masked with a zero key as the protocol requires a mask
+func wsFrame(msgType int, data []byte, masked bool) []byte {
+	var b bytes.Buffer
+	b.WriteByte(0x80 | byte(msgType))
+	var mask byte
+	if masked {
+		mask = 0x80
+	}
+	switch n := len(data); {
+	case n < 126:
+		b.WriteByte(mask | byte(n))
+	case n <= 0xffff:
+		b.WriteByte(mask | 126)
+		binary.Write(&b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(mask | 127)
+		binary.Write(&b, binary.BigEndian, uint64(n))
+	}
+	if masked {
+		b.Write([]byte{0, 0, 0, 0})
+	}
+	b.Write(data)
+	return b.Bytes()
+}
+
+// open starts a synthesized TCP connection with a three-way handshake
+func (r *PcapRecorder) open(client net.IP, host, port string, t time.Time, comment string) *pcapConn {
+	server := net.ParseIP(host)
+	if server == nil {
+		server = r.hostIP(host)
+	}
+	serverPort, _ := strconv.Atoi(port)
+	r.port++
+	if r.port == 0 {
+		r.port = 40001
+	}
+	c := &pcapConn{
+		client:     client,
+		server:     server,
+		clientPort: r.port,
+		serverPort: uint16(serverPort),
+		clientSeq:  1000,
+		serverSeq:  5000,
+	}
+	r.packet(c, ClientToServer, t, tcpSYN, nil, comment)
+	r.packet(c, ServerToClient, t, tcpSYN|tcpACK, nil, "")
+	r.packet(c, ClientToServer, t, tcpACK, nil, "")
+	return c
+}
+
+// data writes payload sent in dir, split into segments
+func (r *PcapRecorder) data(c *pcapConn, dir Direction, t time.Time, payload []byte) {
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > pcapSegmentSize {
+			n = pcapSegmentSize
+		}
+		r.packet(c, dir, t, tcpACK|tcpPSH, payload[:n], "")
+		payload = payload[n:]
+	}
+}
+
+// close ends a synthesized TCP connection
+func (r *PcapRecorder) close(c *pcapConn, t time.Time) {
+	r.packet(c, ClientToServer, t, tcpFIN|tcpACK, nil, "")
+	r.packet(c, ServerToClient, t, tcpFIN|tcpACK, nil, "")
+	r.packet(c, ClientToServer, t, tcpACK, nil, "")
+}
+
+// hostIP returns the synthesized address of host, a name resolution block
+// is written for a new host
+func (r *PcapRecorder) hostIP(host string) net.IP {
+	if ip, ok := r.hosts[host]; ok {
+		return ip
+	}
+	n := len(r.hosts) + 1
+	ip := net.IPv4(198, 18+byte(n>>16&1), byte(n>>8), byte(n)).To4()
+	r.hosts[host] = ip
+
+	// Name Resolution Block，让 Wireshark 显示主机名
+	var rec bytes.Buffer
+	binary.Write(&rec, binary.LittleEndian, uint16(1))
+	binary.Write(&rec, binary.LittleEndian, uint16(4+len(host)+1))
+	rec.Write(ip)
+	rec.WriteString(host)
+	rec.WriteByte(0)
+	pad(&rec)
+	rec.Write([]byte{0, 0, 0, 0})
+	r.block(4, rec.Bytes())
+	return ip
+}
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// packet writes a TCP segment in dir as an enhanced packet block
+func (r *PcapRecorder) packet(c *pcapConn, dir Direction, t time.Time, flags byte, payload []byte, comment string) {
+	// 完成时才写出的 HTTP 流带有较早的时间，不早于已写出的报文
+	if t.Before(r.last) {
+		t = r.last
+	}
+	r.last = t
+	src, dst := c.client, c.server
+	srcPort, dstPort := c.clientPort, c.serverPort
+	seq, ack := &c.clientSeq, &c.serverSeq
+	if dir == ServerToClient {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], *ack)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	*seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		*seq++
+	}
+
+	// 两端地址族不同时统一使用 IPv6
+	var pkt []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[6] = 0x40
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudoSum(src4, dst4, len(tcp))))
+		pkt = append(ip, tcp...)
+	} else {
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], src.To16())
+		copy(ip[24:], dst.To16())
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudoSum(src.To16(), dst.To16(), len(tcp))))
+		pkt = append(ip, tcp...)
+	}
+
+	var b bytes.Buffer
+	us := uint64(t.UnixMicro())
+	binary.Write(&b, binary.LittleEndian, []uint32{0, uint32(us >> 32), uint32(us), uint32(len(pkt)), uint32(len(pkt))})
+	b.Write(pkt)
+	pad(&b)
+	if comment != "" {
+		// opt_comment
+		binary.Write(&b, binary.LittleEndian, []uint16{1, uint16(len(comment))})
+		b.WriteString(comment)
+		pad(&b)
+		b.Write([]byte{0, 0, 0, 0})
+	}
+	r.block(6, b.Bytes())
+}
+
+// writeHeader writes the section header and interface description blocks
+func (r *PcapRecorder) writeHeader() error {
+	var shb bytes.Buffer
+	binary.Write(&shb, binary.LittleEndian, uint32(0x1A2B3C4D))
+	binary.Write(&shb, binary.LittleEndian, []uint16{1, 0})
+	binary.Write(&shb, binary.LittleEndian, int64(-1))
+	// shb_userappl
+	app := "game-mitm"
+	binary.Write(&shb, binary.LittleEndian, []uint16{4, uint16(len(app))})
+	shb.WriteString(app)
+	pad(&shb)
+	shb.Write([]byte{0, 0, 0, 0})
+	r.block(0x0A0D0D0A, shb.Bytes())
+
+	var idb bytes.Buffer
+	binary.Write(&idb, binary.LittleEndian, []uint16{linkTypeRaw, 0})
+	binary.Write(&idb, binary.LittleEndian, uint32(0))
+	r.block(1, idb.Bytes())
+	return r.err
+}
+
+// block writes a pcapng block, the first error stops all writes
+func (r *PcapRecorder) block(blockType uint32, body []byte) {
+	if r.err != nil {
+		return
+	}
+	var b bytes.Buffer
+	total := uint32(12 + len(body))
+	binary.Write(&b, binary.LittleEndian, []uint32{blockType, total})
+	b.Write(body)
+	binary.Write(&b, binary.LittleEndian, total)
+	if _, r.err = r.w.Write(b.Bytes()); r.err != nil {
+		r.p.logger.Error("Failed to write pcapng block: %v", r.err)
+	}
+}
+
+// pad pads b to a multiple of 4 bytes
+func pad(b *bytes.Buffer) {
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+// pseudoSum is the checksum of the TCP pseudo header
+func pseudoSum(src, dst net.IP, length int) uint32 {
+	var sum uint32
+	for _, ip := range []net.IP{src, dst} {
+		for i := 0; i < len(ip); i += 2 {
+			sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+		}
+	}
+	return sum + 6 + uint32(length)
+}
+
+// checksum is the Internet checksum of b starting from sum
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,278 @@
+package gamemitm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// pcapPacket is an enhanced packet block read back from a capture
+type pcapPacket struct {
+	time     uint64
+	flags    byte
+	payload  []byte
+	comment  string
+	srcPort  uint16
+	validSum bool
+}
+
+// readPcap parses the enhanced packet blocks of a pcapng capture
+func readPcap(t *testing.T, data []byte) []pcapPacket {
+	t.Helper()
+	if len(data) < 8 || binary.LittleEndian.Uint32(data) != 0x0A0D0D0A {
+		t.Fatal("capture does not start with a section header block")
+	}
+	var packets []pcapPacket
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("%d trailing bytes", len(data))
+		}
+		blockType := binary.LittleEndian.Uint32(data)
+		total := int(binary.LittleEndian.Uint32(data[4:]))
+		if total%4 != 0 || total > len(data) || binary.LittleEndian.Uint32(data[total-4:]) != uint32(total) {
+			t.Fatalf("malformed block of type %d, length %d", blockType, total)
+		}
+		body := data[8 : total-4]
+		data = data[total:]
+		if blockType != 6 {
+			continue
+		}
+
+		var pkt pcapPacket
+		pkt.time = uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+		length := int(binary.LittleEndian.Uint32(body[12:]))
+		raw := body[20 : 20+length]
+		var tcp []byte
+		switch raw[0] >> 4 {
+		case 4:
+			tcp = raw[20:]
+			pkt.validSum = checksum(raw[:20], 0) == 0 &&
+				checksum(tcp, pseudoSum(net.IP(raw[12:16]), net.IP(raw[16:20]), len(tcp))) == 0
+		case 6:
+			tcp = raw[40:]
+			pkt.validSum = checksum(tcp, pseudoSum(net.IP(raw[8:24]), net.IP(raw[24:40]), len(tcp))) == 0
+		default:
+			t.Fatalf("IP version %d", raw[0]>>4)
+		}
+		pkt.srcPort = binary.BigEndian.Uint16(tcp)
+		pkt.flags = tcp[13]
+		pkt.payload = tcp[20:]
+		if opts := body[20+(length+3)/4*4:]; len(opts) >= 4 && binary.LittleEndian.Uint16(opts) == 1 {
+			pkt.comment = string(opts[4 : 4+binary.LittleEndian.Uint16(opts[2:])])
+		}
+		packets = append(packets, pkt)
+	}
+	return packets
+}
+
+// pcapPayload joins the TCP payloads of the capture
+func pcapPayload(packets []pcapPacket) string {
+	var b strings.Builder
+	for _, pkt := range packets {
+		b.Write(pkt.payload)
+	}
+	return b.String()
+}
+
+func TestRecordPcapHTTP(t *testing.T) {
+	p, client := newTestProxy(t)
+	var buf syncBuffer
+	rec, err := p.RecordPcap(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	upstream := echoServer(t)
+
+	doText(t, client, "POST", upstream.URL+"/login?v=1", "hello")
+	var packets []pcapPacket
+	waitFor(t, func() bool {
+		packets = readPcap(t, buf.Bytes())
+		return strings.Contains(pcapPayload(packets), "HTTP/1.1 200 OK")
+	})
+	if packets[0].flags != tcpSYN || packets[0].comment != upstream.URL+"/login?v=1" {
+		t.Fatalf("first packet flags %#x, comment %q", packets[0].flags, packets[0].comment)
+	}
+	payload := pcapPayload(packets)
+	if !strings.HasPrefix(payload, "POST /login?v=1 HTTP/1.1\r\n") || !strings.Contains(payload, "Content-Length: 5\r\n\r\nhello") {
+		t.Fatalf("request written as %q", payload)
+	}
+	for i, pkt := range packets {
+		if !pkt.validSum {
+			t.Fatalf("packet %d has a wrong checksum", i)
+		}
+	}
+}
+
+func TestRecordPcapWebSocketLive(t *testing.T) {
+	p, client := newTestProxy(t)
+	var buf syncBuffer
+	rec, err := p.RecordPcap(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	upstream := wsEchoServer(t)
+
+	conn, _ := dialWebSocket(t, client, "ws"+strings.TrimPrefix(upstream.URL, "http")+"/ws", nil)
+	conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "ping" {
+		t.Fatalf("echo = %q, %v", data, err)
+	}
+	// 会话仍在进行时消息已经写出
+	waitFor(t, func() bool {
+		payload := pcapPayload(readPcap(t, buf.Bytes()))
+		return strings.Contains(payload, "GET /ws HTTP/1.1") &&
+			strings.Contains(payload, "HTTP/1.1 101 Switching Protocols") &&
+			strings.Count(payload, "ping") == 2
+	})
+	for _, pkt := range readPcap(t, buf.Bytes()) {
+		if pkt.flags&tcpFIN != 0 {
+			t.Fatal("connection closed while the session is open")
+		}
+	}
+
+	conn.Close()
+	waitFor(t, func() bool {
+		packets := readPcap(t, buf.Bytes())
+		return packets[len(packets)-1].flags == tcpACK && packets[len(packets)-2].flags&tcpFIN != 0
+	})
+}
+
+func TestRecordPcapStream(t *testing.T) {
+	p, client := newTestProxy(t)
+	var buf syncBuffer
+	rec, err := p.RecordPcap(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	target := frameEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	p.OnStream(Port(portNum)).Framer(&DelimiterFramer{Delimiter: []byte("\n")}).Do(func(msg []byte, dir Direction, ctx *ProxyCtx) []byte {
+		return msg
+	})
+
+	conn := connectTunnel(t, client, target)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "hi\n")
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "echo:hi\n" {
+		t.Fatalf("echo = %q, %v", line, err)
+	}
+	waitFor(t, func() bool {
+		packets := readPcap(t, buf.Bytes())
+		return len(packets) > 0 && packets[0].comment == "tcp://"+target &&
+			pcapPayload(packets) == "hi\necho:hi\n"
+	})
+}
+
+func TestRecordPcapFilter(t *testing.T) {
+	p, client := newTestProxy(t)
+	var buf syncBuffer
+	rec, err := p.RecordPcap(&buf, PathPrefix("/api/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	upstream := echoServer(t)
+
+	doText(t, client, "GET", upstream.URL+"/static/a.png", "")
+	doText(t, client, "GET", upstream.URL+"/api/login", "")
+	waitFor(t, func() bool {
+		return strings.Contains(pcapPayload(readPcap(t, buf.Bytes())), "GET /api/login ")
+	})
+	if payload := pcapPayload(readPcap(t, buf.Bytes())); strings.Contains(payload, "/static/") {
+		t.Fatalf("filtered request written: %q", payload)
+	}
+}
+
+func TestPcapTimestampsMonotonic(t *testing.T) {
+	p := NewProxy()
+	var buf syncBuffer
+	rec, err := p.RecordPcap(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+
+	// 完成较晚但开始较早的交换不能让时间倒退
+	now := time.Now()
+	c := rec.open(net.IPv4(127, 0, 0, 1), "game.test", "80", now, "")
+	rec.data(c, ClientToServer, now.Add(time.Second), []byte("late"))
+	rec.data(c, ServerToClient, now, []byte("early"))
+	rec.close(c, now)
+
+	var last uint64
+	for i, pkt := range readPcap(t, buf.Bytes()) {
+		if pkt.time < last {
+			t.Fatalf("packet %d at %d, before %d", i, pkt.time, last)
+		}
+		last = pkt.time
+	}
+}
+
+// failingFile fails every write after the first n and records Close
+type failingFile struct {
+	n      int
+	closed bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errors.New("disk full")
+	}
+	f.n--
+	return len(p), nil
+}
+
+func (f *failingFile) Close() error {
+	f.closed = true
+	return errors.New("close failed")
+}
+
+func TestPcapCloseReportsWriteError(t *testing.T) {
+	p := NewProxy()
+	p.SetLogger(discardLogger{})
+	f := &failingFile{n: 2}
+	rec, err := p.RecordPcap(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 写入失败后 Close 仍关闭文件，并返回最先发生的写入错误
+	rec.open(net.IPv4(127, 0, 0, 1), "game.test", "80", time.Now(), "")
+	if err := rec.Close(); err == nil || err.Error() != "disk full" {
+		t.Fatalf("Close() = %v, want the write error", err)
+	}
+	if !f.closed {
+		t.Fatal("file was not closed")
+	}
+}
@@ -4,24 +4,48 @@ import (
 	"context"
 	"fmt"
 	"github.com/husanpao/game-mitm/cert"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ProxyServer struct {
-	logger             Logger
-	port               int
-	ca                 *cert.CA
-	certManager        *cert.CertificateManager
-	Verbose            bool
-	reqHandles         map[string]Handle
-	hasReqHandle       bool
-	respHandles        map[string]Handle
-	hasRespHandle      bool
-	connectedHandles   map[string]Handle
-	hasConnectedHandle bool
-	server             *http.Server
+	logger        Logger
+	port          int
+	ca            *cert.CA
+	certManager   *cert.CertificateManager
+	Verbose       bool
+	maxBodySize   int64
+	keepEncoding  bool
+	transport     *http.Transport
+	upstreamProxy atomic.Pointer[UpstreamProxyFunc]
+	socksUser     string
+	socksPassword string
+	passthrough   atomic.Pointer[passthrough]
+	// passthroughHandle is the SetPassthroughHandle callback
+	passthroughHandle atomic.Pointer[PassthroughHandle]
+	// upstreamVerifier is nil until SetUpstreamTLS, upstream certificates
+	// are then not verified
+	upstreamVerifier       *upstreamVerifier
+	upstreamTLSErrorHandle func(err *UpstreamCertError)
+	clientCerts            []clientCert
+	requestClientCert      bool
+	noMirrorTLS            bool
+	flowObservers          flowObservers
+	replayer               atomic.Pointer[Replayer]
+	keyLogWriter           io.Writer
+	live                   liveRegistry
+	listeners              []io.Closer
+	listenerMu             sync.Mutex
+	handlers               atomic.Pointer[HandlerSet]
+	// verbose is the value of SetVerbose, which the admin API may call
+	// while serving; nil until it is called
+	verbose atomic.Pointer[bool]
+	server  *http.Server
 }
 
 func NewProxy() *ProxyServer {
@@ -32,16 +56,28 @@ func NewProxy() *ProxyServer {
 	if err != nil {
 		panic(err)
 	}
-	return &ProxyServer{
-		logger:           NewDefaultLogger(),
-		port:             12311,
-		ca:               ca,
-		certManager:      cert.NewCertificateManager(ca),
-		Verbose:          true,
-		reqHandles:       make(map[string]Handle),
-		respHandles:      make(map[string]Handle),
-		connectedHandles: make(map[string]Handle),
+	p := &ProxyServer{
+		logger:       NewDefaultLogger(),
+		port:         12311,
+		ca:           ca,
+		certManager:  cert.NewCertificateManager(ca),
+		Verbose:      true,
+		maxBodySize:  DefaultMaxBodySize,
+		keepEncoding: true,
 	}
+	p.transport = &http.Transport{
+		Proxy:       p.httpProxy,
+		DialContext: p.dial,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialTLS(ctx, network, addr, "", nil)
+		},
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	p.handlers.Store(NewHandlerSet())
+	p.passthrough.Store(&passthrough{})
+	return p
 }
 
 func (p *ProxyServer) SetLogger(logger Logger) {
@@ -50,8 +86,20 @@ func (p *ProxyServer) SetLogger(logger Logger) {
 func (p *ProxyServer) SetPort(port int) {
 	p.port = port
 }
+
+// SetVerbose enables debug logs, it may be called while serving and takes
+// precedence over the Verbose field
 func (p *ProxyServer) SetVerbose(verbose bool) {
-	p.Verbose = verbose
+	p.verbose.Store(&verbose)
+}
+
+// isVerbose reports whether debug logs are written: the last value given
+// to SetVerbose, the Verbose field when it was never called
+func (p *ProxyServer) isVerbose() bool {
+	if v := p.verbose.Load(); v != nil {
+		return *v
+	}
+	return p.Verbose
 }
 func (p *ProxyServer) SetCa(ca *cert.CA) {
 	p.ca = ca
@@ -62,6 +110,15 @@ func (p *ProxyServer) Start() error {
 	p.server = &http.Server{
 		Addr:    fmt.Sprintf(":%d", p.port),
 		Handler: http.HandlerFunc(p.handleRequest),
+		// CONNECT 隧道被接管后由 interceptConn 重新登记目标地址
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				p.trackConn(conn, "")
+			case http.StateHijacked, http.StateClosed:
+				p.untrackConn(conn)
+			}
+		},
 	}
 	p.logger.Info("Starting proxy server on port %d ", p.port)
 	return p.server.ListenAndServe()
@@ -69,6 +126,13 @@ func (p *ProxyServer) Start() error {
 
 // Stop gracefully stops the proxy server with a timeout
 func (p *ProxyServer) Stop() error {
+	p.listenerMu.Lock()
+	for _, l := range p.listeners {
+		l.Close()
+	}
+	p.listeners = nil
+	p.listenerMu.Unlock()
+
 	if p.server != nil {
 		p.logger.Info("Stopping proxy server on port %d", p.port)
 		// 创建一个带有超时的上下文
@@ -89,19 +153,19 @@ func (p *ProxyServer) Stop() error {
 
 func (p *ProxyServer) handleRequest(w http.ResponseWriter, r *http.Request) {
 	// Handle the incoming request and forward it to the target server
-	if p.Verbose {
+	if p.isVerbose() {
 		p.logger.Debug("Received request: %s %s", r.Method, r.URL)
 	}
 
 	if r.Method == http.MethodConnect {
-		if p.Verbose {
+		if p.isVerbose() {
 			p.logger.Debug("Handling CONNECT request for %s", r.URL)
 		}
 		p.handleTunneling(w, r)
 		return
 	}
 	// 处理普通 HTTP 请求
-	if p.Verbose {
+	if p.isVerbose() {
 		p.logger.Debug("Handling HTTP request for %s", r.URL)
 	}
 	p.handleHTTP(w, r)
@@ -0,0 +1,97 @@
+package gamemitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// discardLogger drops every log line
+type discardLogger struct{}
+
+func (discardLogger) Debug(format string, args ...interface{}) {}
+func (discardLogger) Info(format string, args ...interface{})  {}
+func (discardLogger) Warn(format string, args ...interface{})  {}
+func (discardLogger) Error(format string, args ...interface{}) {}
+func (discardLogger) Fatal(format string, args ...interface{}) {}
+
+// newTestProxy starts the proxy on a random port and returns a client
+// using it that trusts the proxy CA
+func newTestProxy(t *testing.T) (*ProxyServer, *http.Client) {
+	t.Helper()
+	p := NewProxy()
+	p.SetLogger(discardLogger{})
+	p.SetVerbose(false)
+	server := httptest.NewServer(http.HandlerFunc(p.handleRequest))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { p.Stop() })
+	return p, newProxyClient(t, p, server.URL)
+}
+
+// newProxyClient returns a client sending its requests to proxyURL
+func newProxyClient(t *testing.T, p *ProxyServer, proxyURL string) *http.Client {
+	t.Helper()
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &http.Transport{
+		Proxy:              http.ProxyURL(u),
+		TLSClientConfig:    &tls.Config{RootCAs: caPool(p)},
+		DisableCompression: true,
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+// caPool returns a pool trusting the proxy CA
+func caPool(p *ProxyServer) *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca.Certificate)
+	return roots
+}
+
+// echoServer answers every request with its method, path and body
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(echoHandler))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("X-Method", r.Method)
+	w.Header().Set("X-Path", r.URL.RequestURI())
+	w.Header().Set("X-Host", r.Host)
+	w.Write(body)
+}
+
+// doText sends a request through client and returns the response and its
+// body
+func doText(t *testing.T, client *http.Client, method, target, body string) (*http.Response, string) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
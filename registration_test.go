@@ -0,0 +1,110 @@
+package gamemitm
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRegistrationRemove(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+	r := p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return []byte("changed")
+	})
+
+	if _, body := doText(t, client, "POST", upstream.URL, "orig"); body != "changed" {
+		t.Fatalf("body = %q before Remove", body)
+	}
+	r.Remove()
+	if _, body := doText(t, client, "POST", upstream.URL, "orig"); body != "orig" {
+		t.Fatalf("body = %q after Remove", body)
+	}
+	// 重复移除不影响其他处理函数
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return append(body, '!')
+	})
+	r.Remove()
+	if _, body := doText(t, client, "POST", upstream.URL, "orig"); body != "orig!" {
+		t.Fatalf("body = %q after a second Remove", body)
+	}
+}
+
+func TestRegistrationSetEnabled(t *testing.T) {
+	s := NewHandlerSet()
+	first := s.OnRequest(All).Name("first").Do(func(body []byte, ctx *ProxyCtx) []byte { return body })
+	second := s.OnResponse(All).Name("second").Priority(5).Do(func(body []byte, ctx *ProxyCtx) []byte { return body })
+
+	first.SetEnabled(false)
+	if len(s.chain(Request)) != 0 {
+		t.Fatal("disabled handler is still in the chain")
+	}
+	list := s.List()
+	if len(list) != 2 {
+		t.Fatalf("List returned %d handlers, want 2", len(list))
+	}
+	if list[0].ID != first.ID() || list[0].Type != "request" || list[0].Name != "first" || list[0].Enabled {
+		t.Errorf("List()[0] = %+v", list[0])
+	}
+	if list[1].ID != second.ID() || list[1].Type != "response" || list[1].Priority != 5 || !list[1].Enabled {
+		t.Errorf("List()[1] = %+v", list[1])
+	}
+
+	if !s.SetEnabled(first.ID(), true) || len(s.chain(Request)) != 1 {
+		t.Fatal("SetEnabled by ID did not enable the handler")
+	}
+	if s.SetEnabled(12345, true) {
+		t.Fatal("SetEnabled reported an unknown ID as found")
+	}
+}
+
+func TestReplaceHandlers(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return []byte("old")
+	})
+
+	s := NewHandlerSet()
+	s.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return []byte("new")
+	})
+	old := p.ReplaceHandlers(s)
+	if p.Handlers() != s {
+		t.Fatal("Handlers did not return the new set")
+	}
+	if _, body := doText(t, client, "POST", upstream.URL, "orig"); body != "new" {
+		t.Fatalf("body = %q, want the new set to run", body)
+	}
+	p.ReplaceHandlers(old)
+	if _, body := doText(t, client, "POST", upstream.URL, "orig"); body != "old" {
+		t.Fatalf("body = %q, want the old set to run", body)
+	}
+}
+
+func TestHandlerSetConcurrentUpdates(t *testing.T) {
+	p := NewProxy()
+	s := p.Handlers()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				r := s.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte { return body })
+				r.SetEnabled(j%2 == 0)
+				r.Remove()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				p.runHandles(Request, nil, &ProxyCtx{Proxy: p})
+				s.List()
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(s.List()); n != 0 {
+		t.Fatalf("%d handlers left after removing all of them", n)
+	}
+}
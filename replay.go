@@ -0,0 +1,446 @@
+package gamemitm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// ReplayStrategy reduces a request to the key looked up in the recording,
+// a request is answered with the recorded exchange of the same key
+type ReplayStrategy func(method string, u *url.URL, body []byte) string
+
+// ReplayExact matches requests with the same method, URL and body
+func ReplayExact() ReplayStrategy {
+	return func(method string, u *url.URL, body []byte) string {
+		return method + " " + u.String() + "\n" + string(body)
+	}
+}
+
+// ReplayIgnoreQuery matches requests with the same method, URL without
+// query and body
+func ReplayIgnoreQuery() ReplayStrategy {
+	return func(method string, u *url.URL, body []byte) string {
+		v := *u
+		v.RawQuery = ""
+		return method + " " + v.String() + "\n" + string(body)
+	}
+}
+
+// ReplayIgnoreJSONFields matches requests as ReplayExact, ignoring the
+// named fields, e.g. timestamps or nonces, at any depth of JSON bodies
+// and in the query string
+func ReplayIgnoreJSONFields(fields ...string) ReplayStrategy {
+	ignored := make(map[string]bool)
+	for _, f := range fields {
+		ignored[f] = true
+	}
+	return func(method string, u *url.URL, body []byte) string {
+		v := *u
+		query := v.Query()
+		for f := range ignored {
+			query.Del(f)
+		}
+		v.RawQuery = query.Encode()
+		var doc any
+		if json.Unmarshal(body, &doc) == nil {
+			// 重新编码后字段顺序固定，空白差异也被忽略
+			body, _ = json.Marshal(dropJSONFields(doc, ignored))
+		}
+		return method + " " + v.String() + "\n" + string(body)
+	}
+}
+
+func dropJSONFields(v any, ignored map[string]bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if ignored[k] {
+				delete(v, k)
+			} else {
+				v[k] = dropJSONFields(child, ignored)
+			}
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = dropJSONFields(child, ignored)
+		}
+	}
+	return v
+}
+
+// errNotRecorded is the error of flows missing from the recording in
+// offline replay
+var errNotRecorded = errors.New("not in the recording")
+
+// ReplayConfig configures a Replayer
+type ReplayConfig struct {
+	// Files are HAR files written by RecordHAR, loaded in order
+	Files []string
+	// Strategy matches requests to recorded exchanges, ReplayExact when nil
+	Strategy ReplayStrategy
+	// Offline answers requests missing from the recording with 502 Bad
+	// Gateway instead of sending them upstream
+	Offline bool
+	// NoDelay answers at once instead of reproducing the recorded waiting
+	// times and the gaps between WebSocket messages
+	NoDelay bool
+}
+
+// Replayer answers requests from recorded exchanges, see ProxyServer.Replay
+type Replayer struct {
+	p         *ProxyServer
+	cfg       ReplayConfig
+	mu        sync.Mutex
+	exchanges map[string]*replayQueue
+	sessions  map[string]*replayQueue
+	unmatched []string
+}
+
+// replayQueue holds the recorded exchanges of a key, they are used in
+// order and the last one is repeated
+type replayQueue struct {
+	list []*replayExchange
+	next int
+}
+
+func (q *replayQueue) take() *replayExchange {
+	ex := q.list[q.next]
+	if q.next < len(q.list)-1 {
+		q.next++
+	}
+	return ex
+}
+
+type replayExchange struct {
+	status int
+	reason string
+	header http.Header
+	body   []byte
+	wait   time.Duration
+	frames []replayFrame
+}
+
+// replayFrame is a recorded WebSocket message, gap is the time elapsed
+// since the previous message
+type replayFrame struct {
+	fromClient bool
+	msgType    int
+	data       []byte
+	gap        time.Duration
+}
+
+// Replay answers HTTP requests and WebSocket sessions from the HAR files
+// in cfg instead of the upstream servers. Request and response handlers
+// still run; recorded WebSocket server messages are sent in order, each
+// client message recorded in between is awaited before going on. Replay
+// ends when the returned Replayer is closed.
+func (p *ProxyServer) Replay(cfg ReplayConfig) (*Replayer, error) {
+	if cfg.Strategy == nil {
+		cfg.Strategy = ReplayExact()
+	}
+	r := &Replayer{
+		p:         p,
+		cfg:       cfg,
+		exchanges: make(map[string]*replayQueue),
+		sessions:  make(map[string]*replayQueue),
+	}
+	count := 0
+	for _, name := range cfg.Files {
+		n, err := r.load(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %v", name, err)
+		}
+		count += n
+	}
+	p.replayer.Store(r)
+	p.logger.Info("Replaying %d recorded exchanges", count)
+	return r, nil
+}
+
+// Close stops the replay, requests are sent upstream again
+func (r *Replayer) Close() error {
+	r.p.replayer.CompareAndSwap(r, nil)
+	return nil
+}
+
+// Unmatched returns the requests that had no recorded exchange, as
+// "METHOD URL"
+func (r *Replayer) Unmatched() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.unmatched...)
+}
+
+// load adds the entries of a HAR file and returns how many were loaded
+func (r *Replayer) load(name string) (int, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	var har struct {
+		Log struct {
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(data, &har); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, e := range har.Log.Entries {
+		// 没有收到响应的条目无法回放
+		if e.Response.Status == 0 {
+			continue
+		}
+		// 截断的内容回放给客户端只会得到残缺的数据
+		if e.Response.Content.Truncated || (e.Request.PostData != nil && e.Request.PostData.Truncated) {
+			r.p.logger.Warn("Skipping %s %s in %s, its recorded body is truncated", e.Request.Method, e.Request.URL, name)
+			continue
+		}
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			continue
+		}
+		var body []byte
+		if e.Request.PostData != nil {
+			body = harBytes(e.Request.PostData.Text, e.Request.PostData.Encoding)
+		}
+		ex := &replayExchange{
+			status: e.Response.Status,
+			reason: e.Response.StatusText,
+			header: make(http.Header),
+			body:   harBytes(e.Response.Content.Text, e.Response.Content.Encoding),
+			wait:   time.Duration(e.Timings.Wait * float64(time.Millisecond)),
+		}
+		for _, h := range e.Response.Headers {
+			ex.header.Add(h.Name, h.Value)
+		}
+		// HAR 中通常保存解压后的内容，未能解压的保留原来的 Content-Encoding
+		for _, name := range []string{"Content-Encoding", "Content-Length", "Transfer-Encoding"} {
+			ex.header.Del(name)
+		}
+		if enc := e.Response.Content.ContentEncoding; enc != "" {
+			ex.header.Set("Content-Encoding", enc)
+		}
+
+		queues := r.exchanges
+		if e.ResourceType == "websocket" || e.Messages != nil {
+			queues = r.sessions
+			prev := 0.0
+			if t, err := time.Parse(time.RFC3339Nano, e.StartedDateTime); err == nil {
+				prev = float64(t.UnixNano()) / float64(time.Second)
+			}
+			for _, m := range e.Messages {
+				frame := replayFrame{
+					fromClient: m.Type == "send",
+					msgType:    m.Opcode,
+					data:       []byte(m.Data),
+					gap:        time.Duration((m.Time - prev) * float64(time.Second)),
+				}
+				if m.Opcode == websocket.BinaryMessage || m.Encoding == "base64" {
+					frame.data, _ = base64.StdEncoding.DecodeString(m.Data)
+				}
+				if frame.gap < 0 {
+					frame.gap = 0
+				}
+				prev = m.Time
+				ex.frames = append(ex.frames, frame)
+			}
+		}
+		key := r.cfg.Strategy(e.Request.Method, u, body)
+		q := queues[key]
+		if q == nil {
+			q = &replayQueue{}
+			queues[key] = q
+		}
+		q.list = append(q.list, ex)
+		count++
+	}
+	return count, nil
+}
+
+// harBytes decodes a HAR text field
+func harBytes(text, encoding string) []byte {
+	if encoding == "base64" {
+		if data, err := base64.StdEncoding.DecodeString(text); err == nil {
+			return data
+		}
+	}
+	return []byte(text)
+}
+
+// find returns the next recorded exchange for the request, nil and the
+// request is noted as unmatched when there is none
+func (r *Replayer) find(queues map[string]*replayQueue, req *http.Request, body []byte) *replayExchange {
+	if enc := contentEncoding(req.Header); enc != "" && len(body) > 0 {
+		if plain, err := decodeBytes(enc, body, r.p.maxBodySize); err == nil {
+			body = plain
+		}
+	}
+	key := r.cfg.Strategy(req.Method, req.URL, body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if q := queues[key]; q != nil {
+		return q.take()
+	}
+	r.unmatched = append(r.unmatched, req.Method+" "+req.URL.String())
+	return nil
+}
+
+// respond returns the recorded response for req, or nil and the body to
+// send upstream when the request is not in the recording
+func (r *Replayer) respond(req *http.Request, body io.ReadCloser) (*http.Response, io.ReadCloser) {
+	max := r.p.maxBodySize
+	var data []byte
+	var err error
+	if max > 0 {
+		data, err = io.ReadAll(io.LimitReader(body, max+1))
+	} else {
+		data, err = io.ReadAll(body)
+	}
+	if err != nil {
+		body.Close()
+		return NewResponse(req, http.StatusBadGateway, "text/plain; charset=utf-8", []byte("Failed to read request body")), nil
+	}
+	if max > 0 && int64(len(data)) > max {
+		// 超出限制的请求不在录制中查找，已读取部分与剩余部分拼接后发往上游
+		r.mu.Lock()
+		r.unmatched = append(r.unmatched, req.Method+" "+req.URL.String())
+		r.mu.Unlock()
+		if r.cfg.Offline {
+			body.Close()
+			msg := fmt.Sprintf("Request body of %s %s exceeds %d bytes, not replayed\n", req.Method, req.URL, max)
+			return NewResponse(req, http.StatusBadGateway, "text/plain; charset=utf-8", []byte(msg)), nil
+		}
+		return nil, &readCloser{Reader: io.MultiReader(bytes.NewReader(data), body), closer: body}
+	}
+	body.Close()
+	ex := r.find(r.exchanges, req, data)
+	if ex == nil {
+		if r.cfg.Offline {
+			r.p.logger.Warn("No recorded response for %s %s", req.Method, req.URL)
+			msg := fmt.Sprintf("No recorded response for %s %s\n", req.Method, req.URL)
+			return NewResponse(req, http.StatusBadGateway, "text/plain; charset=utf-8", []byte(msg)), nil
+		}
+		return nil, io.NopCloser(bytes.NewReader(data))
+	}
+	if r.p.isVerbose() {
+		r.p.logger.Debug("Replaying recorded response for %s %s", req.Method, req.URL)
+	}
+	if !r.cfg.NoDelay {
+		time.Sleep(ex.wait)
+	}
+	resp := NewResponse(req, ex.status, "", ex.body)
+	resp.Status = fmt.Sprintf("%d %s", ex.status, ex.reason)
+	resp.Header = ex.header.Clone()
+	return resp, nil
+}
+
+// replayWebSocket serves a recorded WebSocket session to the client
+func (p *ProxyServer) replayWebSocket(w http.ResponseWriter, r *http.Request, ctx *ProxyCtx, ex *replayExchange, noDelay bool) {
+	ctx.Resp = &http.Response{
+		Status:     "101 Switching Protocols",
+		StatusCode: http.StatusSwitchingProtocols,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     ex.header.Clone(),
+		Body:       http.NoBody,
+		Request:    r,
+	}
+	ctx.flow.original(Response, nil)
+	p.runHandshake(Response, ctx)
+	responseHeader := http.Header{}
+	for k, vs := range ctx.Resp.Header {
+		if k != "Sec-Websocket-Extensions" &&
+			k != "Sec-Websocket-Protocol" &&
+			k != "Sec-Websocket-Accept" &&
+			k != "Upgrade" &&
+			k != "Connection" {
+			responseHeader[k] = vs
+		}
+	}
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	if proto := ex.header.Get("Sec-Websocket-Protocol"); proto != "" {
+		upgrader.Subprotocols = []string{proto}
+	}
+	clientConn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		p.logger.Error("Failed to upgrade WebSocket connection: %v", err)
+		return
+	}
+	defer clientConn.Close()
+
+	// 回放时没有上游连接，Session.Server 为 nil
+	session := &Session{Client: clientConn}
+	ctx.WSSession = session
+	defer p.trackSession(ctx)()
+	p.runHandles(Connected, []byte{}, ctx)
+
+	// 每条录制的客户端消息对应一次接收，缓冲足够时不会丢失
+	clientFrames := 0
+	for _, f := range ex.frames {
+		if f.fromClient {
+			clientFrames++
+		}
+	}
+	received := make(chan struct{}, clientFrames)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			messageType, message, err := clientConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			modifiedMessage := p.runHandles(Request, message, ctx)
+			ctx.flow.message(ClientToServer, messageType, message, modifiedMessage)
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	for _, f := range ex.frames {
+		if f.fromClient {
+			// 等待客户端发送录制中的下一条消息
+			select {
+			case <-received:
+			case <-done:
+				return
+			}
+			continue
+		}
+		if !noDelay && f.gap > 0 {
+			select {
+			case <-time.After(f.gap):
+			case <-done:
+				return
+			}
+		}
+		modifiedMessage := p.runHandles(Response, f.data, ctx)
+		ctx.flow.message(ServerToClient, f.msgType, f.data, modifiedMessage)
+		if err := session.send(ServerToClient, f.msgType, modifiedMessage); err != nil {
+			return
+		}
+	}
+	if p.isVerbose() {
+		p.logger.Debug("Replayed %d WebSocket messages for %s", len(ex.frames), r.URL)
+	}
+	// 录制的消息发送完毕后保持连接，直到客户端关闭
+	<-done
+}
@@ -0,0 +1,267 @@
+package gamemitm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordHAR runs fn against a recording proxy and returns the HAR files
+// once n entries are written
+func recordHAR(t *testing.T, n int, fn func(client *http.Client)) []string {
+	t.Helper()
+	p, client := newTestProxy(t)
+	dir := t.TempDir()
+	rec, err := p.RecordHAR(HARConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(client)
+	waitHAREntries(t, dir, n)
+	rec.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	return files
+}
+
+// replayProxy returns a proxy replaying files and its client
+func replayProxy(t *testing.T, cfg ReplayConfig) (*ProxyServer, *http.Client, *Replayer) {
+	t.Helper()
+	p, client := newTestProxy(t)
+	cfg.NoDelay = true
+	r, err := p.Replay(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return p, client, r
+}
+
+func TestReplayHTTP(t *testing.T) {
+	upstream, hits := countingServer(t)
+	files := recordHAR(t, 1, func(client *http.Client) {
+		doText(t, client, "POST", upstream.URL+"/login", `{"user":"a"}`)
+	})
+	recorded := hits.Load()
+
+	_, client, r := replayProxy(t, ReplayConfig{Files: files, Offline: true})
+	resp, body := doText(t, client, "POST", upstream.URL+"/login", `{"user":"a"}`)
+	if body != `{"user":"a"}` || resp.Header.Get("X-Method") != "POST" {
+		t.Fatalf("replayed %q, X-Method %q", body, resp.Header.Get("X-Method"))
+	}
+	if resp, _ := doText(t, client, "GET", upstream.URL+"/missing", ""); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d for a request missing from the recording", resp.StatusCode)
+	}
+	if hits.Load() != recorded {
+		t.Fatal("offline replay contacted the upstream server")
+	}
+	if u := r.Unmatched(); len(u) != 1 || u[0] != "GET "+upstream.URL+"/missing" {
+		t.Fatalf("Unmatched = %q", u)
+	}
+
+	r.Close()
+	doText(t, client, "GET", upstream.URL+"/missing", "")
+	if hits.Load() != recorded+1 {
+		t.Fatal("request not sent upstream after Close")
+	}
+}
+
+func TestReplayOrder(t *testing.T) {
+	var n atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, n.Add(1))
+	}))
+	defer upstream.Close()
+	files := recordHAR(t, 2, func(client *http.Client) {
+		doText(t, client, "GET", upstream.URL+"/counter", "")
+		doText(t, client, "GET", upstream.URL+"/counter", "")
+	})
+
+	// 按录制顺序应答，之后重复最后一个
+	_, client, _ := replayProxy(t, ReplayConfig{Files: files, Offline: true})
+	for _, want := range []string{"1", "2", "2"} {
+		if _, body := doText(t, client, "GET", upstream.URL+"/counter", ""); body != want {
+			t.Fatalf("body = %q, want %q", body, want)
+		}
+	}
+}
+
+func TestReplayStrategies(t *testing.T) {
+	parse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	tests := []struct {
+		name     string
+		strategy ReplayStrategy
+		a, b     string
+		bodyA    string
+		bodyB    string
+		same     bool
+	}{
+		{"exact query", ReplayExact(), "http://g.test/a?x=1", "http://g.test/a?x=2", "", "", false},
+		{"ignore query", ReplayIgnoreQuery(), "http://g.test/a?x=1", "http://g.test/a?x=2", "", "", true},
+		{"ignore fields", ReplayIgnoreJSONFields("ts"), "http://g.test/a?ts=1&u=2", "http://g.test/a?u=2&ts=9",
+			`{"ts":1,"x":{"ts":2,"y":1}}`, `{"x": {"y": 1, "ts": 5}, "ts": 9}`, true},
+		{"other fields differ", ReplayIgnoreJSONFields("ts"), "http://g.test/a", "http://g.test/a",
+			`{"ts":1,"y":1}`, `{"ts":1,"y":2}`, false},
+	}
+	for _, tt := range tests {
+		ka := tt.strategy("POST", parse(tt.a), []byte(tt.bodyA))
+		kb := tt.strategy("POST", parse(tt.b), []byte(tt.bodyB))
+		if (ka == kb) != tt.same {
+			t.Errorf("%s: keys %q and %q, same = %v", tt.name, ka, kb, ka == kb)
+		}
+	}
+}
+
+func TestReplayOversizedBody(t *testing.T) {
+	upstream, hits := countingServer(t)
+	files := recordHAR(t, 1, func(client *http.Client) {
+		doText(t, client, "POST", upstream.URL+"/upload", "small")
+	})
+	large := strings.Repeat("x", 100)
+
+	// 超出限制的请求体完整地发往上游
+	p, client, r := replayProxy(t, ReplayConfig{Files: files})
+	p.SetMaxBodySize(16)
+	before := hits.Load()
+	if _, body := doText(t, client, "POST", upstream.URL+"/upload", large); body != large {
+		t.Fatalf("upstream echoed %d bytes, want %d", len(body), len(large))
+	}
+	if hits.Load() != before+1 || len(r.Unmatched()) != 1 {
+		t.Fatalf("hits %d, unmatched %q", hits.Load()-before, r.Unmatched())
+	}
+
+	p, client, _ = replayProxy(t, ReplayConfig{Files: files, Offline: true})
+	p.SetMaxBodySize(16)
+	if resp, _ := doText(t, client, "POST", upstream.URL+"/upload", large); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d offline", resp.StatusCode)
+	}
+}
+
+// greetingWSServer sends "hello", reads two messages and answers "done"
+func greetingWSServer(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		for i := 0; i < 2; i++ {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte("done"))
+		conn.ReadMessage()
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReplayWebSocket(t *testing.T) {
+	upstream := greetingWSServer(t)
+	target := "ws" + strings.TrimPrefix(upstream.URL, "http") + "/ws"
+	session := func(conn *websocket.Conn) {
+		t.Helper()
+		conn.WriteMessage(websocket.TextMessage, []byte("a"))
+		conn.WriteMessage(websocket.TextMessage, []byte("b"))
+		for _, want := range []string{"hello", "done"} {
+			if _, data, err := conn.ReadMessage(); err != nil || string(data) != want {
+				t.Fatalf("received %q, %v, want %q", data, err, want)
+			}
+		}
+	}
+	files := recordHAR(t, 1, func(client *http.Client) {
+		conn, _ := dialWebSocket(t, client, target, nil)
+		session(conn)
+		conn.Close()
+	})
+	upstream.Close()
+
+	p, client, _ := replayProxy(t, ReplayConfig{Files: files, Offline: true})
+	// 发送 hello 时两条客户端消息都已到达，回放不能因为丢失其中一条而停住
+	p.OnResponse(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		if string(body) == "hello" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return body
+	})
+	conn, _ := dialWebSocket(t, client, target, nil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	session(conn)
+}
+
+func TestReplayIncompleteBodies(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(bytes.Repeat([]byte("a"), 1000))
+	zw.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compressed.Bytes())
+			return
+		}
+		w.Write(bytes.Repeat([]byte("b"), 1000))
+	}))
+	defer upstream.Close()
+
+	p, client := newTestProxy(t)
+	dir := t.TempDir()
+	rec, err := p.RecordHAR(HARConfig{Dir: dir, MaxBodySize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doText(t, client, "GET", upstream.URL+"/gzip", "")
+	doText(t, client, "GET", upstream.URL+"/big", "")
+	waitHAREntries(t, dir, 2)
+	rec.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+
+	// 解压后超出限制的内容仍是压缩的，回放时保留 Content-Encoding
+	_, client, _ = replayProxy(t, ReplayConfig{Files: files, Offline: true})
+	resp, body := doText(t, client, "GET", upstream.URL+"/gzip", "")
+	if resp.Header.Get("Content-Encoding") != "gzip" || body != compressed.String() {
+		t.Fatalf("replayed %d bytes with Content-Encoding %q", len(body), resp.Header.Get("Content-Encoding"))
+	}
+	// 截断的内容不回放
+	if resp, _ := doText(t, client, "GET", upstream.URL+"/big", ""); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d for a truncated recording", resp.StatusCode)
+	}
+}
+
+func TestReplayWebSocketInvalidUTF8(t *testing.T) {
+	upstream := wsEchoServer(t)
+	target := "ws" + strings.TrimPrefix(upstream.URL, "http") + "/ws"
+	invalid := []byte{0xff, 0xfe, 'x'}
+	files := recordHAR(t, 1, func(client *http.Client) {
+		conn, _ := dialWebSocket(t, client, target, nil)
+		conn.WriteMessage(websocket.TextMessage, invalid)
+		conn.ReadMessage()
+		conn.Close()
+	})
+
+	_, client, _ := replayProxy(t, ReplayConfig{Files: files, Offline: true})
+	conn, _ := dialWebSocket(t, client, target, nil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, invalid)
+	if msgType, data, err := conn.ReadMessage(); err != nil || msgType != websocket.TextMessage || !bytes.Equal(data, invalid) {
+		t.Fatalf("replayed %d %q, %v", msgType, data, err)
+	}
+}
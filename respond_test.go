@@ -0,0 +1,73 @@
+package gamemitm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// countingServer echoes requests and counts them
+func countingServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		echoHandler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func TestRespondWithoutUpstream(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream, hits := countingServer(t)
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		ctx.Respond(NewResponse(ctx.Req, http.StatusTeapot, "text/plain", []byte("local")))
+		return body
+	})
+	p.OnResponse(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return append(body, " answer"...)
+	})
+
+	resp, body := doText(t, client, "POST", upstream.URL, "x")
+	if resp.StatusCode != http.StatusTeapot || body != "local answer" {
+		t.Fatalf("got %d %q, want 418 %q", resp.StatusCode, body, "local answer")
+	}
+	if resp.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("upstream received %d requests", n)
+	}
+}
+
+func TestRespondOverHTTPS(t *testing.T) {
+	p, client := newTestProxy(t)
+	p.OnRequestMatch(Host("game.invalid")).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		ctx.Respond(NewResponse(ctx.Req, http.StatusOK, "", []byte("mocked")))
+		return body
+	})
+	// 目标无法解析，只有本地应答才能成功
+	p.SetMirrorTLS(false)
+	resp, body := doText(t, client, "GET", "https://game.invalid/", "")
+	if resp.StatusCode != http.StatusOK || body != "mocked" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestDropRequest(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream, hits := countingServer(t)
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		ctx.Drop()
+		return body
+	})
+
+	if resp, err := client.Get(upstream.URL); err == nil {
+		resp.Body.Close()
+		t.Fatalf("dropped request got a %d response", resp.StatusCode)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("upstream received %d requests", n)
+	}
+}
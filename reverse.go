@@ -0,0 +1,152 @@
+package gamemitm
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// ReverseTarget is the fixed upstream of a reverse proxy listener
+type ReverseTarget struct {
+	// Addr is the upstream address, "host:port"
+	Addr string
+	// ServerName is the certificate hostname for clients that send no SNI
+	// and the SNI sent upstream, the host of Addr when empty
+	ServerName string
+	// TLS connects to the upstream with TLS. Clients may connect with or
+	// without TLS either way, client TLS is always terminated.
+	TLS bool
+	// KeepHost forwards the Host header of the client unchanged, by default
+	// it is replaced with ServerName, or the host of Addr
+	KeepHost bool
+}
+
+// hostHeader returns the Host sent upstream, empty to keep the client's
+func (t ReverseTarget) hostHeader() string {
+	if t.KeepHost {
+		return ""
+	}
+	host, port, _ := net.SplitHostPort(t.Addr)
+	if t.ServerName != "" {
+		host = t.ServerName
+	}
+	// 默认端口不写入 Host
+	if (t.TLS && port == "443") || (!t.TLS && port == "80") {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// ListenReverse forwards every connection accepted on addr to target,
+// e.g. for a game client pointed at 127.0.0.1 through its hosts file or
+// config. HTTP, WebSocket and OnStream handlers run as for proxied
+// connections. It blocks until Stop is called.
+func (p *ProxyServer) ListenReverse(addr string, target ReverseTarget) error {
+	if _, _, err := net.SplitHostPort(target.Addr); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.trackListener(l)
+	p.logger.Info("Starting reverse proxy on %s for %s", addr, target.Addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.handleReverse(conn, target)
+	}
+}
+
+func (p *ProxyServer) handleReverse(clientConn net.Conn, target ReverseTarget) {
+	defer clientConn.Close()
+	p.trackConn(clientConn, target.Addr)
+	defer p.untrackConn(clientConn)
+	host := target.Addr
+	serverName := target.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(host)
+	}
+	scheme := "http"
+	if target.TLS {
+		scheme = "https"
+	}
+
+	reader := newSniffReader(clientConn)
+	first, err := peekWithin(clientConn, reader, 1, sniffTimeout)
+	if err != nil && !isTimeout(err) {
+		return
+	}
+	clientConn = &bufferedConn{Conn: clientConn, r: reader}
+	if err != nil {
+		// 客户端不先发言，按服务端先发言的协议转发
+		if p.isVerbose() {
+			p.logger.Debug("Reverse client of %s sent nothing, relaying", host)
+		}
+		p.reverseStream(clientConn, host, serverName, target.TLS)
+		return
+	}
+
+	var tlsConn *tls.Conn
+	if first[0] == recordTypeHandshake {
+		tlsConn = tls.Server(clientConn, p.serverTLSConfig(serverName))
+		if err := tlsConn.Handshake(); err != nil {
+			p.logger.Error("TLS handshake with client failed for %s: %v", host, err)
+			return
+		}
+		defer tlsConn.Close()
+		if sni := tlsConn.ConnectionState().ServerName; sni != "" && target.ServerName == "" {
+			serverName = sni
+		}
+		reader = bufio.NewReader(tlsConn)
+		clientConn = &bufferedConn{Conn: tlsConn, r: reader}
+	}
+
+	if ctx, handles := p.matchStream(host, serverName, target.TLS); handles != nil {
+		p.proxyStream(clientConn, ctx, handles)
+		return
+	}
+
+	transport := p.newTunnelTransport(host, serverName, nil)
+	defer transport.CloseIdleConnections()
+
+	if tlsConn != nil && tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		p.proxyH2(tlsConn, scheme, host, target.hostHeader(), transport)
+		return
+	}
+	if tlsConn != nil {
+		_, err := peekWithin(tlsConn, reader, 1, sniffTimeout)
+		if err != nil && !isTimeout(err) {
+			return
+		}
+		if err != nil {
+			p.reverseStream(clientConn, host, serverName, target.TLS)
+			return
+		}
+	}
+	if looksLikeHTTP(clientConn, reader) {
+		p.proxyHTTP1(clientConn, scheme, host, target.hostHeader(), transport)
+		return
+	}
+	if p.isVerbose() {
+		p.logger.Debug("Reverse connection to %s is not HTTP, relaying", host)
+	}
+	p.reverseStream(clientConn, host, serverName, target.TLS)
+}
+
+// reverseStream relays a reverse connection that is not HTTP, through the
+// OnStream handlers selecting it if any
+func (p *ProxyServer) reverseStream(clientConn net.Conn, host, serverName string, isTLS bool) {
+	if ctx, handles := p.matchStream(host, serverName, isTLS); handles != nil {
+		p.proxyStream(clientConn, ctx, handles)
+		return
+	}
+	ctx := &ProxyCtx{Proxy: p, Stream: &StreamSession{Host: host, ServerName: serverName, TLS: isTLS, framer: rawFramer{}}}
+	p.proxyStream(clientConn, ctx, nil)
+}
@@ -0,0 +1,94 @@
+package gamemitm
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startReverse runs a reverse proxy listener of p for target and returns
+// its address
+func startReverse(t *testing.T, p *ProxyServer, target ReverseTarget) string {
+	t.Helper()
+	addr := freeAddr(t)
+	go p.ListenReverse(addr, target)
+	waitListening(t, addr)
+	return addr
+}
+
+func TestReverseRewritesHost(t *testing.T) {
+	p, _ := newTestProxy(t)
+	upstream := echoServer(t)
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	addr := startReverse(t, p, ReverseTarget{Addr: upstream.Listener.Addr().String(), ServerName: "api.game.test"})
+
+	resp, _ := doText(t, http.DefaultClient, "GET", "http://"+addr+"/login", "")
+	if got, want := resp.Header.Get("X-Host"), "api.game.test:"+port; got != want {
+		t.Fatalf("upstream Host = %q, want %q", got, want)
+	}
+	if got := resp.Header.Get("X-Path"); got != "/login" {
+		t.Fatalf("upstream path = %q", got)
+	}
+}
+
+func TestReverseKeepHost(t *testing.T) {
+	p, _ := newTestProxy(t)
+	upstream := echoServer(t)
+	addr := startReverse(t, p, ReverseTarget{Addr: upstream.Listener.Addr().String(), KeepHost: true})
+
+	resp, _ := doText(t, http.DefaultClient, "GET", "http://"+addr+"/", "")
+	if got := resp.Header.Get("X-Host"); got != addr {
+		t.Fatalf("upstream Host = %q, want the client's %q", got, addr)
+	}
+}
+
+func TestReverseTerminatesClientTLS(t *testing.T) {
+	p, _ := newTestProxy(t)
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return append(body, " via reverse"...)
+	})
+	upstream := echoServer(t)
+	addr := startReverse(t, p, ReverseTarget{Addr: upstream.Listener.Addr().String(), ServerName: "api.game.test"})
+
+	// 客户端按 hosts 将域名指向本地，证书按配置的 ServerName 签发
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: caPool(p), ServerName: "api.game.test"},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	resp, body := doText(t, client, "POST", "https://"+addr+"/", "hello")
+	if body != "hello via reverse" {
+		t.Fatalf("body = %q", body)
+	}
+	if resp.TLS == nil {
+		t.Fatal("client connection is not TLS")
+	}
+}
+
+func TestReverseServerFirstProtocol(t *testing.T) {
+	p, _ := newTestProxy(t)
+	addr := startReverse(t, p, ReverseTarget{Addr: bannerServer(t)})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 客户端等待服务端先发言，代理需在探测超时后转发
+	conn.SetDeadline(time.Now().Add(sniffTimeout + 3*time.Second))
+	reader := bufio.NewReader(conn)
+	banner, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if banner != "220 ready\r\n" {
+		t.Fatalf("banner = %q", banner)
+	}
+	conn.Write([]byte("QUIT\r\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "QUIT\r\n" {
+		t.Fatalf("echo = %q, %v", line, err)
+	}
+}
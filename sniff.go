@@ -0,0 +1,242 @@
+package gamemitm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// recordTypeHandshake is the first byte of a TLS ClientHello record
+	recordTypeHandshake = 0x16
+	// maxClientHelloSize is a record header plus the largest record body
+	maxClientHelloSize = 5 + 16384
+
+	extensionServerName        = 0
+	extensionALPN              = 16
+	extensionSupportedVersions = 43
+
+	// sniffTimeout bounds the wait for the first bytes of a client, after
+	// it the server is assumed to speak first
+	sniffTimeout = 2 * time.Second
+)
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// clientHello holds the ClientHello fields the proxy cares about
+type clientHello struct {
+	serverName   string
+	alpn         []string
+	versions     []uint16
+	cipherSuites []uint16
+}
+
+// newSniffReader returns a reader large enough to peek a full ClientHello
+func newSniffReader(conn net.Conn) *bufio.Reader {
+	return bufio.NewReaderSize(conn, maxClientHelloSize)
+}
+
+// peekWithin peeks n bytes of reader, which reads from conn, waiting at
+// most d for them to arrive
+func peekWithin(conn net.Conn, reader *bufio.Reader, n int, d time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(d))
+	defer conn.SetReadDeadline(time.Time{})
+	return reader.Peek(n)
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// peekClientHello parses the ClientHello at the start of reader without
+// consuming it. Only ClientHellos fitting in the first record are parsed.
+func peekClientHello(reader *bufio.Reader) (*clientHello, error) {
+	header, err := reader.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != recordTypeHandshake {
+		return nil, errNotClientHello
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	record, err := reader.Peek(5 + length)
+	if err != nil {
+		return nil, err
+	}
+	return parseClientHello(record[5:])
+}
+
+func parseClientHello(data []byte) (*clientHello, error) {
+	s := &byteString{b: data}
+	var msgType uint8
+	var body byteString
+	if !s.readUint8(&msgType) || msgType != 1 || !s.readUint24Prefixed(&body) {
+		return nil, errNotClientHello
+	}
+	var sessionID, suites, compression, extensions byteString
+	if !body.skip(2+32) || !body.readUint8Prefixed(&sessionID) ||
+		!body.readUint16Prefixed(&suites) || !body.readUint8Prefixed(&compression) {
+		return nil, errNotClientHello
+	}
+	hello := &clientHello{}
+	for !suites.empty() {
+		var suite uint16
+		if !suites.readUint16(&suite) {
+			return nil, errNotClientHello
+		}
+		hello.cipherSuites = append(hello.cipherSuites, suite)
+	}
+	if body.empty() {
+		return hello, nil
+	}
+	if !body.readUint16Prefixed(&extensions) {
+		return nil, errNotClientHello
+	}
+	for !extensions.empty() {
+		var extType uint16
+		var ext byteString
+		if !extensions.readUint16(&extType) || !extensions.readUint16Prefixed(&ext) {
+			return nil, errNotClientHello
+		}
+		switch extType {
+		case extensionServerName:
+			var names byteString
+			if !ext.readUint16Prefixed(&names) {
+				return nil, errNotClientHello
+			}
+			for !names.empty() {
+				var nameType uint8
+				var name byteString
+				if !names.readUint8(&nameType) || !names.readUint16Prefixed(&name) {
+					return nil, errNotClientHello
+				}
+				if nameType == 0 {
+					hello.serverName = strings.TrimSuffix(string(name.b), ".")
+				}
+			}
+		case extensionALPN:
+			var protos byteString
+			if !ext.readUint16Prefixed(&protos) {
+				return nil, errNotClientHello
+			}
+			for !protos.empty() {
+				var proto byteString
+				if !protos.readUint8Prefixed(&proto) {
+					return nil, errNotClientHello
+				}
+				hello.alpn = append(hello.alpn, string(proto.b))
+			}
+		case extensionSupportedVersions:
+			var versions byteString
+			if !ext.readUint8Prefixed(&versions) {
+				return nil, errNotClientHello
+			}
+			for !versions.empty() {
+				var v uint16
+				if !versions.readUint16(&v) {
+					return nil, errNotClientHello
+				}
+				hello.versions = append(hello.versions, v)
+			}
+		}
+	}
+	return hello, nil
+}
+
+// httpMethods are the request methods recognised when sniffing plain HTTP
+var httpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// looksLikeHTTP reports whether the stream in reader, which reads from
+// conn, starts with an HTTP request line. More bytes are read while they
+// are a prefix of a method, at most until sniffTimeout, so a short message
+// such as "GE" is neither mistaken for HTTP nor blocks the client for long.
+func looksLikeHTTP(conn net.Conn, reader *bufio.Reader) bool {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for n := 1; ; n++ {
+		head, err := reader.Peek(n)
+		if err != nil {
+			return false
+		}
+		prefix := false
+		for _, m := range httpMethods {
+			if m == string(head) {
+				return true
+			}
+			if strings.HasPrefix(m, string(head)) {
+				prefix = true
+			}
+		}
+		if !prefix {
+			return false
+		}
+	}
+}
+
+// byteString is a minimal reader for TLS length-prefixed structures
+type byteString struct {
+	b []byte
+}
+
+func (s *byteString) empty() bool {
+	return len(s.b) == 0
+}
+
+func (s *byteString) skip(n int) bool {
+	if len(s.b) < n {
+		return false
+	}
+	s.b = s.b[n:]
+	return true
+}
+
+func (s *byteString) readUint8(v *uint8) bool {
+	if len(s.b) < 1 {
+		return false
+	}
+	*v = s.b[0]
+	s.b = s.b[1:]
+	return true
+}
+
+func (s *byteString) readUint16(v *uint16) bool {
+	if len(s.b) < 2 {
+		return false
+	}
+	*v = binary.BigEndian.Uint16(s.b)
+	s.b = s.b[2:]
+	return true
+}
+
+func (s *byteString) readPrefixed(size int, out *byteString) bool {
+	if len(s.b) < size {
+		return false
+	}
+	n := 0
+	for _, c := range s.b[:size] {
+		n = n<<8 | int(c)
+	}
+	if len(s.b) < size+n {
+		return false
+	}
+	out.b = s.b[size : size+n]
+	s.b = s.b[size+n:]
+	return true
+}
+
+func (s *byteString) readUint8Prefixed(out *byteString) bool {
+	return s.readPrefixed(1, out)
+}
+
+func (s *byteString) readUint16Prefixed(out *byteString) bool {
+	return s.readPrefixed(2, out)
+}
+
+func (s *byteString) readUint24Prefixed(out *byteString) bool {
+	return s.readPrefixed(3, out)
+}
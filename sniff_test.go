@@ -0,0 +1,129 @@
+package gamemitm
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{
+			ServerName: "login.game.test",
+			NextProtos: []string{"h2", "http/1.1"},
+			MinVersion: tls.VersionTLS12,
+		}).Handshake()
+		client.Close()
+	}()
+
+	hello, err := peekClientHello(newSniffReader(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.serverName != "login.game.test" {
+		t.Errorf("serverName = %q", hello.serverName)
+	}
+	if len(hello.alpn) != 2 || hello.alpn[0] != "h2" || hello.alpn[1] != "http/1.1" {
+		t.Errorf("alpn = %q", hello.alpn)
+	}
+	lo, hi := versionRange(hello.versions)
+	if lo != tls.VersionTLS12 || hi != tls.VersionTLS13 {
+		t.Errorf("versions %x..%x, want TLS 1.2..1.3", lo, hi)
+	}
+	if len(hello.cipherSuites) == 0 {
+		t.Error("no cipher suites parsed")
+	}
+}
+
+func TestPeekClientHelloRejectsOtherData(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+		client.Close()
+	}()
+	if _, err := peekClientHello(newSniffReader(server)); err != errNotClientHello {
+		t.Fatalf("err = %v, want errNotClientHello", err)
+	}
+}
+
+// sniffHTTP writes the chunks to one end of a pipe, waiting between them,
+// and runs looksLikeHTTP on the other end
+func sniffHTTP(chunks []string, pause time.Duration) bool {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		for _, c := range chunks {
+			io.WriteString(client, c)
+			time.Sleep(pause)
+		}
+		io.Copy(io.Discard, client)
+	}()
+	defer client.Close()
+	return looksLikeHTTP(server, bufio.NewReader(server))
+}
+
+func TestLooksLikeHTTP(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		want   bool
+	}{
+		{[]string{"GET / HTTP/1.1\r\n"}, true},
+		{[]string{"OPTIONS * HTTP/1.1\r\n"}, true},
+		{[]string{"G", "ET", " /"}, true},
+		{[]string{"GETX"}, false},
+		{[]string{"\x16\x03\x01"}, false},
+		{[]string{"HELLO"}, false},
+	}
+	for _, tt := range tests {
+		if got := sniffHTTP(tt.chunks, 10*time.Millisecond); got != tt.want {
+			t.Errorf("looksLikeHTTP(%q) = %v, want %v", tt.chunks, got, tt.want)
+		}
+	}
+}
+
+func TestLooksLikeHTTPShortMessage(t *testing.T) {
+	// 与方法名前缀相同的短消息最多等待 sniffTimeout，之后按非 HTTP 处理
+	start := time.Now()
+	if sniffHTTP([]string{"PO"}, 0) {
+		t.Fatal("two bytes were taken for HTTP")
+	}
+	if d := time.Since(start); d > sniffTimeout+time.Second {
+		t.Fatalf("sniffing took %v", d)
+	}
+}
+
+func TestCertificateUsesSNI(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+
+	// 隧道按 IP 建立，证书必须按 SNI 签发客户端才能验证通过
+	conn := tls.Client(connectTunnel(t, client, upstream.Listener.Addr().String()), &tls.Config{
+		RootCAs:    caPool(p),
+		ServerName: "login.game.test",
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "login.game.test" {
+		t.Fatalf("certificate issued for %q", cn)
+	}
+	io.WriteString(conn, "GET /sni HTTP/1.1\r\nHost: login.game.test\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Path") != "/sni" {
+		t.Fatalf("upstream answered %q", resp.Header.Get("X-Path"))
+	}
+}
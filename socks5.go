@@ -0,0 +1,524 @@
+package gamemitm
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSuccess             = 0x00
+	socks5RepFailure             = 0x01
+	socks5RepNetUnreachable      = 0x03
+	socks5RepHostUnreachable     = 0x04
+	socks5RepConnRefused         = 0x05
+	socks5RepCmdNotSupported     = 0x07
+	socks5RepAddrTypeUnsupported = 0x08
+)
+
+// SetSOCKS5Auth requires SOCKS5 clients to authenticate with username and
+// password, an empty username allows anonymous clients
+func (p *ProxyServer) SetSOCKS5Auth(username, password string) {
+	p.socksUser = username
+	p.socksPassword = password
+}
+
+// ListenSOCKS5 serves a SOCKS5 proxy on addr, e.g. ":1080". CONNECT streams
+// are intercepted like HTTPS tunnels and UDP ASSOCIATE datagrams are
+// relayed through the datagram handlers. It blocks until Stop is called.
+func (p *ProxyServer) ListenSOCKS5(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.trackListener(l)
+	p.logger.Info("Starting SOCKS5 server on %s", addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.handleSOCKS5(conn)
+	}
+}
+
+// trackListener registers l to be closed by Stop
+func (p *ProxyServer) trackListener(l io.Closer) {
+	p.listenerMu.Lock()
+	p.listeners = append(p.listeners, l)
+	p.listenerMu.Unlock()
+}
+
+func (p *ProxyServer) handleSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if err := p.socks5Handshake(reader, conn); err != nil {
+		p.logger.Error("SOCKS5 handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// 请求：VER CMD RSV ATYP DST.ADDR DST.PORT
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	if header[0] != socks5Version {
+		return
+	}
+	target, err := readSOCKS5Addr(reader)
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5RepAddrTypeUnsupported, nil)
+		return
+	}
+
+	switch header[1] {
+	case socks5CmdConnect:
+		if p.isVerbose() {
+			p.logger.Debug("SOCKS5 CONNECT %s from %s", target, conn.RemoteAddr())
+		}
+		// 先连接目标，客户端据此得知连接是否成功
+		upstream, err := p.dial(context.Background(), "tcp", target)
+		if err != nil {
+			p.logger.Error("Failed to connect to target server %s: %v", target, err)
+			writeSOCKS5Reply(conn, socks5ReplyCode(err), nil)
+			return
+		}
+		if err := writeSOCKS5Reply(conn, socks5RepSuccess, conn.LocalAddr()); err != nil {
+			upstream.Close()
+			return
+		}
+		p.interceptConn(&bufferedConn{Conn: conn, r: reader}, target, upstream)
+	case socks5CmdUDPAssociate:
+		p.socks5UDPAssociate(conn, reader)
+	default:
+		writeSOCKS5Reply(conn, socks5RepCmdNotSupported, nil)
+	}
+}
+
+// socks5ReplyCode maps a dial error to the REP field of the reply
+func socks5ReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr), isTimeout(err):
+		return socks5RepHostUnreachable
+	}
+	return socks5RepFailure
+}
+
+// socks5Handshake negotiates the authentication method
+func (p *ProxyServer) socks5Handshake(reader *bufio.Reader, conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return err
+	}
+	want := byte(socks5AuthNone)
+	if p.socksUser != "" {
+		want = socks5AuthPassword
+	}
+	accepted := false
+	for _, m := range methods {
+		if m == want {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return err
+	}
+	if want == socks5AuthNone {
+		return nil
+	}
+
+	// RFC 1929：VER ULEN UNAME PLEN PASSWD
+	ver, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	username, err := readSOCKS5String(reader)
+	if err != nil {
+		return err
+	}
+	password, err := readSOCKS5String(reader)
+	if err != nil {
+		return err
+	}
+	// 用户名和密码都参与比较，耗时不暴露哪一项或哪个字节不同
+	valid := subtle.ConstantTimeCompare([]byte(username), []byte(p.socksUser)) &
+		subtle.ConstantTimeCompare([]byte(password), []byte(p.socksPassword))
+	if ver != 0x01 || valid != 1 {
+		conn.Write([]byte{0x01, 0x01})
+		return errors.New("invalid username or password")
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	return err
+}
+
+// socks5UDPAssociate relays datagrams for the client until the control
+// connection is closed
+func (p *ProxyServer) socks5UDPAssociate(conn net.Conn, reader *bufio.Reader) {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	clientSocket, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		p.logger.Error("Failed to listen for SOCKS5 UDP: %v", err)
+		writeSOCKS5Reply(conn, socks5RepFailure, nil)
+		return
+	}
+	defer clientSocket.Close()
+	if err := writeSOCKS5Reply(conn, socks5RepSuccess, clientSocket.LocalAddr()); err != nil {
+		return
+	}
+	if p.isVerbose() {
+		p.logger.Debug("SOCKS5 UDP ASSOCIATE for %s on %s", conn.RemoteAddr(), clientSocket.LocalAddr())
+	}
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	flows := p.newUDPFlows()
+	defer flows.closeAll()
+
+	// 客户端 -> 服务器，回包由各个流自行转发
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := clientSocket.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !addr.IP.Equal(clientIP) {
+				continue
+			}
+			target, data, err := parseSOCKS5Datagram(buf[:n])
+			if err != nil {
+				continue
+			}
+			flows.fromClient(addr, target, data, func(from *net.UDPAddr, data []byte) error {
+				_, err := clientSocket.WriteToUDP(append(socks5DatagramHeader(from), data...), addr)
+				return err
+			})
+		}
+	}()
+
+	// 控制连接关闭时结束 UDP 转发
+	io.Copy(io.Discard, reader)
+}
+
+// readSOCKS5Addr reads ATYP DST.ADDR DST.PORT and returns "host:port"
+func readSOCKS5Addr(reader io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if atyp[0] == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(reader, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func readSOCKS5String(reader *bufio.Reader) (string, error) {
+	size, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// appendSOCKS5Addr appends ATYP BND.ADDR BND.PORT for addr
+func appendSOCKS5Addr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip16...)
+	} else {
+		b = append(b, socks5AtypIPv4, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func writeSOCKS5Reply(conn net.Conn, rep byte, bind net.Addr) error {
+	_, err := conn.Write(appendSOCKS5Addr([]byte{socks5Version, rep, 0x00}, bind))
+	return err
+}
+
+// parseSOCKS5Datagram parses RSV FRAG ATYP DST.ADDR DST.PORT DATA,
+// fragmented datagrams are not supported
+func parseSOCKS5Datagram(b []byte) (string, []byte, error) {
+	if len(b) < 4 || b[2] != 0 {
+		return "", nil, errors.New("invalid or fragmented SOCKS5 datagram")
+	}
+	r := &sliceReader{b: b[3:]}
+	target, err := readSOCKS5Addr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return target, r.b, nil
+}
+
+// appendSOCKS5Target appends ATYP DST.ADDR DST.PORT for target, host
+// names are sent as is for the proxy to resolve
+func appendSOCKS5Target(b []byte, target string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", target)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return appendSOCKS5Addr(b, &net.UDPAddr{IP: ip, Port: int(port)}), nil
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("host name too long: %q", host)
+	}
+	b = append(b, socks5AtypDomain, byte(len(host)))
+	b = append(b, host...)
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+func socks5DatagramHeader(from *net.UDPAddr) []byte {
+	return appendSOCKS5Addr([]byte{0, 0, 0}, from)
+}
+
+type sliceReader struct {
+	b []byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// socks5UDPConn relays datagrams to one target through the UDP relay of an
+// upstream SOCKS5 proxy, the association lasts while ctrl is open
+type socks5UDPConn struct {
+	// Conn is the socket connected to the relay
+	net.Conn
+	ctrl net.Conn
+	// header is RSV FRAG ATYP DST.ADDR DST.PORT of the target
+	header []byte
+	// remote is the server address reported by the relay
+	remote atomic.Pointer[net.UDPAddr]
+	buf    []byte
+}
+
+// dialSOCKS5UDP asks the SOCKS5 proxy u for a UDP association and returns
+// a socket sending to and receiving from target
+func dialSOCKS5UDP(u *url.URL, target string) (net.Conn, error) {
+	header, err := appendSOCKS5Target([]byte{0, 0, 0}, target)
+	if err != nil {
+		return nil, err
+	}
+	ctrl, err := net.DialTimeout("tcp", u.Host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(10 * time.Second))
+	relay, err := socks5ClientAssociate(ctrl, u.User)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+	conn, err := net.Dial("udp", relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	c := &socks5UDPConn{Conn: conn, ctrl: ctrl, header: header, buf: make([]byte, 65535)}
+	// 回包到达前先用目标地址，域名目标在收到回包后才知道服务器地址
+	remote := &net.UDPAddr{}
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		remote.IP = net.ParseIP(host)
+		remote.Port, _ = strconv.Atoi(port)
+	}
+	c.remote.Store(remote)
+	// 代理关闭控制连接时关联随之结束
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		conn.Close()
+	}()
+	return c, nil
+}
+
+// socks5ClientAssociate negotiates authentication and UDP ASSOCIATE on the
+// control connection, it returns the address of the relay
+func socks5ClientAssociate(ctrl net.Conn, user *url.Userinfo) (string, error) {
+	method := byte(socks5AuthNone)
+	if user != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := ctrl.Write([]byte{socks5Version, 1, method}); err != nil {
+		return "", err
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, reply[:2]); err != nil {
+		return "", err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return "", errors.New("upstream SOCKS5 proxy refused the authentication method")
+	}
+	if method == socks5AuthPassword {
+		// RFC 1929：VER ULEN UNAME PLEN PASSWD
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return "", errors.New("SOCKS5 username or password too long")
+		}
+		msg := append([]byte{0x01, byte(len(username))}, username...)
+		msg = append(append(msg, byte(len(password))), password...)
+		if _, err := ctrl.Write(msg); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(ctrl, reply[:2]); err != nil {
+			return "", err
+		}
+		if reply[1] != 0x00 {
+			return "", errors.New("upstream SOCKS5 proxy rejected the credentials")
+		}
+	}
+
+	// 客户端地址未知，按 RFC 1928 填 0.0.0.0:0
+	req := appendSOCKS5Addr([]byte{socks5Version, socks5CmdUDPAssociate, 0x00}, &net.UDPAddr{IP: net.IPv4zero})
+	if _, err := ctrl.Write(req); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return "", err
+	}
+	if reply[0] != socks5Version || reply[1] != socks5RepSuccess {
+		return "", fmt.Errorf("upstream SOCKS5 proxy refused UDP ASSOCIATE, reply %d", reply[1])
+	}
+	relay, err := readSOCKS5Addr(ctrl)
+	if err != nil {
+		return "", err
+	}
+	// 未指定的中继地址表示与控制连接相同的主机
+	host, port, _ := net.SplitHostPort(relay)
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		relay = net.JoinHostPort(ctrl.RemoteAddr().(*net.TCPAddr).IP.String(), port)
+	}
+	return relay, nil
+}
+
+// Read returns the payload of the next datagram from the relay
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		from, data, err := parseSOCKS5Datagram(c.buf[:n])
+		if err != nil {
+			continue
+		}
+		if host, port, err := net.SplitHostPort(from); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				p, _ := strconv.Atoi(port)
+				c.remote.Store(&net.UDPAddr{IP: ip, Port: p})
+			}
+		}
+		return copy(b, data), nil
+	}
+}
+
+// Write sends b to the target through the relay
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	// header 容量已满，append 总会分配新切片，可并发写
+	if _, err := c.Conn.Write(append(c.header[:len(c.header):len(c.header)], b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5UDPConn) RemoteAddr() net.Addr {
+	return c.remote.Load()
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,192 @@
+package gamemitm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// freeAddr returns a local address nobody listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// waitListening waits until something accepts connections on addr
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("nothing listens on %s", addr)
+}
+
+// startSOCKS5 runs the SOCKS5 listener of p and returns its address
+func startSOCKS5(t *testing.T, p *ProxyServer) string {
+	t.Helper()
+	addr := freeAddr(t)
+	go p.ListenSOCKS5(addr)
+	waitListening(t, addr)
+	return addr
+}
+
+// socks5Connect sends a CONNECT for target without authentication and
+// returns the reply code
+func socks5Connect(t *testing.T, socksAddr, target string) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	host, portText, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portText)
+	req := []byte{socks5Version, 1, socks5AuthNone, socks5Version, socks5CmdConnect, 0, socks5AtypDomain, byte(len(host))}
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	// 方法选择 2 字节，应答头 4 字节加 IPv4 地址和端口
+	reply := make([]byte, 2+4+4+2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply[3]
+}
+
+func TestSOCKS5ConnectInterceptsHTTP(t *testing.T) {
+	p := NewProxy()
+	p.SetLogger(discardLogger{})
+	p.SetVerbose(false)
+	defer p.Stop()
+	socksAddr := startSOCKS5(t, p)
+	upstream := echoServer(t)
+	p.OnRequest(All).Do(func(body []byte, ctx *ProxyCtx) []byte {
+		return append(body, " via socks"...)
+	})
+
+	dialer, err := proxy.SOCKS5("tcp", socksAddr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{Dial: dialer.Dial}}
+	_, body := doText(t, client, "POST", upstream.URL, "hello")
+	if body != "hello via socks" {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestSOCKS5ReplyCodes(t *testing.T) {
+	p := NewProxy()
+	p.SetLogger(discardLogger{})
+	defer p.Stop()
+	socksAddr := startSOCKS5(t, p)
+
+	// 目标端口无人监听时应答连接被拒绝，而不是先应答成功
+	if _, rep := socks5Connect(t, socksAddr, freeAddr(t)); rep != socks5RepConnRefused {
+		t.Fatalf("REP = %#x for a closed port, want %#x", rep, socks5RepConnRefused)
+	}
+	if _, rep := socks5Connect(t, socksAddr, "no-such-host.invalid:80"); rep != socks5RepHostUnreachable {
+		t.Fatalf("REP = %#x for an unknown host, want %#x", rep, socks5RepHostUnreachable)
+	}
+	upstream := echoServer(t)
+	if _, rep := socks5Connect(t, socksAddr, upstream.Listener.Addr().String()); rep != socks5RepSuccess {
+		t.Fatalf("REP = %#x for a reachable target", rep)
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	p := NewProxy()
+	p.SetLogger(discardLogger{})
+	p.SetSOCKS5Auth("user", "secret")
+	defer p.Stop()
+	socksAddr := startSOCKS5(t, p)
+	upstream := echoServer(t)
+	target := upstream.Listener.Addr().String()
+
+	for _, auth := range []proxy.Auth{{User: "user", Password: "wrong"}, {User: "other", Password: "secret"}, {User: "use", Password: "secret"}} {
+		bad, _ := proxy.SOCKS5("tcp", socksAddr, &auth, proxy.Direct)
+		if conn, err := bad.Dial("tcp", target); err == nil {
+			conn.Close()
+			t.Fatalf("credentials %s/%s were accepted", auth.User, auth.Password)
+		}
+	}
+	anonymous, _ := proxy.SOCKS5("tcp", socksAddr, nil, proxy.Direct)
+	if conn, err := anonymous.Dial("tcp", target); err == nil {
+		conn.Close()
+		t.Fatal("anonymous client was accepted")
+	}
+	good, _ := proxy.SOCKS5("tcp", socksAddr, &proxy.Auth{User: "user", Password: "secret"}, proxy.Direct)
+	conn, err := good.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// bannerServer greets every client first, like SMTP or MySQL, then echoes
+// lines
+func bannerServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "220 ready\r\n")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestServerFirstProtocol(t *testing.T) {
+	p := NewProxy()
+	p.SetLogger(discardLogger{})
+	p.SetVerbose(false)
+	defer p.Stop()
+	socksAddr := startSOCKS5(t, p)
+	target := bannerServer(t)
+
+	conn, rep := socks5Connect(t, socksAddr, target)
+	if rep != socks5RepSuccess {
+		t.Fatalf("REP = %#x", rep)
+	}
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout + 5*time.Second))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "220 ready\r\n" {
+		t.Fatalf("banner = %q, %v", line, err)
+	}
+	io.WriteString(conn, "PING\r\n")
+	if line, err = reader.ReadString('\n'); err != nil || strings.TrimSpace(line) != "PING" {
+		t.Fatalf("echo = %q, %v", line, err)
+	}
+}
@@ -0,0 +1,192 @@
+package gamemitm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// MessageHandle inspects a message of a raw TCP stream and returns the
+// message to forward, returning nil drops it
+type MessageHandle func(msg []byte, dir Direction, ctx *ProxyCtx) []byte
+
+// StreamSession is an intercepted TCP stream, it is the counterpart of
+// Session for custom protocols
+type StreamSession struct {
+	// Host is the target address, "host:port"
+	Host string
+	// ServerName is the SNI sent by the client, empty for plain TCP
+	ServerName string
+	// TLS reports whether the stream was decrypted
+	TLS    bool
+	Client net.Conn
+	Server net.Conn
+
+	framer   Framer
+	clientMu sync.Mutex
+	serverMu sync.Mutex
+	// observe reports the bytes written in either direction
+	observe func(dir Direction, data []byte)
+}
+
+// SendToServer injects msg, framed by the stream framer, to the server
+func (s *StreamSession) SendToServer(msg []byte) error {
+	return s.send(ClientToServer, msg)
+}
+
+// SendToClient injects msg, framed by the stream framer, to the client
+func (s *StreamSession) SendToClient(msg []byte) error {
+	return s.send(ServerToClient, msg)
+}
+
+// Close closes both sides of the stream
+func (s *StreamSession) Close() error {
+	s.Server.Close()
+	return s.Client.Close()
+}
+
+// send writes msg framed in dir with a single write
+func (s *StreamSession) send(dir Direction, msg []byte) error {
+	conn, mu := s.Server, &s.serverMu
+	if dir == ServerToClient {
+		conn, mu = s.Client, &s.clientMu
+	}
+	var buf bytes.Buffer
+	if err := s.framer.WriteMessage(&buf, msg); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if s.observe != nil {
+		s.observe(dir, buf.Bytes())
+	}
+	return nil
+}
+
+// streamHandlers returns the stream handlers matching ctx and the framer
+// to use, nil if no handler matches
+func (p *ProxyServer) streamHandlers(ctx *ProxyCtx) ([]*handleEntry, Framer) {
+	var handles []*handleEntry
+	var framer Framer
+	for _, e := range p.Handlers().chain(Stream) {
+		if e.message == nil || !e.matcher.Match(ctx) {
+			continue
+		}
+		handles = append(handles, e)
+		if framer == nil {
+			framer = e.framer
+		}
+	}
+	if framer == nil {
+		framer = rawFramer{}
+	}
+	return handles, framer
+}
+
+// proxyStream relays the stream of ctx between clientConn and the target,
+// running the stream handlers on every message
+func (p *ProxyServer) proxyStream(clientConn net.Conn, ctx *ProxyCtx, handles []*handleEntry) {
+	s := ctx.Stream
+	// 镜像握手时上游连接已经建立
+	serverConn := s.Server
+	if serverConn == nil {
+		var err error
+		serverConn, err = p.dial(context.Background(), "tcp", s.Host)
+		if err != nil {
+			p.logger.Error("Failed to connect to target server %s: %v", s.Host, err)
+			return
+		}
+		if s.TLS {
+			tlsConn := tls.Client(serverConn, p.upstreamTLSConfig(s.Host, s.ServerName, nil))
+			if err := tlsConn.Handshake(); err != nil {
+				p.logger.Error("TLS handshake with %s failed: %v", s.Host, err)
+				serverConn.Close()
+				return
+			}
+			serverConn = tlsConn
+		}
+	}
+	defer serverConn.Close()
+	s.Client, s.Server = clientConn, serverConn
+	ctx.ClientTLS = connState(clientConn)
+	ctx.UpstreamTLS = connState(serverConn)
+	if observers := p.streamObservers(); observers != nil {
+		s.observe = func(dir Direction, data []byte) {
+			for _, o := range observers {
+				o.ObserveStream(ctx, dir, data)
+			}
+		}
+		defer func() {
+			for _, o := range observers {
+				o.StreamClosed(ctx)
+			}
+		}()
+	}
+
+	if p.isVerbose() {
+		p.logger.Debug("Intercepting TCP stream to %s with %d handlers", s.Host, len(handles))
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		p.pipeStream(ctx, handles, ClientToServer)
+		done <- struct{}{}
+	}()
+	go func() {
+		p.pipeStream(ctx, handles, ServerToClient)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// pipeStream forwards the messages of one direction of the stream
+func (p *ProxyServer) pipeStream(ctx *ProxyCtx, handles []*handleEntry, dir Direction) {
+	s := ctx.Stream
+	src, dst := s.Client, s.Server
+	if dir == ServerToClient {
+		src, dst = s.Server, s.Client
+	}
+	reader := bufio.NewReader(src)
+	for {
+		msg, err := s.framer.ReadMessage(reader)
+		if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				closeWrite(dst)
+				return
+			}
+			// 分帧失败后无法继续解析，关闭整个连接
+			p.logger.Error("Failed to read %s message from %s: %v", dir, s.Host, err)
+			s.Close()
+			return
+		}
+		for _, e := range handles {
+			if msg = e.message(msg, dir, ctx); msg == nil {
+				break
+			}
+		}
+		if msg == nil {
+			continue
+		}
+		if err := s.send(dir, msg); err != nil {
+			s.Close()
+			return
+		}
+	}
+}
+
+// connState returns the TLS state of conn, nil if it is not a TLS connection
+func connState(conn net.Conn) *tls.ConnectionState {
+	if tlsConn, ok := unwrapConn(conn).(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return &state
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package gamemitm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFramersRoundTrip(t *testing.T) {
+	framers := map[string]Framer{
+		"length prefix":           &LengthPrefixFramer{Size: 2},
+		"length prefix inclusive": &LengthPrefixFramer{Size: 4, ByteOrder: binary.LittleEndian, Inclusive: true},
+		"delimiter":               &DelimiterFramer{Delimiter: []byte("\r\n")},
+	}
+	messages := [][]byte{[]byte("header+hello"), []byte("header"), []byte("header" + strings.Repeat("x", 300))}
+	for name, f := range framers {
+		var buf bytes.Buffer
+		for _, m := range messages {
+			if err := f.WriteMessage(&buf, m); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		r := bufio.NewReader(&buf)
+		for _, want := range messages {
+			got, err := f.ReadMessage(r)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s: read %q, want %q", name, got, want)
+			}
+		}
+		if _, err := f.ReadMessage(r); err != io.EOF {
+			t.Fatalf("%s: err = %v at the end, want io.EOF", name, err)
+		}
+	}
+}
+
+func TestFramerErrors(t *testing.T) {
+	// 长度超过上限
+	big := &LengthPrefixFramer{Size: 4, MaxSize: 8}
+	if _, err := big.ReadMessage(bufio.NewReader(bytes.NewReader([]byte{0, 0, 1, 0}))); err == nil {
+		t.Error("oversized frame accepted")
+	}
+	// 截断的帧不是正常结束
+	short := &LengthPrefixFramer{Size: 1}
+	if _, err := short.ReadMessage(bufio.NewReader(bytes.NewReader([]byte{5, 'a'}))); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated frame: err = %v, want io.ErrUnexpectedEOF", err)
+	}
+	fixed := &FixedHeaderFramer{HeaderSize: 4, LengthOffset: 2, LengthSize: 2}
+	if err := fixed.WriteMessage(io.Discard, []byte("ab")); err == nil {
+		t.Error("message shorter than the header accepted")
+	}
+
+	// 无效的配置返回错误而不是 panic
+	invalid := map[string]Framer{
+		"negative size":   &LengthPrefixFramer{Size: -1},
+		"size 3":          &LengthPrefixFramer{Size: 3},
+		"length size 0":   &FixedHeaderFramer{HeaderSize: 4},
+		"negative offset": &FixedHeaderFramer{HeaderSize: 4, LengthOffset: -2, LengthSize: 2},
+		"negative header": &FixedHeaderFramer{HeaderSize: -4, LengthOffset: -4, LengthSize: 2},
+		"outside header":  &FixedHeaderFramer{HeaderSize: 4, LengthOffset: 3, LengthSize: 2},
+	}
+	for name, f := range invalid {
+		if _, err := f.ReadMessage(bufio.NewReader(bytes.NewReader([]byte("abcdefgh")))); err == nil {
+			t.Errorf("%s: read accepted", name)
+		}
+		if err := f.WriteMessage(io.Discard, []byte("abcdefgh")); err == nil {
+			t.Errorf("%s: write accepted", name)
+		}
+	}
+}
+
+func TestFixedHeaderFramerRewritesLength(t *testing.T) {
+	f := &FixedHeaderFramer{HeaderSize: 4, LengthOffset: 0, LengthSize: 2}
+	var buf bytes.Buffer
+	// 处理函数加长了消息，长度字段仍为旧值
+	if err := f.WriteMessage(&buf, []byte{0, 1, 9, 9, 'a', 'b', 'c'}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes(); binary.BigEndian.Uint16(got) != 3 {
+		t.Fatalf("length field = %d, want 3", binary.BigEndian.Uint16(got))
+	}
+}
+
+// frameEchoServer echoes every line back with an "echo:" prefix
+func frameEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, "echo:"+line)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestOnStreamMessages(t *testing.T) {
+	p, client := newTestProxy(t)
+	target := frameEchoServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	p.OnStream(Port(portNum)).Framer(&DelimiterFramer{Delimiter: []byte("\n")}).Do(func(msg []byte, dir Direction, ctx *ProxyCtx) []byte {
+		switch {
+		case dir == ClientToServer && string(msg) == "drop":
+			return nil
+		case dir == ClientToServer && string(msg) == "inject":
+			ctx.Stream.SendToClient([]byte("injected"))
+			return nil
+		case dir == ServerToClient:
+			return append(msg, " [seen]"...)
+		}
+		return bytes.ToUpper(msg)
+	})
+
+	conn := connectTunnel(t, client, target)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, step := range []struct{ send, want string }{
+		{"hello\n", "echo:HELLO [seen]"},
+		{"drop\ninject\n", "injected"},
+		{"bye\n", "echo:BYE [seen]"},
+	} {
+		io.WriteString(conn, step.send)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSuffix(line, "\n"); got != step.want {
+			t.Fatalf("after %q got %q, want %q", step.send, got, step.want)
+		}
+	}
+}
+
+func TestOnStreamServerFirst(t *testing.T) {
+	p, client := newTestProxy(t)
+	target := bannerServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	p.OnStream(Port(portNum)).Do(func(msg []byte, dir Direction, ctx *ProxyCtx) []byte {
+		if dir == ServerToClient {
+			return bytes.ReplaceAll(msg, []byte("ready"), []byte("hooked"))
+		}
+		return msg
+	})
+
+	// 客户端等待服务端先发送问候语
+	conn := connectTunnel(t, client, target)
+	conn.SetDeadline(time.Now().Add(sniffTimeout + 5*time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "220 hooked\r\n" {
+		t.Fatalf("banner = %q, %v", line, err)
+	}
+}
@@ -0,0 +1,89 @@
+package gamemitm
+
+import (
+	"errors"
+	"net"
+)
+
+// TransparentMode selects how the original destination of a transparently
+// intercepted connection is recovered
+type TransparentMode int
+
+const (
+	// TransparentRedirect is used with iptables REDIRECT, the destination
+	// is read with SO_ORIGINAL_DST
+	TransparentRedirect TransparentMode = iota
+	// TransparentTProxy is used with iptables TPROXY, the destination is
+	// the local address of the accepted socket
+	TransparentTProxy
+)
+
+// ListenTransparent serves connections redirected to addr by the firewall,
+// e.g. with
+//
+//	iptables -t nat -A OUTPUT -p tcp -m owner ! --uid-owner proxy -j REDIRECT --to-ports 12312
+//
+// TLS, plain HTTP and other TCP streams are told apart by their first
+// bytes, as in a CONNECT tunnel. It is only supported on Linux and blocks
+// until Stop is called.
+func (p *ProxyServer) ListenTransparent(addr string, mode TransparentMode) error {
+	l, err := listenTransparent(addr, mode)
+	if err != nil {
+		return err
+	}
+	p.trackListener(l)
+	p.logger.Info("Starting transparent proxy on %s", addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.handleTransparent(conn, mode, l.Addr().(*net.TCPAddr))
+	}
+}
+
+func (p *ProxyServer) handleTransparent(conn net.Conn, mode TransparentMode, listenAddr *net.TCPAddr) {
+	defer conn.Close()
+	dst, err := originalDst(conn, mode)
+	if err != nil {
+		p.logger.Error("Failed to get original destination of %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	// 直接连接到监听端口的请求没有原始目标，转发会形成回环
+	if isListenAddr(dst, listenAddr) {
+		p.logger.Warn("Connection from %s was not redirected, closing", conn.RemoteAddr())
+		return
+	}
+	if p.isVerbose() {
+		p.logger.Debug("Transparent connection from %s to %s", conn.RemoteAddr(), dst)
+	}
+	p.interceptConn(conn, dst.String(), nil)
+}
+
+// isListenAddr reports whether dst is the address the listener at
+// listenAddr accepts on. With TPROXY the local address of a connection is
+// its original destination, so it cannot be compared with dst.
+func isListenAddr(dst, listenAddr *net.TCPAddr) bool {
+	if dst.Port != listenAddr.Port {
+		return false
+	}
+	if !listenAddr.IP.IsUnspecified() {
+		return dst.IP.Equal(listenAddr.IP)
+	}
+	if dst.IP.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
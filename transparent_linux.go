@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package gamemitm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	soOriginalDst = 80
+	// ipv6Transparent is IPV6_TRANSPARENT, missing from package syscall
+	ipv6Transparent = 75
+)
+
+func listenTransparent(addr string, mode TransparentMode) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if mode == TransparentTProxy {
+		// TPROXY 需要 IP_TRANSPARENT 才能接受目标地址不属于本机的连接
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if err == nil && network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func originalDst(conn net.Conn, mode TransparentMode) (*net.TCPAddr, error) {
+	if mode == TransparentTProxy {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	isIPv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+
+	var dst *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if isIPv4 {
+			// 结果为 sockaddr_in：family(2) port(2) addr(4)
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			sa := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+				Port: int(sa[2])<<8 | int(sa[3]),
+			}
+			return
+		}
+		// 结果为 sockaddr_in6，借用 IPv6MTUInfo 的内存布局读取
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		dst = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errors.Is(serr, syscall.ENOENT) {
+		// conntrack 中没有记录，说明连接没有经过 REDIRECT
+		return nil, errors.New("connection was not redirected")
+	}
+	return dst, serr
+}
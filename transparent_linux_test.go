@@ -0,0 +1,74 @@
+package gamemitm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsListenAddr(t *testing.T) {
+	listen := &net.TCPAddr{IP: net.IPv4zero, Port: 12312}
+	tests := []struct {
+		dst, listen *net.TCPAddr
+		want        bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12312}, listen, true},
+		{&net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 12312}, listen, false},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}, listen, false},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}, true},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 80}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}, false},
+	}
+	for _, tt := range tests {
+		if got := isListenAddr(tt.dst, tt.listen); got != tt.want {
+			t.Errorf("isListenAddr(%v, %v) = %v, want %v", tt.dst, tt.listen, got, tt.want)
+		}
+	}
+}
+
+// startTransparent runs the transparent listener of p and returns its
+// address, the test is skipped without the needed privileges
+func startTransparent(t *testing.T, p *ProxyServer, mode TransparentMode) string {
+	addr := freeAddr(t)
+	errc := make(chan error, 1)
+	go func() { errc <- p.ListenTransparent(addr, mode) }()
+	for i := 0; i < 100; i++ {
+		select {
+		case err := <-errc:
+			if errors.Is(err, syscall.EPERM) {
+				t.Skip("IP_TRANSPARENT needs CAP_NET_ADMIN")
+			}
+			t.Fatal(err)
+		default:
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("transparent listener on %s did not start", addr)
+	return ""
+}
+
+func TestTransparentClosesDirectConnections(t *testing.T) {
+	for _, mode := range []TransparentMode{TransparentRedirect, TransparentTProxy} {
+		p := NewProxy()
+		p.SetLogger(discardLogger{})
+		addr := startTransparent(t, p, mode)
+
+		// 未经防火墙重定向的连接没有原始目标，应直接关闭而不是转发给自己
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("mode %d: read %d bytes, %v, want the connection closed", mode, n, err)
+		}
+		conn.Close()
+		p.Stop()
+	}
+}
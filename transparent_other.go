@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package gamemitm
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy mode is only supported on Linux")
+
+func listenTransparent(addr string, mode TransparentMode) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDst(conn net.Conn, mode TransparentMode) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
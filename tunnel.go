@@ -1,9 +1,14 @@
 package gamemitm
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
+	"io"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -41,54 +46,268 @@ func (p *ProxyServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
 	}
 	defer clientConn.Close()
 
-	// Get certificate for this domain
-	cert, err := p.certManager.GetCertificateForDomain(host)
-	if err != nil {
-		p.logger.Error("Failed to generate certificate for %s: %v", host, err)
+	p.interceptConn(clientConn, host, nil)
+}
+
+// interceptConn intercepts a client connection to host ("host:port"). The
+// protocol is sniffed from the first bytes: TLS is decrypted using the
+// ClientHello SNI for the certificate and the upstream ServerName, streams
+// selected by OnStream go through the stream handlers, plain HTTP goes
+// through the request handlers and anything else is relayed to host
+// unchanged. A client that sends nothing within sniffTimeout is treated as
+// a server-first protocol and goes through the stream handlers or the
+// relay. dialed, when not nil, is a connection to host made in advance that
+// the first upstream connection uses.
+func (p *ProxyServer) interceptConn(clientConn net.Conn, host string, dialed net.Conn) {
+	p.trackConn(clientConn, host)
+	defer p.untrackConn(clientConn)
+	raw := &preConn{conn: dialed}
+	defer raw.Close()
+	// 在读取数据前判断，服务端先发言的协议也能直接转发
+	if p.passthroughListed(host, "") {
+		p.reportPassthrough(host, "", PassthroughListed)
+		p.relay(clientConn, host, raw)
 		return
 	}
 
-	// Create TLS config for client connection
-	config := &tls.Config{
-		Certificates: []tls.Certificate{*cert},
+	reader := newSniffReader(clientConn)
+	first, err := peekWithin(clientConn, reader, 1, sniffTimeout)
+	if err != nil && !isTimeout(err) {
+		return
+	}
+	clientConn = &bufferedConn{Conn: clientConn, r: reader}
+	if err != nil || first[0] != recordTypeHandshake {
+		if ctx, handles := p.matchStream(host, "", false); handles != nil {
+			ctx.Stream.Server = raw.take()
+			p.proxyStream(clientConn, ctx, handles)
+			return
+		}
+		if err != nil {
+			if p.isVerbose() {
+				p.logger.Debug("Client of %s sent nothing, relaying", host)
+			}
+			p.relay(clientConn, host, raw)
+			return
+		}
+		if looksLikeHTTP(clientConn, reader) {
+			if p.isVerbose() {
+				p.logger.Debug("Connection to %s is plain HTTP", host)
+			}
+			// 明文 HTTP 使用连接池，预先建立的连接用不上
+			raw.Close()
+			p.proxyHTTP1(clientConn, "http", host, "", p.transport)
+			return
+		}
+		if p.isVerbose() {
+			p.logger.Debug("Connection to %s is neither TLS nor HTTP, relaying", host)
+		}
+		p.relay(clientConn, host, raw)
+		return
+	}
+
+	// 客户端可能按 IP 建立隧道，证书以 SNI 为准
+	var serverName string
+	hello, err := peekClientHello(reader)
+	if err == nil {
+		serverName = hello.serverName
+	}
+	if p.isVerbose() && serverName != "" {
+		p.logger.Debug("ClientHello for %s has SNI %s", host, serverName)
 	}
+	if serverName != "" && p.passthroughListed(host, serverName) {
+		p.reportPassthrough(host, serverName, PassthroughListed)
+		p.relay(clientConn, host, raw)
+		return
+	}
+	// 客户端曾拒绝我们的证书（证书固定），直接转发原始数据
+	if p.passthroughLearned(host, serverName) {
+		p.reportPassthrough(host, serverName, PassthroughLearned)
+		p.relay(clientConn, host, raw)
+		return
+	}
+
+	// 先与上游握手，再按上游协商的结果回应客户端
+	config := p.serverTLSConfig(host)
+	upstream := &preConn{}
+	defer upstream.Close()
+	if hello != nil && !p.noMirrorTLS {
+		conn, err := p.connectUpstreamTLS(host, hello, raw)
+		var certErr *UpstreamCertError
+		switch {
+		case errors.As(err, &certErr):
+			// 证书已被拒绝并报告，之后的请求直接失败，不再重新连接
+			upstream.fail(certErr)
+		case conn != nil:
+			mirrorTLS(config, conn.ConnectionState())
+			upstream.conn = conn
+		}
+	}
+	raw.Close()
 
 	// Create TLS connection with client
 	tlsConn := tls.Server(clientConn, config)
 	if err := tlsConn.Handshake(); err != nil {
 		p.logger.Error("TLS handshake with client failed for %s: %v", host, err)
+		if p.learnPassthrough(host, serverName, err) {
+			p.reportPassthrough(host, serverName, PassthroughHandshakeFailed)
+		}
 		return
 	}
 	defer tlsConn.Close()
+	// 证书固定的客户端在握手后才校验证书，不通过时不发数据直接断开
+	clientTLS := p.watchPinnedClose(tlsConn, host, serverName)
 
-	// Create dialer with timeout
-	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	// 上游连接按需建立，并在同一隧道的多个请求间复用
+	transport := p.newTunnelTransport(host, serverName, upstream)
+	defer transport.CloseIdleConnections()
 
-	// Connect to destination server
-	destConn, err := dialer.Dial("tcp", host)
-	if err != nil {
-		p.logger.Error("Failed to connect to target server %s: %v", host, err)
+	if ctx, handles := p.matchStream(host, serverName, true); handles != nil {
+		if upstream.failed() != nil {
+			return
+		}
+		ctx.Stream.Server = upstream.take()
+		p.proxyStream(clientTLS, ctx, handles)
 		return
 	}
-	defer destConn.Close()
-	serverName := host
-	if h, _, err := net.SplitHostPort(serverName); err == nil {
-		serverName = h
+
+	// Process HTTPS requests
+	switch tlsConn.ConnectionState().NegotiatedProtocol {
+	case "h2":
+		if p.isVerbose() {
+			p.logger.Debug("Serving HTTP/2 for %s", host)
+		}
+		p.proxyH2(clientTLS, "https", host, "", transport)
+	case "http/1.1":
+		p.proxyHTTP1(clientTLS, "https", host, "", transport)
+	default:
+		// 没有协商 ALPN 时根据解密后的数据判断是否为 HTTP
+		tlsReader := bufio.NewReader(clientTLS)
+		_, err := peekWithin(clientTLS, tlsReader, 1, sniffTimeout)
+		if err != nil && !isTimeout(err) {
+			return
+		}
+		conn := &bufferedConn{Conn: clientTLS, r: tlsReader}
+		if err == nil && looksLikeHTTP(clientTLS, tlsReader) {
+			p.proxyHTTP1(conn, "https", host, "", transport)
+			return
+		}
+		if p.isVerbose() {
+			p.logger.Debug("TLS connection to %s is not HTTP, relaying decrypted stream", host)
+		}
+		if upstream.failed() != nil {
+			return
+		}
+		ctx := &ProxyCtx{Proxy: p, Stream: &StreamSession{Host: host, ServerName: serverName, TLS: true, Server: upstream.take(), framer: rawFramer{}}}
+		p.proxyStream(conn, ctx, nil)
 	}
+}
+
+// matchStream returns the context and the handlers for a TCP stream to
+// host, handles is nil when no stream handler selects it
+func (p *ProxyServer) matchStream(host, serverName string, isTLS bool) (*ProxyCtx, []*handleEntry) {
+	ctx := &ProxyCtx{
+		Proxy:  p,
+		Stream: &StreamSession{Host: host, ServerName: serverName, TLS: isTLS},
+	}
+	handles, framer := p.streamHandlers(ctx)
+	if len(handles) == 0 {
+		return nil, nil
+	}
+	ctx.Stream.framer = framer
+	return ctx, handles
+}
 
-	// Establish TLS connection to target server
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         serverName,
+// relay copies data between clientConn and host in both directions, the
+// connection in pre is used when there is one
+func (p *ProxyServer) relay(clientConn net.Conn, host string, pre *preConn) {
+	destConn := pre.take()
+	if destConn == nil {
+		var err error
+		destConn, err = p.dial(context.Background(), "tcp", host)
+		if err != nil {
+			p.logger.Error("Failed to connect to target server %s: %v", host, err)
+			return
+		}
 	}
+	defer destConn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(destConn, clientConn)
+		closeWrite(destConn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(clientConn, destConn)
+		closeWrite(clientConn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
 
-	destTLSConn := tls.Client(destConn, tlsConfig)
-	if err := destTLSConn.Handshake(); err != nil {
-		p.logger.Error("TLS handshake with target server %s failed: %v", host, err)
+// closeWrite half-closes conn when supported, so the peer sees EOF while
+// data in the other direction keeps flowing
+func closeWrite(conn net.Conn) {
+	conn = unwrapConn(conn)
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
 		return
 	}
-	defer destTLSConn.Close()
+	conn.Close()
+}
 
-	// Process HTTPS requests
-	p.proxyHTTPS(tlsConn, destTLSConn, host)
+// serverTLSConfig returns the config for the TLS handshake with a client,
+// the certificate is issued for the SNI or defaultName when there is none
+func (p *ProxyServer) serverTLSConfig(defaultName string) *tls.Config {
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return p.certManager.GetCertificate(hello)
+			}
+			return p.certManager.GetCertificateForDomain(defaultName)
+		},
+		NextProtos:   []string{"h2", "http/1.1"},
+		KeyLogWriter: p.keyLogWriter,
+	}
+	if p.requestClientCert {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config
+}
+
+// newTunnelTransport creates the transport used for the upstream side of
+// an intercepted TLS connection. Connections to host use serverName, when
+// set, as the upstream ServerName; the first one is taken from pre when it
+// holds a connection made in advance.
+func (p *ProxyServer) newTunnelTransport(host, serverName string, pre *preConn) *http.Transport {
+	return &http.Transport{
+		DialContext: p.dial,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			name := ""
+			if sameAddr(addr, host) {
+				if conn := pre.take(); conn != nil {
+					return conn, nil
+				}
+				if err := pre.failed(); err != nil {
+					return nil, err
+				}
+				name = serverName
+			}
+			return p.dialTLS(ctx, network, addr, name, []string{"h2", "http/1.1"})
+		},
+		ForceAttemptHTTP2:   true,
+		DisableCompression:  true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// sameAddr reports whether the dial address addr is host, which may lack
+// the default HTTPS port
+func sameAddr(addr, host string) bool {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	return strings.EqualFold(addr, host)
 }
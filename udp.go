@@ -0,0 +1,314 @@
+package gamemitm
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpIdleTimeout closes UDP flows without traffic in either direction
+const udpIdleTimeout = 2 * time.Minute
+
+// Direction tells which peer sent a datagram or message
+type Direction int
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+func (d Direction) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// OnDatagram registers handlers for UDP datagrams of flows selected by m.
+// Handlers receive the payload and return the payload to send, nil drops
+// it; ctx.UDPSession is the flow and can inject or delay datagrams.
+func (p *ProxyServer) OnDatagram(m Matcher) *DatagramDispatcher {
+	return p.Handlers().OnDatagram(m)
+}
+
+// udpQueueSize is the number of datagrams a flow buffers while its
+// upstream socket is being opened, later datagrams are dropped
+const udpQueueSize = 64
+
+// UDPSession is a UDP flow between a client address and a remote address,
+// it is the counterpart of Session for datagrams
+type UDPSession struct {
+	// Client is the address of the client socket
+	Client net.Addr
+	// Remote is the server address as requested by the client, "host:port"
+	Remote string
+
+	ctx *ProxyCtx
+	// server is set once ready is closed, nil when it could not be opened
+	server   net.Conn
+	ready    chan struct{}
+	queue    chan []byte
+	done     chan struct{}
+	mu       sync.Mutex
+	closed   bool
+	toClient func(from *net.UDPAddr, data []byte) error
+	active   atomic.Int64
+	onClose  func()
+	once     sync.Once
+}
+
+// upstream waits until the server socket is open
+func (s *UDPSession) upstream() (net.Conn, error) {
+	select {
+	case <-s.ready:
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+	if s.server == nil {
+		return nil, net.ErrClosed
+	}
+	return s.server, nil
+}
+
+// SendToServer injects data to the server, it skips the handlers
+func (s *UDPSession) SendToServer(data []byte) error {
+	server, err := s.upstream()
+	if err != nil {
+		return err
+	}
+	s.touch()
+	_, err = server.Write(data)
+	return err
+}
+
+// SendToClient injects data to the client, it skips the handlers
+func (s *UDPSession) SendToClient(data []byte) error {
+	server, err := s.upstream()
+	if err != nil {
+		return err
+	}
+	s.touch()
+	return s.toClient(server.RemoteAddr().(*net.UDPAddr), data)
+}
+
+// SendToServerAfter sends data to the server after d. A handler delays a
+// datagram by passing it here and returning nil.
+func (s *UDPSession) SendToServerAfter(d time.Duration, data []byte) {
+	data = append([]byte(nil), data...)
+	time.AfterFunc(d, func() { s.SendToServer(data) })
+}
+
+// SendToClientAfter sends data to the client after d
+func (s *UDPSession) SendToClientAfter(d time.Duration, data []byte) {
+	data = append([]byte(nil), data...)
+	time.AfterFunc(d, func() { s.SendToClient(data) })
+}
+
+// Close ends the flow, a new flow is created if the client sends again
+func (s *UDPSession) Close() error {
+	s.once.Do(func() {
+		s.onClose()
+		close(s.done)
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.server != nil {
+		return s.server.Close()
+	}
+	return nil
+}
+
+// setServer publishes the opened server socket, it reports false when the
+// flow was closed meanwhile
+func (s *UDPSession) setServer(server net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.server = server
+	close(s.ready)
+	return true
+}
+
+func (s *UDPSession) touch() {
+	s.active.Store(time.Now().UnixNano())
+}
+
+// udpFlows tracks the flows relayed through one client-facing socket
+type udpFlows struct {
+	p        *ProxyServer
+	mu       sync.Mutex
+	sessions map[string]*UDPSession
+}
+
+func (p *ProxyServer) newUDPFlows() *udpFlows {
+	return &udpFlows{p: p, sessions: make(map[string]*UDPSession)}
+}
+
+// fromClient relays a datagram sent by client to remote, toClient sends
+// the replies, received from the resolved remote address, to the client.
+// It never blocks: the datagram is queued on the flow, which resolves and
+// opens the server socket in its own goroutine.
+func (f *udpFlows) fromClient(client net.Addr, remote string, data []byte, toClient func(from *net.UDPAddr, data []byte) error) {
+	s := f.session(client, remote, toClient)
+	s.touch()
+	select {
+	case s.queue <- append([]byte(nil), data...):
+	default:
+		if f.p.isVerbose() {
+			f.p.logger.Debug("Dropping UDP datagram %s -> %s, queue full", client, remote)
+		}
+	}
+}
+
+// session returns the flow between client and remote, creating it on the
+// first datagram
+func (f *udpFlows) session(client net.Addr, remote string, toClient func(from *net.UDPAddr, data []byte) error) *UDPSession {
+	key := client.String() + "|" + remote
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.sessions[key]; ok {
+		return s
+	}
+	s := &UDPSession{
+		Client:   client,
+		Remote:   remote,
+		ready:    make(chan struct{}),
+		queue:    make(chan []byte, udpQueueSize),
+		done:     make(chan struct{}),
+		toClient: toClient,
+	}
+	s.ctx = &ProxyCtx{Proxy: f.p, UDPSession: s}
+	s.onClose = func() {
+		f.mu.Lock()
+		if f.sessions[key] == s {
+			delete(f.sessions, key)
+		}
+		f.mu.Unlock()
+	}
+	f.sessions[key] = s
+	if f.p.isVerbose() {
+		f.p.logger.Debug("New UDP flow %s -> %s", client, remote)
+	}
+	go f.toServer(s)
+	return s
+}
+
+// toServer opens the server socket of the flow, then relays the queued
+// datagrams of the client in order
+func (f *udpFlows) toServer(s *UDPSession) {
+	// 解析和拨号可能较慢，在流自己的协程中进行，不阻塞监听套接字的读循环
+	server, err := f.p.dialUDP(s.Remote)
+	if err != nil {
+		f.p.logger.Error("Failed to open UDP flow to %s: %v", s.Remote, err)
+		s.Close()
+		return
+	}
+	if !s.setServer(server) {
+		server.Close()
+		return
+	}
+	go f.fromServer(s)
+	for {
+		select {
+		case data := <-s.queue:
+			if data = f.p.runDatagram(s, ClientToServer, data); data != nil {
+				server.Write(data)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// fromServer relays the replies of the flow until it is closed or idle
+func (f *udpFlows) fromServer(s *UDPSession) {
+	defer s.Close()
+	buf := make([]byte, 65535)
+	for {
+		last := time.Unix(0, s.active.Load())
+		s.server.SetReadDeadline(last.Add(udpIdleTimeout))
+		n, err := s.server.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && time.Since(time.Unix(0, s.active.Load())) < udpIdleTimeout {
+				continue
+			}
+			return
+		}
+		s.touch()
+		data := f.p.runDatagram(s, ServerToClient, append([]byte(nil), buf[:n]...))
+		if data == nil {
+			continue
+		}
+		s.toClient(s.server.RemoteAddr().(*net.UDPAddr), data)
+	}
+}
+
+// closeAll closes every flow
+func (f *udpFlows) closeAll() {
+	f.mu.Lock()
+	sessions := make([]*UDPSession, 0, len(f.sessions))
+	for _, s := range f.sessions {
+		sessions = append(sessions, s)
+	}
+	f.mu.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+}
+
+// runDatagram passes data through the OnDatagram handlers, it returns nil
+// when the datagram is dropped
+func (p *ProxyServer) runDatagram(s *UDPSession, dir Direction, data []byte) []byte {
+	for _, e := range p.Handlers().chain(UDP) {
+		if e.message == nil || !e.matcher.Match(s.ctx) {
+			continue
+		}
+		if data = e.message(data, dir, s.ctx); data == nil {
+			return nil
+		}
+	}
+	return data
+}
+
+// ListenUDPForward relays UDP datagrams received on addr to remote
+// ("host:port"), each client address is a separate flow. It blocks until
+// Stop is called.
+func (p *ProxyServer) ListenUDPForward(addr, remote string) error {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	p.trackListener(conn)
+	p.logger.Info("Forwarding UDP %s to %s", addr, remote)
+
+	flows := p.newUDPFlows()
+	defer flows.closeAll()
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		flows.fromClient(client, remote, buf[:n], func(_ *net.UDPAddr, data []byte) error {
+			_, err := conn.WriteToUDP(data, client)
+			return err
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package gamemitm
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpEchoServer echoes every datagram and returns its address
+func udpEchoServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// startUDPForward runs ListenUDPForward of p to remote and returns the
+// local address
+func startUDPForward(t *testing.T, p *ProxyServer, remote string) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	go p.ListenUDPForward(addr, remote)
+	return addr
+}
+
+// udpClient returns a socket connected to addr
+func udpClient(t *testing.T, addr string) *net.UDPConn {
+	t.Helper()
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// udpRoundTrip sends msg until a reply arrives, the listener may not be
+// bound yet when the first datagram is sent
+func udpRoundTrip(t *testing.T, conn *net.UDPConn, msg string) string {
+	t.Helper()
+	buf := make([]byte, 65535)
+	for i := 0; i < 20; i++ {
+		// 监听前发送会收到端口不可达，读写都可能报错
+		conn.Write([]byte(msg))
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err == nil {
+			return string(buf[:n])
+		}
+		if !isTimeout(err) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	t.Fatalf("no reply to %q", msg)
+	return ""
+}
+
+func TestUDPForwardHandlers(t *testing.T) {
+	p, _ := newTestProxy(t)
+	p.OnDatagram(Any()).Do(func(data []byte, dir Direction, ctx *ProxyCtx) []byte {
+		if dir == ClientToServer && string(data) == "drop" {
+			return nil
+		}
+		if dir == ServerToClient {
+			return append(data, " via proxy"...)
+		}
+		return data
+	})
+	conn := udpClient(t, startUDPForward(t, p, udpEchoServer(t)))
+
+	if got := udpRoundTrip(t, conn, "hello"); got != "hello via proxy" {
+		t.Fatalf("reply = %q", got)
+	}
+	conn.Write([]byte("drop"))
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 100)
+	if n, err := conn.Read(buf); err == nil && string(buf[:n]) == "drop via proxy" {
+		t.Fatal("dropped datagram was relayed")
+	}
+	if got := udpRoundTrip(t, conn, "again"); got != "again via proxy" {
+		t.Fatalf("reply = %q", got)
+	}
+}
+
+func TestUDPSessionInject(t *testing.T) {
+	p, _ := newTestProxy(t)
+	p.OnDatagram(Any()).Do(func(data []byte, dir Direction, ctx *ProxyCtx) []byte {
+		if dir == ClientToServer && string(data) == "ping" {
+			// 延迟发送，并直接回复客户端一条不经过服务器的数据报
+			ctx.UDPSession.SendToServerAfter(50*time.Millisecond, []byte("delayed"))
+			ctx.UDPSession.SendToClient([]byte("injected"))
+			return nil
+		}
+		return data
+	})
+	conn := udpClient(t, startUDPForward(t, p, udpEchoServer(t)))
+
+	if got := udpRoundTrip(t, conn, "ping"); got != "injected" {
+		t.Fatalf("first reply = %q", got)
+	}
+	buf := make([]byte, 100)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) == "delayed" {
+			return
+		}
+	}
+}
+
+func TestUDPThroughUpstreamSOCKS5(t *testing.T) {
+	upstream := NewProxy()
+	upstream.SetLogger(discardLogger{})
+	upstream.SetVerbose(false)
+	upstream.SetSOCKS5Auth("user", "secret")
+	defer upstream.Stop()
+	var relayed atomic.Int32
+	upstream.OnDatagram(Any()).Do(func(data []byte, dir Direction, ctx *ProxyCtx) []byte {
+		if dir == ClientToServer {
+			relayed.Add(1)
+		}
+		return data
+	})
+	socksAddr := startSOCKS5(t, upstream)
+
+	p, _ := newTestProxy(t)
+	if err := p.SetUpstreamProxy("socks5://user:secret@" + socksAddr); err != nil {
+		t.Fatal(err)
+	}
+	conn := udpClient(t, startUDPForward(t, p, udpEchoServer(t)))
+	if got := udpRoundTrip(t, conn, "through socks"); got != "through socks" {
+		t.Fatalf("reply = %q", got)
+	}
+	if relayed.Load() == 0 {
+		t.Fatal("datagram bypassed the upstream SOCKS5 proxy")
+	}
+}
+
+func TestUDPRefusesHTTPUpstream(t *testing.T) {
+	p, _ := newTestProxy(t)
+	if err := p.SetUpstreamProxy("http://127.0.0.1:3128"); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := p.dialUDP("127.0.0.1:7777"); err == nil {
+		conn.Close()
+		t.Fatal("UDP flow bypassed the HTTP upstream proxy")
+	}
+}
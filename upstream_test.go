@@ -0,0 +1,160 @@
+package gamemitm
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUpstreamProxy is an HTTP proxy recording the requests it receives
+type fakeUpstreamProxy struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+	auth     []string
+}
+
+func newFakeUpstreamProxy(t *testing.T) *fakeUpstreamProxy {
+	f := &fakeUpstreamProxy{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeUpstreamProxy) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.RequestURI)
+	f.auth = append(f.auth, r.Header.Get("Proxy-Authorization"))
+	f.mu.Unlock()
+	if r.Method != http.MethodConnect {
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.Header().Set("X-Via", "upstream")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		target.Close()
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() {
+		io.Copy(target, conn)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+}
+
+func (f *fakeUpstreamProxy) seen() ([]string, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...), append([]string(nil), f.auth...)
+}
+
+func TestUpstreamProxyPlainHTTPAbsoluteForm(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+	chain := newFakeUpstreamProxy(t)
+	if err := p.SetUpstreamProxy(strings.Replace(chain.URL, "http://", "http://user:pass@", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := doText(t, client, "POST", upstream.URL+"/path?q=1", "data")
+	if body != "data" || resp.Header.Get("X-Via") != "upstream" {
+		t.Fatalf("got %q via %q", body, resp.Header.Get("X-Via"))
+	}
+	requests, auth := chain.seen()
+	if len(requests) != 1 || requests[0] != "POST "+upstream.URL+"/path?q=1" {
+		t.Fatalf("upstream proxy saw %q, want one absolute-form request", requests)
+	}
+	// "user:pass" 的 Base64 编码
+	if auth[0] != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("Proxy-Authorization = %q", auth[0])
+	}
+}
+
+func TestUpstreamProxyTunnelsTLS(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	chain := newFakeUpstreamProxy(t)
+	if err := p.SetUpstreamProxy(chain.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, body := doText(t, client, "POST", upstream.URL, "secret"); body != "secret" {
+		t.Fatalf("body = %q", body)
+	}
+	requests, _ := chain.seen()
+	host := upstream.Listener.Addr().String()
+	if len(requests) == 0 || requests[0] != "CONNECT "+host {
+		t.Fatalf("upstream proxy saw %q, want CONNECT %s", requests, host)
+	}
+}
+
+func TestUpstreamProxyBypass(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+	chain := newFakeUpstreamProxy(t)
+	if err := p.SetUpstreamProxy(chain.URL, "127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := doText(t, client, "POST", upstream.URL, "direct"); body != "direct" {
+		t.Fatalf("body = %q", body)
+	}
+	if requests, _ := chain.seen(); len(requests) != 0 {
+		t.Fatalf("bypassed request went through the upstream proxy: %q", requests)
+	}
+}
+
+func TestSetUpstreamProxyErrors(t *testing.T) {
+	p := NewProxy()
+	for _, bad := range []string{"ftp://host:21", "http://host", "http://%zz"} {
+		if err := p.SetUpstreamProxy(bad); err == nil {
+			t.Errorf("SetUpstreamProxy(%q) accepted", bad)
+		}
+	}
+	if err := p.SetUpstreamProxy(""); err != nil {
+		t.Errorf("disabling the upstream proxy failed: %v", err)
+	}
+}
+
+func TestUpstreamProxySwapWhileRunning(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := echoServer(t)
+	chain := newFakeUpstreamProxy(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if i%2 == 0 {
+				p.SetUpstreamProxy(chain.URL)
+			} else {
+				p.SetUpstreamProxy("")
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if _, body := doText(t, client, "POST", upstream.URL, "x"); body != "x" {
+			t.Fatalf("body = %q", body)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,200 @@
+package gamemitm
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// UpstreamTLSConfig configures how upstream server certificates are
+// verified, see SetUpstreamTLS
+type UpstreamTLSConfig struct {
+	// Insecure accepts any certificate chain, pins are still checked
+	Insecure bool
+	// RootCAs are PEM encoded root certificates trusted in addition to the
+	// system roots, e.g. the CA of a staging environment
+	RootCAs [][]byte
+	// Pins maps host patterns (host globs, IPs, CIDRs or ":port") to base64
+	// encoded SHA-256 hashes of a SubjectPublicKeyInfo. Matching hosts must
+	// present a chain containing one of the keys.
+	Pins map[string][]string
+}
+
+// UpstreamCertError is returned when the certificate of an upstream server
+// is rejected
+type UpstreamCertError struct {
+	// Host is the upstream address, "host:port"
+	Host string
+	// ServerName is the name the certificate was verified against
+	ServerName string
+	Err        error
+}
+
+func (e *UpstreamCertError) Error() string {
+	return fmt.Sprintf("certificate of upstream server %s (%s) rejected: %v", e.Host, e.ServerName, e.Err)
+}
+
+func (e *UpstreamCertError) Unwrap() error {
+	return e.Err
+}
+
+// upstreamVerifier holds the parsed UpstreamTLSConfig
+type upstreamVerifier struct {
+	insecure bool
+	roots    *x509.CertPool
+	pins     []hostPins
+}
+
+type hostPins struct {
+	hosts  *hostList
+	hashes map[string]bool
+}
+
+// SetUpstreamTLS enables verification of upstream certificates for HTTPS,
+// WSS and TLS streams. Until it is called upstream certificates are not
+// verified. Rejected connections are reported to the handle set with
+// SetUpstreamTLSErrorHandle and answered with 502 Bad Gateway.
+func (p *ProxyServer) SetUpstreamTLS(cfg UpstreamTLSConfig) error {
+	v := &upstreamVerifier{insecure: cfg.Insecure}
+	if !cfg.Insecure {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		for i, pem := range cfg.RootCAs {
+			if !roots.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificate found in RootCAs[%d]", i)
+			}
+		}
+		v.roots = roots
+	}
+	for pattern, hashes := range cfg.Pins {
+		hosts, err := parseHostList([]string{pattern})
+		if err != nil {
+			return err
+		}
+		pins := hostPins{hosts: hosts, hashes: make(map[string]bool)}
+		for _, h := range hashes {
+			if b, err := base64.StdEncoding.DecodeString(h); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("invalid SHA-256 pin %q for %s", h, pattern)
+			}
+			pins.hashes[h] = true
+		}
+		v.pins = append(v.pins, pins)
+	}
+	p.upstreamVerifier = v
+	return nil
+}
+
+// SetUpstreamTLSErrorHandle sets the callback for rejected upstream
+// certificates
+func (p *ProxyServer) SetUpstreamTLSErrorHandle(h func(err *UpstreamCertError)) {
+	p.upstreamTLSErrorHandle = h
+}
+
+// upstreamTLSConfig returns the client config for a TLS connection to host
+// ("host:port"), the certificate is checked against serverName
+func (p *ProxyServer) upstreamTLSConfig(host, serverName string, nextProtos []string) *tls.Config {
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(host)
+	}
+	return &tls.Config{
+		// 证书由 VerifyConnection 按配置校验
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+		NextProtos:         nextProtos,
+		KeyLogWriter:       p.keyLogWriter,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return p.clientCertificate(host, serverName), nil
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			err := p.upstreamVerifier.verify(host, serverName, cs.PeerCertificates)
+			if err == nil {
+				return nil
+			}
+			certErr := &UpstreamCertError{Host: host, ServerName: serverName, Err: err}
+			p.logger.Error("%v", certErr)
+			if h := p.upstreamTLSErrorHandle; h != nil {
+				h(certErr)
+			}
+			return certErr
+		},
+	}
+}
+
+// dialTLS connects to addr with TLS, verifying the upstream certificate
+func (p *ProxyServer) dialTLS(ctx context.Context, network, addr, serverName string, nextProtos []string) (net.Conn, error) {
+	conn, err := p.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, p.upstreamTLSConfig(addr, serverName, nextProtos))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (v *upstreamVerifier) verify(host, serverName string, certs []*x509.Certificate) error {
+	if v == nil {
+		return nil
+	}
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+	chain := certs
+	if !v.insecure {
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		chains, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         v.roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return err
+		}
+		// 固定的公钥可以是已验证链中的任意证书，包括根证书
+		chain = nil
+		for _, c := range chains {
+			chain = append(chain, c...)
+		}
+	}
+
+	_, port, _ := net.SplitHostPort(host)
+	pinned := false
+	for _, pins := range v.pins {
+		if !pins.hosts.match(host) && !pins.hosts.match(net.JoinHostPort(serverName, port)) {
+			continue
+		}
+		pinned = true
+		for _, c := range chain {
+			sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+			if pins.hashes[base64.StdEncoding.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+	}
+	if pinned {
+		return errors.New("no pinned public key in certificate chain")
+	}
+	return nil
+}
+
+// upstreamErrorText is the message sent to the client when the request
+// could not be sent upstream
+func upstreamErrorText(err error) string {
+	var certErr *UpstreamCertError
+	if errors.As(err, &certErr) {
+		return certErr.Error()
+	}
+	return "Failed to send request to target server"
+}
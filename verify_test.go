@@ -0,0 +1,107 @@
+package gamemitm
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// spkiPin returns the SHA-256 pin of the public key of cert
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestUpstreamTLSNotVerifiedByDefault(t *testing.T) {
+	_, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+
+	if resp, _ := doText(t, client, "GET", upstream.URL, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+}
+
+func TestUpstreamTLSRejectsUnknownCA(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	if err := p.SetUpstreamTLS(UpstreamTLSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	rejected := make(chan *UpstreamCertError, 10)
+	p.SetUpstreamTLSErrorHandle(func(err *UpstreamCertError) { rejected <- err })
+
+	resp, body := doText(t, client, "GET", upstream.URL, "")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if !strings.Contains(body, "rejected") {
+		t.Fatalf("error page = %q", body)
+	}
+	// 镜像握手拒绝证书后不再重新连接，每个失败的连接只报告一次
+	if n := len(rejected); n != 1 {
+		t.Fatalf("error handle called %d times, want once", n)
+	}
+	if err := <-rejected; err.Host != upstream.Listener.Addr().String() {
+		t.Fatalf("rejected host = %q", err.Host)
+	}
+}
+
+func TestUpstreamTLSRootCAs(t *testing.T) {
+	p, client := newTestProxy(t)
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	root := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := p.SetUpstreamTLS(UpstreamTLSConfig{RootCAs: [][]byte{root}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, _ := doText(t, client, "GET", upstream.URL, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+}
+
+func TestUpstreamTLSPins(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer upstream.Close()
+	good := spkiPin(upstream.Certificate())
+	bad := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name string
+		pins map[string][]string
+		want int
+	}{
+		{"matching pin", map[string][]string{"127.0.0.1": {bad, good}}, http.StatusOK},
+		{"wrong pin", map[string][]string{"127.0.0.1": {bad}}, http.StatusBadGateway},
+		{"other host", map[string][]string{"*.game.test": {bad}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, client := newTestProxy(t)
+			// 跳过链校验时仍检查固定的公钥
+			if err := p.SetUpstreamTLS(UpstreamTLSConfig{Insecure: true, Pins: tt.pins}); err != nil {
+				t.Fatal(err)
+			}
+			if resp, _ := doText(t, client, "GET", upstream.URL, ""); resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetUpstreamTLSInvalidConfig(t *testing.T) {
+	p := NewProxy()
+	if err := p.SetUpstreamTLS(UpstreamTLSConfig{RootCAs: [][]byte{[]byte("not a certificate")}}); err == nil {
+		t.Error("RootCAs without a certificate accepted")
+	}
+	if err := p.SetUpstreamTLS(UpstreamTLSConfig{Pins: map[string][]string{"*.game.test": {"c2hvcnQ="}}}); err == nil {
+		t.Error("pin of the wrong length accepted")
+	}
+}
@@ -1,31 +1,62 @@
 package gamemitm
 
 import (
-	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"github.com/gorilla/websocket"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
-	"strings"
+	"sync"
 )
 
 type Session struct {
 	Client *websocket.Conn
 	Server *websocket.Conn
+
+	// 每个连接同一时间只能有一个写入者
+	clientMu sync.Mutex
+	serverMu sync.Mutex
 }
 
+// errNoServer is returned when sending to the server of a replayed session
+var errNoServer = errors.New("replayed session has no server connection")
+
 func (s *Session) SendTextToServer(data []byte) {
-	s.Server.WriteMessage(websocket.TextMessage, data)
+	s.send(ClientToServer, websocket.TextMessage, data)
 }
 func (s *Session) SendBinaryToServer(data []byte) {
-	s.Server.WriteMessage(websocket.BinaryMessage, data)
+	s.send(ClientToServer, websocket.BinaryMessage, data)
 }
 func (s *Session) SendTextToClient(data []byte) {
-	s.Client.WriteMessage(websocket.TextMessage, data)
+	s.send(ServerToClient, websocket.TextMessage, data)
 }
 func (s *Session) SendBinaryToClient(data []byte) {
-	s.Client.WriteMessage(websocket.BinaryMessage, data)
+	s.send(ServerToClient, websocket.BinaryMessage, data)
+}
+
+// Close closes both sides of the session
+func (s *Session) Close() error {
+	if s.Server != nil {
+		s.Server.Close()
+	}
+	return s.Client.Close()
+}
+
+// send writes a message in dir, serialized with the relayed messages
+func (s *Session) send(dir Direction, msgType int, data []byte) error {
+	conn, mu := s.Server, &s.serverMu
+	if dir == ServerToClient {
+		conn, mu = s.Client, &s.clientMu
+	}
+	// 回放录制的会话时没有上游连接
+	if conn == nil {
+		return errNoServer
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return conn.WriteMessage(msgType, data)
 }
 
 // handleWebSocket handles WebSocket connections
@@ -35,13 +66,51 @@ func (p *ProxyServer) handleWebSocket(w http.ResponseWriter, r *http.Request, is
 		scheme = "wss"
 	}
 
-	// 构建目标URL
+	// 握手请求只经过以 Handshake 注册的请求处理函数，此时 ctx.WSSession 为 nil
+	ctx := &ProxyCtx{
+		Req:       r,
+		Proxy:     p,
+		ClientTLS: r.TLS,
+	}
+	defer p.startFlow(ctx).finish()
+	origHost := r.URL.Host
+	p.runHandshake(Request, ctx)
+	if ctx.dropped {
+		ctx.flow.fail(errDropped)
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+		return
+	}
+	if ctx.response != nil {
+		p.respond(w, ctx, ctx.response)
+		return
+	}
+	if replay := p.replayer.Load(); replay != nil {
+		if ex := replay.find(replay.sessions, r, nil); ex != nil {
+			p.replayWebSocket(w, r, ctx, ex, replay.cfg.NoDelay)
+			return
+		}
+		if replay.cfg.Offline {
+			p.logger.Warn("No recorded WebSocket session for %s", r.URL)
+			ctx.flow.fail(errNotRecorded)
+			http.Error(w, "No recorded WebSocket session for "+r.URL.String(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	// 构建目标URL，处理函数可能修改了目标地址
 	targetURL := url.URL{
 		Scheme:   scheme,
-		Host:     r.Host,
+		Host:     r.URL.Host,
 		Path:     r.URL.Path,
 		RawQuery: r.URL.RawQuery,
 	}
+	if targetURL.Host == "" {
+		targetURL.Host = r.Host
+	}
 
 	// 创建一个新的header对象，只复制需要的，避免WebSocket特定的头
 	requestHeader := http.Header{}
@@ -64,16 +133,31 @@ func (p *ProxyServer) handleWebSocket(w http.ResponseWriter, r *http.Request, is
 	if proto := r.Header.Get("Sec-Websocket-Protocol"); proto != "" {
 		requestHeader.Set("Sec-Websocket-Protocol", proto)
 	}
+	if r.Host != "" && r.Host != targetURL.Host {
+		requestHeader.Set("Host", r.Host)
+	}
 
 	// 连接目标WebSocket服务器
+	// 目标未被修改时沿用客户端的 SNI，按 IP 建立的隧道也能连接到正确的站点
+	serverName := ""
+	if r.TLS != nil && r.TLS.ServerName != "" && targetURL.Host == origHost {
+		serverName = r.TLS.ServerName
+	}
+	dialHost := targetURL.Host
+	if _, _, err := net.SplitHostPort(dialHost); err != nil {
+		dialHost = net.JoinHostPort(dialHost, "443")
+	}
+	tlsConfig := p.upstreamTLSConfig(dialHost, serverName, nil)
 	dialer := websocket.Dialer{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		NetDialContext:  p.dial,
+		TLSClientConfig: tlsConfig,
 	}
 
 	// 增加超时和更详细的错误处理
 	targetConn, resp, err := dialer.Dial(targetURL.String(), requestHeader)
 	if err != nil {
 		p.logger.Error("Failed to connect to target WebSocket server: %v ", err)
+		ctx.flow.fail(err)
 		if resp != nil {
 
 			// 转发响应
@@ -85,11 +169,32 @@ func (p *ProxyServer) handleWebSocket(w http.ResponseWriter, r *http.Request, is
 			w.WriteHeader(resp.StatusCode)
 			io.Copy(w, resp.Body)
 		} else {
-			http.Error(w, "Unable to connect to WebSocket server", http.StatusBadGateway)
+			var certErr *UpstreamCertError
+			if errors.As(err, &certErr) {
+				http.Error(w, certErr.Error(), http.StatusBadGateway)
+			} else {
+				http.Error(w, "Unable to connect to WebSocket server", http.StatusBadGateway)
+			}
 		}
 		return
 	}
 	defer targetConn.Close()
+	ctx.UpstreamTLS = connState(targetConn.UnderlyingConn())
+
+	// 握手响应经过以 Handshake 注册的响应处理函数，可修改返回给客户端的响应头
+	ctx.Resp = resp
+	ctx.flow.original(Response, nil)
+	p.runHandshake(Response, ctx)
+	responseHeader := http.Header{}
+	for k, vs := range ctx.Resp.Header {
+		if k != "Sec-Websocket-Extensions" &&
+			k != "Sec-Websocket-Protocol" &&
+			k != "Sec-Websocket-Accept" &&
+			k != "Upgrade" &&
+			k != "Connection" {
+			responseHeader[k] = vs
+		}
+	}
 
 	// Define client connection upgrader
 	upgrader := websocket.Upgrader{
@@ -98,30 +203,25 @@ func (p *ProxyServer) handleWebSocket(w http.ResponseWriter, r *http.Request, is
 		},
 		Subprotocols: websocket.Subprotocols(r),
 	}
+	if proto := targetConn.Subprotocol(); proto != "" {
+		upgrader.Subprotocols = []string{proto}
+	}
 
 	// Upgrade connection with client
-	clientConn, err := upgrader.Upgrade(w, r, nil)
+	clientConn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		p.logger.Error("Failed to upgrade WebSocket connection: %v", err)
 		return
 	}
 	defer clientConn.Close()
 
-	ctx := &ProxyCtx{
-		Req:  r,
-		Resp: resp,
-		WSSession: &Session{
-			Client: clientConn,
-			Server: targetConn,
-		},
-	}
-	for u, handle := range p.connectedHandles {
-		if u == All || strings.Contains(r.Host, u) {
-			if handle != nil {
-				handle([]byte{}, ctx)
-			}
-		}
+	session := &Session{
+		Client: clientConn,
+		Server: targetConn,
 	}
+	ctx.WSSession = session
+	defer p.trackSession(ctx)()
+	p.runHandles(Connected, []byte{}, ctx)
 	// Create channels for relaying messages
 	clientDone := make(chan struct{})
 	targetDone := make(chan struct{})
@@ -136,21 +236,15 @@ func (p *ProxyServer) handleWebSocket(w http.ResponseWriter, r *http.Request, is
 				return
 			}
 
-			if p.Verbose {
+			if p.isVerbose() {
 				p.logger.Debug("Client -> Server: %s", hex.EncodeToString(message))
 			}
 			// Here you can add code to modify WebSocket messages
 
-			modifiedMessage := message
-			for u, handle := range p.reqHandles {
-				if u == All || strings.Contains(r.Host, u) {
-					if handle != nil {
-						modifiedMessage = handle(message, ctx)
-					}
-				}
-			}
+			modifiedMessage := p.runHandles(Request, message, ctx)
+			ctx.flow.message(ClientToServer, messageType, message, modifiedMessage)
 
-			if err := targetConn.WriteMessage(messageType, modifiedMessage); err != nil {
+			if err := session.send(ClientToServer, messageType, modifiedMessage); err != nil {
 				p.logger.Error("Failed to send message to target server: %v", err)
 				return
 			}
@@ -166,22 +260,14 @@ func (p *ProxyServer) handleWebSocket(w http.ResponseWriter, r *http.Request, is
 				p.logger.Error("Failed to read target server message: %v", err)
 				return
 			}
-			if p.Verbose {
+			if p.isVerbose() {
 				p.logger.Debug("Server -> Client: %s", hex.EncodeToString(message))
 			}
 			// Here you can add code to modify WebSocket messages
 
-			modifiedMessage := message
-
-			for u, handle := range p.respHandles {
-
-				if u == All || strings.Contains(r.Host, u) {
-					if handle != nil {
-						modifiedMessage = handle(message, ctx)
-					}
-				}
-			}
-			if err := clientConn.WriteMessage(messageType, modifiedMessage); err != nil {
+			modifiedMessage := p.runHandles(Response, message, ctx)
+			ctx.flow.message(ServerToClient, messageType, message, modifiedMessage)
+			if err := session.send(ServerToClient, messageType, modifiedMessage); err != nil {
 				p.logger.Error("Failed to send message to client: %v", err)
 				return
 			}
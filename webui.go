@@ -0,0 +1,28 @@
+package gamemitm
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// webUIFiles is the web UI served by ListenAdmin, a single page using the
+// admin API
+//
+//go:embed webui
+var webUIFiles embed.FS
+
+// webUIHandler serves the embedded web UI
+func webUIHandler() http.Handler {
+	files, err := fs.Sub(webUIFiles, "webui")
+	if err != nil {
+		panic(err)
+	}
+	server := http.FileServer(http.FS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 页面只加载自身的脚本和样式，记录的内容不会被当作页面执行
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		server.ServeHTTP(w, r)
+	})
+}
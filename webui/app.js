@@ -0,0 +1,756 @@
+'use strict';
+
+// game-mitm web UI, a single page over the admin API
+
+const token = new URLSearchParams(location.search).get('token') || '';
+const maxFlows = 5000;
+
+const state = {
+  flows: [],        // flow summaries in the order they completed
+  ids: new Set(),   // ids of state.flows
+  paused: [],       // summaries received while paused
+  selected: null,   // id of the selected flow
+  session: null,    // the selected live session
+  timeline: null,   // the timeline receiving live messages
+  filter: () => true,
+};
+
+// ---- helpers ----
+
+// withToken adds the token to the URL of the event stream, the only route
+// taking it outside the Authorization header
+function withToken(path) {
+  if (!token) return path;
+  return path + (path.includes('?') ? '&' : '?') + 'token=' + encodeURIComponent(token);
+}
+
+async function api(method, path, body) {
+  const opts = { method, headers: {} };
+  if (token) opts.headers['Authorization'] = 'Bearer ' + token;
+  // 改变状态的请求必须以 JSON 发送
+  if (method !== 'GET') opts.headers['Content-Type'] = 'application/json';
+  if (body !== undefined) opts.body = JSON.stringify(body);
+  const resp = await fetch(path, opts);
+  if (!resp.ok) {
+    let msg = resp.status + ' ' + resp.statusText;
+    try { msg = (await resp.json()).error || msg; } catch (e) { /* 非 JSON 响应 */ }
+    throw new Error(msg);
+  }
+  return resp;
+}
+
+async function apiJSON(method, path, body) {
+  const resp = await api(method, path, body);
+  return resp.status === 204 ? null : resp.json();
+}
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k.startsWith('on')) e.addEventListener(k.slice(2), v);
+    else if (k === 'class') e.className = v;
+    else if (v !== false && v !== null && v !== undefined) e.setAttribute(k, v === true ? '' : v);
+  }
+  for (const c of children.flat()) {
+    if (c === null || c === undefined || c === false) continue;
+    e.append(c instanceof Node ? c : String(c));
+  }
+  return e;
+}
+
+function fail(err) {
+  alert(err.message || err);
+}
+
+function b64ToBytes(s) {
+  if (!s) return new Uint8Array(0);
+  const bin = atob(s);
+  const bytes = new Uint8Array(bin.length);
+  for (let i = 0; i < bin.length; i++) bytes[i] = bin.charCodeAt(i);
+  return bytes;
+}
+
+function bytesToB64(bytes) {
+  let bin = '';
+  for (let i = 0; i < bytes.length; i += 0x8000) {
+    bin += String.fromCharCode.apply(null, bytes.subarray(i, i + 0x8000));
+  }
+  return btoa(bin);
+}
+
+// utf8 returns the text of bytes, null if they are not valid UTF-8 text
+function utf8(bytes) {
+  try {
+    const text = new TextDecoder('utf-8', { fatal: true }).decode(bytes);
+    return /[\x00-\x08\x0e-\x1f]/.test(text) ? null : text;
+  } catch (e) {
+    return null;
+  }
+}
+
+function fmtSize(n) {
+  if (n < 1024) return n + ' B';
+  if (n < 1024 * 1024) return (n / 1024).toFixed(1) + ' KB';
+  return (n / 1024 / 1024).toFixed(1) + ' MB';
+}
+
+// fmtDuration formats a Go duration in nanoseconds
+function fmtDuration(ns) {
+  const ms = ns / 1e6;
+  return ms < 1000 ? ms.toFixed(ms < 10 ? 1 : 0) + ' ms' : (ms / 1000).toFixed(2) + ' s';
+}
+
+function fmtTime(t) {
+  return new Date(t).toLocaleTimeString();
+}
+
+function statusClass(s) {
+  if (s.error) return 'err';
+  if (s.statusCode === 101 || s.messages) return 'ws';
+  return s.statusCode ? 's' + String(s.statusCode)[0] : '';
+}
+
+// ---- body views ----
+
+function hexDump(bytes) {
+  const lines = [];
+  const limit = Math.min(bytes.length, 64 * 1024);
+  for (let off = 0; off < limit; off += 16) {
+    const row = bytes.subarray(off, Math.min(off + 16, limit));
+    let hex = '', ascii = '';
+    for (let i = 0; i < 16; i++) {
+      if (i === 8) hex += ' ';
+      if (i < row.length) {
+        hex += row[i].toString(16).padStart(2, '0') + ' ';
+        ascii += row[i] >= 0x20 && row[i] < 0x7f ? String.fromCharCode(row[i]) : '.';
+      } else {
+        hex += '   ';
+      }
+    }
+    lines.push(off.toString(16).padStart(8, '0') + '  ' + hex + ' ' + ascii);
+  }
+  if (limit < bytes.length) lines.push('... ' + (bytes.length - limit) + ' more bytes');
+  return lines.join('\n');
+}
+
+function readVarint(bytes, i) {
+  let v = 0n, shift = 0n;
+  for (let n = 0; n < 10; n++, i++) {
+    if (i >= bytes.length) return null;
+    const b = bytes[i];
+    v |= BigInt(b & 0x7f) << shift;
+    shift += 7n;
+    if (b < 0x80) return [v, i + 1];
+  }
+  return null;
+}
+
+// decodeProto parses protobuf wire format without a schema, null if bytes
+// are not a valid message
+function decodeProto(bytes) {
+  const fields = [];
+  let i = 0;
+  while (i < bytes.length) {
+    const key = readVarint(bytes, i);
+    if (!key) return null;
+    i = key[1];
+    const no = Number(key[0] >> 3n), wire = Number(key[0] & 7n);
+    if (no === 0) return null;
+    if (wire === 0) {
+      const v = readVarint(bytes, i);
+      if (!v) return null;
+      fields.push({ no, wire, value: v[0] });
+      i = v[1];
+    } else if (wire === 1 || wire === 5) {
+      const size = wire === 1 ? 8 : 4;
+      if (i + size > bytes.length) return null;
+      fields.push({ no, wire, value: new DataView(bytes.buffer, bytes.byteOffset + i, size) });
+      i += size;
+    } else if (wire === 2) {
+      const l = readVarint(bytes, i);
+      if (!l) return null;
+      i = l[1];
+      const end = i + Number(l[0]);
+      if (end > bytes.length) return null;
+      fields.push({ no, wire, value: bytes.subarray(i, end) });
+      i = end;
+    } else {
+      return null;
+    }
+  }
+  return fields;
+}
+
+function protoText(fields, indent) {
+  const pad = '  '.repeat(indent);
+  const lines = [];
+  for (const f of fields) {
+    if (f.wire === 0) {
+      let s = f.value.toString();
+      // 负数 int64 以补码编码，同时给出有符号和 zigzag 解释
+      if (f.value >= 1n << 63n) s += ' (int64 ' + BigInt.asIntN(64, f.value) + ')';
+      else if (f.value & 1n) s += ' (sint ' + -((f.value + 1n) >> 1n) + ')';
+      lines.push(pad + f.no + ': ' + s);
+    } else if (f.wire === 1) {
+      lines.push(pad + f.no + ': ' + f.value.getBigUint64(0, true) + ' (double ' + f.value.getFloat64(0, true) + ')');
+    } else if (f.wire === 5) {
+      lines.push(pad + f.no + ': ' + f.value.getUint32(0, true) + ' (float ' + f.value.getFloat32(0, true) + ')');
+    } else {
+      const text = utf8(f.value);
+      const nested = text === null && f.value.length && indent < 16 ? decodeProto(f.value) : null;
+      if (nested) {
+        lines.push(pad + f.no + ' {', protoText(nested, indent + 1), pad + '}');
+      } else if (text !== null) {
+        lines.push(pad + f.no + ': ' + JSON.stringify(text));
+      } else {
+        lines.push(pad + f.no + ': <' + Array.from(f.value, b => b.toString(16).padStart(2, '0')).join(' ') + '>');
+      }
+    }
+  }
+  return lines.join('\n');
+}
+
+const bodyModes = {
+  text: bytes => {
+    const text = utf8(bytes);
+    return text === null ? new TextDecoder().decode(bytes) : text;
+  },
+  json: bytes => JSON.stringify(JSON.parse(new TextDecoder().decode(bytes)), null, 2),
+  hex: hexDump,
+  protobuf: bytes => {
+    const fields = decodeProto(bytes);
+    if (!fields) throw new Error('not a protobuf message');
+    return protoText(fields, 0);
+  },
+};
+
+function autoMode(bytes, contentType) {
+  if (/json/.test(contentType || '')) return 'json';
+  if (/proto/.test(contentType || '')) return 'protobuf';
+  const text = utf8(bytes);
+  if (text === null) return decodeProto(bytes) ? 'protobuf' : 'hex';
+  try {
+    JSON.parse(text);
+    return 'json';
+  } catch (e) {
+    return 'text';
+  }
+}
+
+// bodyView shows bytes with a selectable text/JSON/hex/protobuf view
+function bodyView(bytes, contentType, note) {
+  const out = el('pre', { class: 'body' });
+  const buttons = {};
+  const show = mode => {
+    for (const [m, b] of Object.entries(buttons)) b.classList.toggle('active', m === mode);
+    try {
+      out.textContent = bodyModes[mode](bytes);
+    } catch (e) {
+      out.textContent = '(' + e.message + ')';
+    }
+  };
+  for (const m of Object.keys(bodyModes)) {
+    buttons[m] = el('button', { onclick: () => show(m) }, m);
+  }
+  const wrap = el('div', {},
+    el('div', { class: 'modes' }, Object.values(buttons),
+      el('span', { class: 'note' }, fmtSize(bytes.length), contentType ? ' · ' + contentType : '', note ? ' · ' + note : '')),
+    out);
+  if (bytes.length) show(autoMode(bytes, contentType));
+  else out.textContent = '(empty)';
+  return wrap;
+}
+
+function headersTable(header) {
+  const rows = [];
+  for (const name of Object.keys(header || {}).sort()) {
+    for (const v of header[name]) rows.push(el('tr', {}, el('td', {}, name), el('td', {}, v)));
+  }
+  return el('table', { class: 'headers' }, el('tbody', {}, rows));
+}
+
+function sameHeaders(a, b) {
+  return JSON.stringify(a || {}) === JSON.stringify(b || {});
+}
+
+function subTabs(tabs) {
+  const content = el('div');
+  const buttons = tabs.map(([name, render], i) => el('button', {
+    onclick: () => {
+      buttons.forEach(b => b.classList.remove('active'));
+      buttons[i].classList.add('active');
+      content.replaceChildren(render());
+    },
+  }, name));
+  buttons[0].click();
+  return el('div', {}, el('div', { class: 'subtabs' }, buttons), content);
+}
+
+// ---- flows ----
+
+function parseFilter(text) {
+  const terms = text.trim().split(/\s+/).filter(Boolean);
+  const tests = [];
+  for (let i = 0; i < terms.length; i++) {
+    const t = terms[i];
+    const arg = () => (terms[++i] || '').toLowerCase();
+    switch (t) {
+      case '~m': { const m = arg(); tests.push(f => f.method.toLowerCase() === m); break; }
+      case '~c': { const c = arg(); tests.push(f => String(f.statusCode || '').startsWith(c)); break; }
+      case '~h': { const h = arg(); tests.push(f => hostOf(f.url).includes(h)); break; }
+      case '~u': { const u = arg(); tests.push(f => f.url.toLowerCase().includes(u)); break; }
+      case '~ws': tests.push(f => f.statusCode === 101 || f.messages > 0); break;
+      case '~e': tests.push(f => !!f.error); break;
+      default: { const s = t.toLowerCase(); tests.push(f => f.url.toLowerCase().includes(s)); }
+    }
+  }
+  return f => tests.every(test => test(f));
+}
+
+function hostOf(u) {
+  try { return new URL(u).host.toLowerCase(); } catch (e) { return ''; }
+}
+
+function flowRow(f) {
+  const row = el('tr', { 'data-id': f.id, onclick: () => selectFlow(f.id) },
+    el('td', {}, f.id),
+    el('td', {}, f.method),
+    el('td', { class: statusClass(f) }, f.error ? 'error' : f.statusCode || ''),
+    el('td', { class: 'url', title: f.url }, f.url),
+    el('td', {}, f.messages ? f.messages + ' msgs' : fmtSize(f.size)),
+    el('td', {}, fmtDuration(f.duration)));
+  if (f.id === state.selected) row.classList.add('selected');
+  return row;
+}
+
+function renderFlows() {
+  const tbody = document.querySelector('#flow-table tbody');
+  tbody.replaceChildren(...state.flows.filter(state.filter).map(flowRow));
+}
+
+function addFlow(f) {
+  // 事件流先于列表建立，同一个流量可能收到两次
+  if (state.ids.has(f.id)) return;
+  if (document.getElementById('pause').checked) {
+    state.paused.push(f);
+    return;
+  }
+  state.flows.push(f);
+  state.ids.add(f.id);
+  if (state.flows.length > maxFlows) {
+    const old = state.flows.shift();
+    state.ids.delete(old.id);
+    const row = document.querySelector('#flow-table tr[data-id="' + old.id + '"]');
+    if (row) row.remove();
+  }
+  if (state.filter(f)) {
+    const list = document.querySelector('#flows .list');
+    const atBottom = list.scrollTop + list.clientHeight >= list.scrollHeight - 4;
+    document.querySelector('#flow-table tbody').append(flowRow(f));
+    if (atBottom) list.scrollTop = list.scrollHeight;
+  }
+}
+
+async function selectFlow(id) {
+  state.selected = id;
+  document.querySelectorAll('#flow-table tr.selected').forEach(r => r.classList.remove('selected'));
+  const row = document.querySelector('#flow-table tr[data-id="' + id + '"]');
+  if (row) row.classList.add('selected');
+  const detail = document.getElementById('flow-detail');
+  let f;
+  try {
+    f = await apiJSON('GET', '/api/flows/' + id);
+  } catch (e) {
+    detail.replaceChildren(el('p', { class: 'empty' }, e.message));
+    return;
+  }
+  if (state.selected !== id) return;
+  detail.replaceChildren(flowDetail(f));
+}
+
+function flowDetail(f) {
+  const isWS = f.messages !== undefined || (f.response && f.response.statusCode === 101);
+  const tabs = [
+    ['Request', () => messageDetail(f, 'request')],
+    ['Response', () => f.response ? messageDetail(f, 'response') : el('p', { class: 'empty' }, f.error || 'No response')],
+  ];
+  if (isWS) tabs.push(['Messages (' + (f.messages || []).length + ')', () => timeline(f.messages || [], f.start).root]);
+  tabs.push(['Timing', () => timingDetail(f)]);
+  return el('div', {},
+    el('div', { class: 'summary' },
+      el('b', {}, f.request.method), ' ', f.request.url, ' ',
+      f.response ? el('span', { class: statusClass({ statusCode: f.response.statusCode }) }, f.response.status) : null,
+      f.error ? el('div', { class: 'err' }, f.error) : null),
+    el('div', { class: 'actions' },
+      el('button', { disabled: isWS || f.request.truncated, onclick: () => replay(f.id) }, 'Replay request'),
+      el('button', { disabled: isWS || f.request.truncated, onclick: () => openEditor(f) }, 'Edit and resend')),
+    subTabs(tabs));
+}
+
+// messageDetail shows the headers and the body of the request or response
+// of a flow, with the versions before the handlers changed them
+function messageDetail(f, part) {
+  const m = f[part];
+  const changed = !sameHeaders(m.header, m.originalHeader) || !!m.originalBody;
+  const wrap = el('div');
+  const render = original => {
+    const header = original ? m.originalHeader : m.header;
+    const body = el('div', {}, el('p', { class: 'note' }, 'Loading body...'));
+    wrap.replaceChildren(
+      changed ? el('label', {}, el('input', {
+        type: 'checkbox', checked: original, onchange: e => render(e.target.checked),
+      }), ' Show the original, before the handlers changed it') : '',
+      headersTable(header), body);
+    loadBody(f.id, part, original).then(([bytes, type, truncated, encoding]) => {
+      const notes = [truncated ? 'truncated' : '', encoding ? 'still ' + encoding + ' encoded' : ''];
+      body.replaceChildren(bodyView(bytes, type, notes.filter(Boolean).join(' · ')));
+    }, e => body.replaceChildren(el('p', { class: 'err' }, e.message)));
+  };
+  render(false);
+  return wrap;
+}
+
+async function loadBody(id, part, original) {
+  const resp = await api('GET', '/api/flows/' + id + '/body?part=' + part + (original ? '&original=1' : ''));
+  return [new Uint8Array(await resp.arrayBuffer()),
+    resp.headers.get('X-Flow-Content-Type'),
+    resp.headers.get('X-Flow-Truncated') === 'true',
+    resp.headers.get('X-Flow-Content-Encoding')];
+}
+
+function timingDetail(f) {
+  const t = f.timings;
+  return el('table', { class: 'headers' }, el('tbody', {},
+    el('tr', {}, el('td', {}, 'Start'), el('td', {}, new Date(f.start).toISOString())),
+    el('tr', {}, el('td', {}, 'Send'), el('td', {}, fmtDuration(t.send))),
+    el('tr', {}, el('td', {}, 'Wait'), el('td', {}, fmtDuration(t.wait))),
+    el('tr', {}, el('td', {}, 'Receive'), el('td', {}, fmtDuration(t.receive))),
+    el('tr', {}, el('td', {}, 'Total'), el('td', {}, fmtDuration(t.send + t.wait + t.receive)))));
+}
+
+// downloadCA saves the CA certificate, fetched with the token in the header
+async function downloadCA() {
+  const resp = await api('GET', '/api/ca');
+  const name = /filename=([^;]+)/.exec(resp.headers.get('Content-Disposition') || '');
+  const url = URL.createObjectURL(await resp.blob());
+  const a = el('a', { href: url, download: name ? name[1] : 'gamemitm-ca.crt' });
+  document.body.append(a);
+  a.click();
+  a.remove();
+  // 立即释放可能使下载失败
+  setTimeout(() => URL.revokeObjectURL(url), 1000);
+}
+
+async function replay(id) {
+  try {
+    const res = await apiJSON('POST', '/api/flows/' + id + '/replay');
+    if (res.id) selectFlow(res.id);
+  } catch (e) {
+    fail(e);
+  }
+}
+
+// ---- WebSocket timeline ----
+
+function timeline(messages, start) {
+  const root = el('div', { class: 'timeline' });
+  const t0 = new Date(start).getTime();
+  const add = m => {
+    const data = b64ToBytes(m.data);
+    const up = m.direction === 'client->server';
+    const text = m.type === 1 ? utf8(data) : null;
+    const body = el('div');
+    const item = el('div', { class: 'msg' },
+      el('div', {
+        class: 'head',
+        onclick: () => {
+          if (body.firstChild) {
+            body.replaceChildren();
+            return;
+          }
+          const views = [bodyView(data, '', m.type === 2 ? 'binary' : 'text')];
+          if (m.originalData) {
+            views.push(el('p', { class: 'note' }, 'Original message'),
+              bodyView(b64ToBytes(m.originalData), '', ''));
+          }
+          body.replaceChildren(...views);
+        },
+      },
+      el('span', {}, '+' + ((new Date(m.time).getTime() - t0) / 1000).toFixed(3) + 's'),
+      el('span', { class: up ? 'up' : 'down' }, up ? '→ server' : '← client'),
+      el('span', {}, fmtSize(data.length)),
+      m.originalData ? el('span', { class: 'badge' }, 'modified') : null,
+      el('span', { class: 'preview' }, text !== null ? text.slice(0, 200) : hexDump(data.subarray(0, 16)).slice(10, 59).trim())),
+      body);
+    root.append(item);
+  };
+  messages.forEach(add);
+  if (!messages.length) root.append(el('p', { class: 'empty' }, 'No messages yet'));
+  return { root, add: m => {
+    const empty = root.querySelector('.empty');
+    if (empty) empty.remove();
+    add(m);
+  } };
+}
+
+// ---- sessions ----
+
+async function loadSessions() {
+  let sessions;
+  try {
+    sessions = await apiJSON('GET', '/api/sessions');
+  } catch (e) {
+    return;
+  }
+  const tbody = document.querySelector('#session-table tbody');
+  tbody.replaceChildren(...sessions.map(s => {
+    const row = el('tr', { onclick: () => selectSession(s) },
+      el('td', {}, s.id),
+      el('td', { class: 'url', title: s.url }, s.url, s.replayed ? ' (replayed)' : ''),
+      el('td', {}, s.client),
+      el('td', {}, fmtTime(s.start)));
+    if (state.session && state.session.id === s.id) row.classList.add('selected');
+    return row;
+  }));
+  if (state.session && !sessions.some(s => s.id === state.session.id)) {
+    const detail = document.getElementById('session-detail');
+    detail.prepend(el('p', { class: 'err' }, 'The session has ended'));
+    state.session = null;
+    state.timeline = null;
+  }
+}
+
+async function selectSession(s) {
+  state.session = s;
+  state.timeline = null;
+  loadSessions();
+  const detail = document.getElementById('session-detail');
+  let messages;
+  try {
+    messages = await apiJSON('GET', '/api/sessions/' + s.id + '/messages');
+  } catch (e) {
+    detail.replaceChildren(el('p', { class: 'err' }, e.message));
+    return;
+  }
+  const tl = timeline(messages, s.start);
+  state.timeline = tl;
+  const to = el('select', {}, el('option', { value: 'client' }, 'to client'), el('option', { value: 'server' }, 'to server'));
+  const type = el('select', {}, el('option', { value: 'text' }, 'text'), el('option', { value: 'binary' }, 'binary'));
+  const base64 = el('input', { type: 'checkbox' });
+  const data = el('textarea', { rows: 4, spellcheck: 'false' });
+  const inject = async () => {
+    try {
+      await api('POST', '/api/sessions/' + s.id + '/messages', {
+        to: to.value, type: type.value, data: data.value, base64: base64.checked,
+      });
+    } catch (e) {
+      fail(e);
+    }
+  };
+  const close = async () => {
+    try {
+      await api('DELETE', '/api/sessions/' + s.id);
+      loadSessions();
+    } catch (e) {
+      fail(e);
+    }
+  };
+  detail.replaceChildren(
+    el('div', { class: 'summary' }, el('b', {}, 'WebSocket'), ' ', s.url),
+    el('div', { class: 'actions' }, el('button', { onclick: close }, 'Close session')),
+    el('div', { class: 'inject' },
+      el('div', { class: 'row' }, 'Inject', to, type, el('label', {}, base64, ' base64'),
+        el('button', { class: 'primary', onclick: inject }, 'Send')),
+      data),
+    tl.root);
+}
+
+// ---- connections and handlers ----
+
+async function loadConnections() {
+  let conns;
+  try {
+    conns = await apiJSON('GET', '/api/connections');
+  } catch (e) {
+    return;
+  }
+  document.querySelector('#conn-table tbody').replaceChildren(...conns.map(c => el('tr', {},
+    el('td', {}, c.id),
+    el('td', {}, c.client),
+    el('td', { class: 'url' }, c.target || '(proxy requests)'),
+    el('td', {}, fmtTime(c.start)),
+    el('td', {}, el('button', {
+      onclick: () => api('DELETE', '/api/connections/' + c.id).then(loadConnections, fail),
+    }, 'Kill')))));
+}
+
+async function loadHandlers() {
+  let handlers;
+  try {
+    handlers = await apiJSON('GET', '/api/handlers');
+  } catch (e) {
+    return;
+  }
+  document.querySelector('#handler-table tbody').replaceChildren(...handlers.map(h => el('tr', {},
+    el('td', {}, h.id),
+    el('td', {}, h.type),
+    el('td', { class: 'url' }, h.name),
+    el('td', {}, h.priority),
+    el('td', {}, el('input', {
+      type: 'checkbox',
+      checked: h.enabled,
+      onchange: e => api('PUT', '/api/handlers/' + h.id, { enabled: e.target.checked }).catch(err => {
+        e.target.checked = !e.target.checked;
+        fail(err);
+      }),
+    })))));
+}
+
+// ---- editor ----
+
+async function openEditor(f) {
+  const method = document.getElementById('ed-method');
+  const url = document.getElementById('ed-url');
+  const headers = document.getElementById('ed-headers');
+  const body = document.getElementById('ed-body');
+  const base64 = document.getElementById('ed-base64');
+  method.value = 'GET';
+  url.value = '';
+  headers.value = '';
+  body.value = '';
+  base64.checked = false;
+  if (f) {
+    method.value = f.request.method;
+    url.value = f.request.url;
+    let bytes, encoding;
+    try {
+      [bytes, , , encoding] = await loadBody(f.id, 'request', false);
+    } catch (e) {
+      fail(e);
+      return;
+    }
+    // 编辑的是解压后的内容时去掉 Content-Encoding
+    const lines = [];
+    for (const name of Object.keys(f.request.header || {}).sort()) {
+      if (!encoding && name.toLowerCase() === 'content-encoding') continue;
+      for (const v of f.request.header[name]) lines.push(name + ': ' + v);
+    }
+    headers.value = lines.join('\n');
+    const text = utf8(bytes);
+    base64.checked = text === null;
+    body.value = text === null ? bytesToB64(bytes) : text;
+  }
+  document.getElementById('editor').showModal();
+}
+
+async function sendEditor(e) {
+  e.preventDefault();
+  const header = {};
+  for (const line of document.getElementById('ed-headers').value.split('\n')) {
+    const i = line.indexOf(':');
+    if (i <= 0) continue;
+    const name = line.slice(0, i).trim();
+    (header[name] = header[name] || []).push(line.slice(i + 1).trim());
+  }
+  const text = document.getElementById('ed-body').value;
+  const body = document.getElementById('ed-base64').checked
+    ? text.replace(/\s+/g, '')
+    : bytesToB64(new TextEncoder().encode(text));
+  try {
+    const res = await apiJSON('POST', '/api/requests', {
+      method: document.getElementById('ed-method').value.trim(),
+      url: document.getElementById('ed-url').value.trim(),
+      header,
+      body,
+    });
+    document.getElementById('editor').close();
+    showView('flows');
+    if (res.id) selectFlow(res.id);
+  } catch (err) {
+    fail(err);
+  }
+}
+
+// ---- page ----
+
+let refresh = null;
+
+function showView(name) {
+  document.querySelectorAll('#tabs button').forEach(b => b.classList.toggle('active', b.dataset.view === name));
+  document.querySelectorAll('.view').forEach(v => v.classList.toggle('active', v.id === name));
+  clearInterval(refresh);
+  refresh = null;
+  const loaders = { sessions: loadSessions, connections: loadConnections, handlers: loadHandlers };
+  if (loaders[name]) {
+    loaders[name]();
+    refresh = setInterval(loaders[name], 2000);
+  }
+}
+
+function connectEvents() {
+  const status = document.getElementById('status');
+  const events = new EventSource(withToken('/api/events'));
+  events.onopen = () => {
+    status.textContent = 'live';
+    status.classList.remove('down');
+  };
+  events.onerror = () => {
+    status.textContent = 'disconnected';
+    status.classList.add('down');
+  };
+  events.addEventListener('flow', e => addFlow(JSON.parse(e.data)));
+  events.addEventListener('message', e => {
+    const ev = JSON.parse(e.data);
+    if (state.timeline && state.session && state.session.flowId === ev.flowId) state.timeline.add(ev.message);
+  });
+}
+
+async function init() {
+  document.querySelectorAll('#tabs button').forEach(b => b.addEventListener('click', () => showView(b.dataset.view)));
+  document.getElementById('filter').addEventListener('input', e => {
+    state.filter = parseFilter(e.target.value);
+    renderFlows();
+  });
+  document.getElementById('pause').addEventListener('change', e => {
+    if (!e.target.checked) {
+      const queued = state.paused;
+      state.paused = [];
+      queued.forEach(addFlow);
+    }
+  });
+  document.getElementById('clear').addEventListener('click', () => {
+    state.flows = [];
+    state.ids.clear();
+    renderFlows();
+  });
+  document.getElementById('compose').addEventListener('click', () => openEditor(null));
+  document.getElementById('ed-send').addEventListener('click', sendEditor);
+  document.getElementById('ca').addEventListener('click', e => {
+    e.preventDefault();
+    downloadCA().catch(fail);
+  });
+  const verbose = document.getElementById('verbose');
+  verbose.addEventListener('change', () => api('PUT', '/api/verbose', { verbose: verbose.checked }).catch(fail));
+
+  try {
+    verbose.checked = (await apiJSON('GET', '/api/verbose')).verbose;
+  } catch (e) {
+    document.getElementById('status').textContent = e.message;
+    document.getElementById('status').classList.add('down');
+    return;
+  }
+  connectEvents();
+  const flows = await apiJSON('GET', '/api/flows');
+  const live = state.flows;
+  state.flows = [];
+  state.ids.clear();
+  flows.concat(live).forEach(f => {
+    if (!state.ids.has(f.id)) {
+      state.flows.push(f);
+      state.ids.add(f.id);
+    }
+  });
+  renderFlows();
+}
+
+init();
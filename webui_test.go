@@ -0,0 +1,76 @@
+package gamemitm
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWebUI(t *testing.T) {
+	p, _ := newTestProxy(t)
+	base := startAdmin(t, p, AdminConfig{Token: "secret"})
+
+	tests := []struct {
+		path        string
+		contentType string
+		contains    string
+	}{
+		{"/", "text/html", `<script src="app.js">`},
+		{"/?token=secret", "text/html", `<a id="ca"`},
+		{"/app.js", "javascript", "async function api("},
+		{"/style.css", "text/css", "{"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			// 页面不需要令牌，接口数据仍然需要
+			resp, err := http.Get(base + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, tt.contentType) {
+				t.Errorf("Content-Type = %q, want %s", ct, tt.contentType)
+			}
+			if csp := resp.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") {
+				t.Errorf("Content-Security-Policy = %q", csp)
+			}
+			if resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+				t.Error("X-Content-Type-Options is not nosniff")
+			}
+			if !strings.Contains(string(body), tt.contains) {
+				t.Errorf("body does not contain %q", tt.contains)
+			}
+		})
+	}
+
+	if resp, _ := adminDo(t, "GET", base+"/missing.js", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d for a missing file", resp.StatusCode)
+	}
+	if resp, _ := adminDo(t, "GET", base+"/api/flows", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d for the API without the token", resp.StatusCode)
+	}
+}
+
+func TestWebUIFlowBodyNotRendered(t *testing.T) {
+	p, client := newTestProxy(t)
+	base := startAdmin(t, p, AdminConfig{})
+	upstream := echoServer(t)
+
+	// 记录的 HTML 以二进制返回，不会在管理页面的源中执行
+	doText(t, client, "POST", upstream.URL, "<script>alert(1)</script>")
+	var flows []flowSummary
+	waitFor(t, func() bool {
+		adminJSON(t, "GET", base+"/api/flows", "", "", &flows)
+		return len(flows) == 1
+	})
+	resp, _ := adminDo(t, "GET", base+"/api/flows/"+strconv.FormatUint(flows[0].ID, 10)+"/body", "", "")
+	if resp.Header.Get("Content-Type") != "application/octet-stream" || resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("body served as %q, options %q", resp.Header.Get("Content-Type"), resp.Header.Get("X-Content-Type-Options"))
+	}
+}